@@ -1,3 +1,4 @@
 #!/usr/bin/env bash
 
 go build -o stream-controller cmd/main.go
+go build -o migrate-keys cmd/migrate-keys/main.go
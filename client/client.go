@@ -0,0 +1,263 @@
+// Package client calls the stream-controller REST API
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// number of times requests failing with server errors are retried by default
+	defaultRetries = 3
+
+	// delay before the first retry by default, which doubles with each retry
+	defaultBackoff = 100 * time.Millisecond
+
+	// maximum size in bytes of the response bodies read
+	maxBodySize = 1 << 20
+
+	jsonContentType = "application/json"
+
+	// header identifying retries of the same PUT or DELETE request to the service
+	idempotencyKeyHeader = "Idempotency-Key"
+)
+
+// Device describes the device on which a stream is watched; the service defaults the IP address and user agent to
+// those of the request
+type Device struct {
+	DeviceID   string `json:"deviceID,omitempty"`
+	DeviceType string `json:"deviceType,omitempty"`
+	AppVersion string `json:"appVersion,omitempty"`
+	IP         string `json:"ip,omitempty"`
+	UserAgent  string `json:"userAgent,omitempty"`
+}
+
+// Session a stream being watched by a user, the device it is watched on and when its lease expires
+type Session struct {
+	StreamID  string    `json:"streamID"`
+	Device    Device    `json:"device"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Stream a stream that was started, stopped or renewed; starting a stream may evict others to make room for it
+type Stream struct {
+	UserID   string   `json:"userID"`
+	StreamID string   `json:"streamID"`
+	Evicted  []string `json:"evicted,omitempty"`
+}
+
+// Streams the streams being watched by a user, the number they may watch concurrently and how many more they may
+// start
+type Streams struct {
+	UserID    string    `json:"userID"`
+	Streams   []string  `json:"streams"`
+	Sessions  []Session `json:"sessions"`
+	Limit     int       `json:"limit"`
+	Remaining int       `json:"remaining"`
+}
+
+// Option configures the client
+type Option func(*Client)
+
+// WithHTTPClient sends requests with the HTTP client rather than http.DefaultClient
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithBearerToken authenticates requests with the bearer token
+func WithBearerToken(token string) Option {
+	return WithTokenSource(func(context.Context) (string, error) {
+		return token, nil
+	})
+}
+
+// WithTokenSource authenticates each request with the bearer token returned by the source, e.g. to refresh
+// tokens before they expire
+func WithTokenSource(source func(ctx context.Context) (string, error)) Option {
+	return func(c *Client) {
+		c.tokenSource = source
+	}
+}
+
+// WithRetries sets the number of times requests failing with server errors or network failures are retried and the
+// delay before the first retry, which doubles with each retry; requests are retried 3 times after 100ms by default
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.retries = retries
+		c.backoff = backoff
+	}
+}
+
+// Client calls the stream-controller REST API on behalf of users; it is safe for concurrent use
+type Client struct {
+	baseURL     string
+	httpClient  *http.Client
+	tokenSource func(ctx context.Context) (string, error)
+	retries     int
+	backoff     time.Duration
+}
+
+// New creates a new client calling the service at the base URL, e.g. http://stream-controller:8080
+func New(baseURL string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.Errorf("base url %q must be an http or https url", baseURL)
+	}
+	c := &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: http.DefaultClient,
+		retries:    defaultRetries,
+		backoff:    defaultBackoff,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// StartStream records the user as watching the stream on the device, which may be nil; it fails with an error
+// wrapping ErrQuotaExceeded if the user has exceeded their streaming quota
+func (c *Client) StartStream(ctx context.Context, userID, streamID string, device *Device) (*Stream, error) {
+	var body []byte
+	if device != nil {
+		var err error
+		if body, err = json.Marshal(device); err != nil {
+			return nil, errors.Wrap(err, "cannot encode device")
+		}
+	}
+	stream := &Stream{}
+	if err := c.do(ctx, http.MethodPut, streamPath(userID, streamID), body, stream); err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// StopStream removes the record of the user watching the stream
+func (c *Client) StopStream(ctx context.Context, userID, streamID string) (*Stream, error) {
+	stream := &Stream{}
+	if err := c.do(ctx, http.MethodDelete, streamPath(userID, streamID), nil, stream); err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Heartbeat extends the lease of a stream the user is watching; it fails with an error wrapping ErrStreamNotFound if
+// the user is not watching the stream or its lease has expired
+func (c *Client) Heartbeat(ctx context.Context, userID, streamID string) (*Stream, error) {
+	stream := &Stream{}
+	if err := c.do(ctx, http.MethodPost, streamPath(userID, streamID)+"/heartbeat", nil, stream); err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// ListStreams returns the streams being watched by the user with their devices and the user's limit
+func (c *Client) ListStreams(ctx context.Context, userID string) (*Streams, error) {
+	streams := &Streams{}
+	if err := c.do(ctx, http.MethodGet, userPath(userID), nil, streams); err != nil {
+		return nil, err
+	}
+	return streams, nil
+}
+
+// do sends the request, retrying it with exponential backoff whilst it fails with server errors or network failures,
+// and decodes the JSON response into the result; PUT and DELETE requests carry the same idempotency key on every
+// attempt so that a retried request is not applied twice
+func (c *Client) do(ctx context.Context, method, path string, body []byte, result interface{}) error {
+	var key string
+	if method == http.MethodPut || method == http.MethodDelete {
+		var err error
+		if key, err = newIdempotencyKey(); err != nil {
+			return err
+		}
+	}
+
+	backoff := c.backoff
+	for attempt := 0; ; attempt++ {
+		err := c.send(ctx, method, path, key, body, result)
+		if err == nil || attempt >= c.retries || !retryable(err) || ctx.Err() != nil {
+			return err
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+func (c *Client) send(ctx context.Context, method, path, key string, body []byte, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, c.baseURL+path, reader)
+	if err != nil {
+		return errors.Wrap(err, "cannot create request")
+	}
+	req.Header.Set("Accept", jsonContentType)
+	if body != nil {
+		req.Header.Set("Content-Type", jsonContentType)
+	}
+	if key != "" {
+		req.Header.Set(idempotencyKeyHeader, key)
+	}
+	if c.tokenSource != nil {
+		token, err := c.tokenSource(ctx)
+		if err != nil {
+			return errors.Wrap(err, "cannot get bearer token")
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return &networkError{err: err}
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+	if err != nil {
+		return &networkError{err: err}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return newError(resp, data)
+	}
+	if err := json.Unmarshal(data, result); err != nil {
+		return errors.Wrap(err, "cannot decode response")
+	}
+	return nil
+}
+
+func userPath(userID string) string {
+	return "/v1/users/" + url.PathEscape(userID)
+}
+
+func streamPath(userID, streamID string) string {
+	return userPath(userID) + "/streams/" + url.PathEscape(streamID)
+}
+
+// newIdempotencyKey returns a random key identifying the attempts of a single request
+func newIdempotencyKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "cannot generate idempotency key")
+	}
+	return hex.EncodeToString(b), nil
+}
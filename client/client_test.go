@@ -0,0 +1,250 @@
+package client
+
+import (
+	"context"
+	"github.com/golang-jwt/jwt"
+	"github.com/pkg/errors"
+	"github.com/prgodlonton/stream-controller/internal"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testSecret = []byte("intentionally-insecure-secret")
+
+func TestShouldStartListAndStopStreams(t *testing.T) {
+	server := newServer(2)
+	defer server.Close()
+	client := newClient(t, server.URL)
+	ctx := context.Background()
+
+	stream, err := client.StartStream(ctx, "alan", "boxing1", &Device{DeviceType: "tv", UserAgent: "tv-app"})
+	assert.NoError(t, err)
+	assert.Equal(t, &Stream{UserID: "alan", StreamID: "boxing1"}, stream)
+
+	streams, err := client.ListStreams(ctx, "alan")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"boxing1"}, streams.Streams)
+	assert.Equal(t, 2, streams.Limit)
+	assert.Equal(t, 1, streams.Remaining)
+	if assert.Len(t, streams.Sessions, 1) {
+		assert.Equal(t, "tv", streams.Sessions[0].Device.DeviceType)
+		assert.Equal(t, "tv-app", streams.Sessions[0].Device.UserAgent)
+		assert.False(t, streams.Sessions[0].ExpiresAt.IsZero())
+	}
+
+	_, err = client.Heartbeat(ctx, "alan", "boxing1")
+	assert.NoError(t, err)
+
+	stream, err = client.StopStream(ctx, "alan", "boxing1")
+	assert.NoError(t, err)
+	assert.Equal(t, "boxing1", stream.StreamID)
+
+	streams, err = client.ListStreams(ctx, "alan")
+	assert.NoError(t, err)
+	assert.Empty(t, streams.Streams)
+}
+
+func TestShouldReturnQuotaExceededErrorWhenUserHasReachedStreamQuotaLimit(t *testing.T) {
+	server := newServer(1)
+	defer server.Close()
+	client := newClient(t, server.URL)
+	ctx := context.Background()
+
+	_, err := client.StartStream(ctx, "becky", "rugby7", nil)
+	assert.NoError(t, err)
+	_, err = client.StartStream(ctx, "becky", "tennis2", nil)
+
+	assert.True(t, errors.Is(err, ErrQuotaExceeded))
+	var apiErr *Error
+	if assert.True(t, errors.As(err, &apiErr)) {
+		assert.Equal(t, http.StatusConflict, apiErr.Status)
+		assert.Equal(t, 1, apiErr.Limit)
+		assert.Equal(t, []string{"rugby7"}, apiErr.Streams)
+		assert.True(t, apiErr.RetryAfter > 0)
+	}
+}
+
+func TestShouldReturnStreamNotFoundErrorWhenRenewedStreamIsNotBeingWatched(t *testing.T) {
+	server := newServer(1)
+	defer server.Close()
+
+	_, err := newClient(t, server.URL).Heartbeat(context.Background(), "charles", "golf4")
+
+	assert.True(t, errors.Is(err, ErrStreamNotFound))
+}
+
+func TestShouldRetryServerErrors(t *testing.T) {
+	var attempts int32
+	router := newRouter(1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		router.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	_, err := newClient(t, server.URL).StartStream(context.Background(), "dorothy", "squash5", nil)
+
+	assert.NoError(t, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&attempts))
+}
+
+func TestShouldSendSameIdempotencyKeyWhenRetryingRequest(t *testing.T) {
+	var attempts int32
+	keys := make(chan string, 10)
+	router := newRouter(1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys <- r.Method + " " + r.Header.Get("Idempotency-Key")
+		if r.Method == http.MethodPut && atomic.AddInt32(&attempts, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		router.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	client := newClient(t, server.URL)
+
+	_, err := client.StartStream(context.Background(), "dorothy", "squash5", nil)
+	assert.NoError(t, err)
+	_, err = client.Heartbeat(context.Background(), "dorothy", "squash5")
+	assert.NoError(t, err)
+	_, err = client.StopStream(context.Background(), "dorothy", "squash5")
+	assert.NoError(t, err)
+	close(keys)
+
+	var sent []string
+	for key := range keys {
+		sent = append(sent, key)
+	}
+	if assert.Len(t, sent, 5) {
+		assert.Regexp(t, "^PUT [0-9a-f]{32}$", sent[0])
+		assert.Equal(t, sent[0], sent[1])
+		assert.Equal(t, sent[0], sent[2])
+		assert.Equal(t, "POST ", sent[3])
+		assert.Regexp(t, "^DELETE [0-9a-f]{32}$", sent[4])
+		assert.NotEqual(t, sent[0][len("PUT "):], sent[4][len("DELETE "):])
+	}
+}
+
+func TestShouldRetryWhilstEarlierAttemptIsInProgress(t *testing.T) {
+	var attempts int32
+	router := newRouter(1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) <= 2 {
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"status":409,"code":"request_in_progress","title":"Request in progress"}`))
+			return
+		}
+		router.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	_, err := newClient(t, server.URL).StopStream(context.Background(), "edward", "darts2")
+
+	assert.NoError(t, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&attempts))
+}
+
+func TestShouldGiveUpAfterRetryingServerErrors(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(http.StatusGatewayTimeout)
+		w.Write([]byte(`{"status":504,"code":"store_timeout","title":"Store timeout"}`))
+	}))
+	defer server.Close()
+
+	_, err := newClient(t, server.URL).ListStreams(context.Background(), "dorothy")
+
+	assert.True(t, errors.Is(err, ErrUnavailable))
+	assert.EqualError(t, err, "stream-controller returned 504 Store timeout")
+	assert.Equal(t, int32(4), atomic.LoadInt32(&attempts))
+}
+
+func TestShouldNotRetryClientErrors(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusNotAcceptable)
+	}))
+	defer server.Close()
+
+	_, err := newClient(t, server.URL).ListStreams(context.Background(), "dorothy")
+
+	var apiErr *Error
+	if assert.True(t, errors.As(err, &apiErr)) {
+		assert.Equal(t, http.StatusNotAcceptable, apiErr.Status)
+		assert.Equal(t, "Not Acceptable", apiErr.Title)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&attempts))
+}
+
+func TestShouldStopRetryingWhenContextIsDone(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	client, err := New(server.URL, WithRetries(10, time.Hour))
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = client.ListStreams(ctx, "edward")
+
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+}
+
+func TestShouldAuthenticateWithBearerToken(t *testing.T) {
+	authenticator := internal.NewAuthenticator(testSecret, nil, "service", "admin", 0)
+	server := httptest.NewServer(internal.NewRouter(zap.NewNop().Sugar(), newStore(1), internal.WithAuthenticator(authenticator)))
+	defer server.Close()
+
+	_, err := newClient(t, server.URL).ListStreams(context.Background(), "frank")
+	assert.True(t, errors.Is(err, ErrUnauthorized))
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{Subject: "frank", ExpiresAt: time.Now().Add(time.Hour).Unix()}).SignedString(testSecret)
+	assert.NoError(t, err)
+	client, err := New(server.URL, WithBearerToken(token), WithRetries(0, 0))
+	assert.NoError(t, err)
+
+	_, err = client.ListStreams(context.Background(), "frank")
+	assert.NoError(t, err)
+	_, err = client.ListStreams(context.Background(), "gina")
+	assert.True(t, errors.Is(err, ErrForbidden))
+}
+
+func TestShouldRejectInvalidBaseURL(t *testing.T) {
+	for _, baseURL := range []string{"", "stream-controller:8080", "ftp://stream-controller"} {
+		_, err := New(baseURL)
+		assert.Error(t, err, baseURL)
+	}
+}
+
+func newStore(limit int) internal.Store {
+	return internal.NewMemoryStore(internal.NewMemoryQuotas(limit), time.Minute)
+}
+
+func newRouter(limit int) http.Handler {
+	return internal.NewRouter(zap.NewNop().Sugar(), newStore(limit))
+}
+
+func newServer(limit int) *httptest.Server {
+	return httptest.NewServer(newRouter(limit))
+}
+
+func newClient(t *testing.T, baseURL string) *Client {
+	client, err := New(baseURL, WithRetries(3, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
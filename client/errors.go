@@ -0,0 +1,118 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	// ErrQuotaExceeded the user has exceeded their streaming quota
+	ErrQuotaExceeded = errors.New("streaming quota exceeded")
+
+	// ErrStreamNotFound the user is not watching the stream or its lease has expired
+	ErrStreamNotFound = errors.New("stream not found")
+
+	// ErrInvalidID the user or stream ID was rejected
+	ErrInvalidID = errors.New("invalid identifier")
+
+	// ErrUnauthorized the client did not present a valid bearer token
+	ErrUnauthorized = errors.New("unauthorized")
+
+	// ErrForbidden the bearer token does not permit acting on the user
+	ErrForbidden = errors.New("forbidden")
+
+	// ErrUnavailable the service could not read or update the streams being watched; the request may be retried
+	ErrUnavailable = errors.New("service unavailable")
+)
+
+// code of the problem returned whilst an earlier attempt with the same idempotency key is still in flight
+const requestInProgress = "request_in_progress"
+
+// codeErrors the errors wrapped by the service's problem codes
+var codeErrors = map[string]error{
+	"invalid_id":        ErrInvalidID,
+	"quota_exceeded":    ErrQuotaExceeded,
+	"forbidden":         ErrForbidden,
+	"request_cancelled": ErrUnavailable,
+	requestInProgress:   ErrUnavailable,
+	"store_timeout":     ErrUnavailable,
+	"store_unavailable": ErrUnavailable,
+	"stream_not_found":  ErrStreamNotFound,
+	"unauthorized":      ErrUnauthorized,
+}
+
+// Error an unsuccessful response from the service described by its problem details; it wraps the error matching its
+// code, if any, so that it may be tested with errors.Is, e.g. errors.Is(err, client.ErrQuotaExceeded)
+type Error struct {
+	Status     int      `json:"status"`
+	Code       string   `json:"code"`
+	Title      string   `json:"title"`
+	Detail     string   `json:"detail"`
+	UserID     string   `json:"userID"`
+	StreamID   string   `json:"streamID"`
+	Field      string   `json:"field"`
+	Streams    []string `json:"streams"`
+	Limit      int      `json:"limit"`
+	DeviceType string   `json:"deviceType"`
+
+	// RetryAfter the time until the user's soonest expiring stream releases its slot when the quota was exceeded
+	RetryAfter time.Duration `json:"-"`
+}
+
+// newError reads the problem details of the response, falling back on its status if it has none
+func newError(resp *http.Response, body []byte) *Error {
+	e := &Error{}
+	if err := json.Unmarshal(body, e); err != nil {
+		e = &Error{}
+	}
+	e.Status = resp.StatusCode
+	if e.Title == "" {
+		e.Title = http.StatusText(resp.StatusCode)
+	}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		e.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return e
+}
+
+func (e *Error) Error() string {
+	if e.Detail != "" {
+		return fmt.Sprintf("stream-controller returned %d %v: %v", e.Status, e.Title, e.Detail)
+	}
+	return fmt.Sprintf("stream-controller returned %d %v", e.Status, e.Title)
+}
+
+// Unwrap returns the error matching the problem's code, or nil if there is none
+func (e *Error) Unwrap() error {
+	return codeErrors[e.Code]
+}
+
+// networkError a request that could not be sent or whose response could not be read
+type networkError struct {
+	err error
+}
+
+func (e *networkError) Error() string {
+	return "cannot call stream-controller: " + e.err.Error()
+}
+
+func (e *networkError) Unwrap() error {
+	return e.err
+}
+
+// retryable returns true if the request failed with a server error or network failure, or an earlier attempt is still
+// in flight
+func retryable(err error) bool {
+	switch e := err.(type) {
+	case *Error:
+		return e.Status >= http.StatusInternalServerError || (e.Status == http.StatusConflict && e.Code == requestInProgress)
+	case *networkError:
+		return true
+	default:
+		return false
+	}
+}
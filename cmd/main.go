@@ -2,20 +2,31 @@ package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
 	"github.com/prgodlonton/stream-controller/internal/startup"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"syscall"
 	"time"
 )
 
 // main entry point
 func main() {
-	config := startup.ReadConfiguration()
+	path := flag.String("config", "", "path to a JSON or YAML configuration file")
+	flag.Parse()
+
+	config, err := startup.ReadConfiguration(*path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot read configuration: %v\n", err)
+		os.Exit(1)
+	}
 	resolver := startup.NewResolver(config)
 
-	signals := make(chan os.Signal)
-	signal.Notify(signals, os.Interrupt, os.Kill)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
 
 	logger := resolver.ResolveLogger()
 	logger.Info("starting...")
@@ -28,19 +39,83 @@ func main() {
 		}
 	}()
 
-	// listen for interrupt/kill signal
+	// start grpc server, if configured
+	grpcServer := resolver.ResolveGRPCServer()
+	if grpcServer != nil {
+		listener, err := net.Listen("tcp", config.Server.GRPCAddress)
+		if err != nil {
+			logger.Errorw("cannot listen for grpc requests", "address", config.Server.GRPCAddress, "error", err)
+			os.Exit(1)
+		}
+		go func() {
+			if err := grpcServer.Serve(listener); err != nil {
+				logger.Errorw("unexpected grpc server serve error", "error", err)
+			}
+		}()
+	}
+
+	// expire the leases that are not renewed, if configured
+	sweeper := resolver.ResolveSweeper()
+	if sweeper != nil {
+		sweeper.Start()
+	}
+	health := resolver.ResolveHealth()
+	publisher := resolver.ResolvePublisher()
+
+	// watch for configuration changes once every dependency is resolved, as reloads replace the configuration that
+	// resolving reads
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	go startup.WatchConfiguration(watchCtx, *path, resolver)
+
+	// listen for interrupt/terminate signal
 	s := <-signals
 	logger.Infow("caught signal: stopping...", "signal", s)
+	stopWatching()
+	config = resolver.Config()
 
-	// shutdown server
+	// fail readiness checks so the load balancer drains the server before it stops accepting requests
+	health.Drain()
+	time.Sleep(time.Duration(config.Server.DrainDelay) * time.Second)
+
+	// shutdown servers
 	waitTime := time.Duration(config.Server.ShutdownTimeout) * time.Second
 	ctx, cfn := context.WithTimeout(context.Background(), waitTime)
 	defer cfn()
 
+	grpcStopped := make(chan struct{})
+	go func() {
+		if grpcServer != nil {
+			grpcServer.GracefulStop()
+		}
+		close(grpcStopped)
+	}()
+
 	if err := server.Shutdown(ctx); err != nil {
 		logger.Errorw("unclean http server shutdown", "error", err)
 		os.Exit(1)
 	}
 
+	select {
+	case <-grpcStopped:
+	case <-ctx.Done():
+		if grpcServer != nil {
+			grpcServer.Stop()
+		}
+		logger.Errorw("unclean grpc server shutdown", "error", ctx.Err())
+		os.Exit(1)
+	}
+
+	if sweeper != nil {
+		sweeper.Stop()
+	}
+
+	// deliver the domain events queued by the last requests and close the sink
+	if publisher != nil {
+		if err := publisher.Close(ctx); err != nil {
+			logger.Errorw("unclean domain event publisher shutdown", "error", err)
+			os.Exit(1)
+		}
+	}
+
 	logger.Info("stopped gracefully")
 }
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/prgodlonton/stream-controller/internal"
+	"github.com/prgodlonton/stream-controller/internal/startup"
+	"os"
+	"time"
+)
+
+// main entry point of the one-off migration of the unprefixed keys written by earlier versions into the configured
+// key space
+func main() {
+	path := flag.String("config", "", "path to a JSON or YAML configuration file")
+	match := flag.String("match", "", "SCAN pattern matching the legacy keys of users' streams, e.g. * (required)")
+	dryRun := flag.Bool("dry-run", false, "list the keys that would be migrated without changing them")
+	flag.Parse()
+
+	if *match == "" {
+		fmt.Fprintln(os.Stderr, "cannot migrate keys: -match is required")
+		os.Exit(1)
+	}
+
+	config, err := startup.ReadConfiguration(*path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot read configuration: %v\n", err)
+		os.Exit(1)
+	}
+	if config.Store.Type != startup.RedisStoreType {
+		fmt.Fprintf(os.Stderr, "cannot migrate keys: store type is %q\n", config.Store.Type)
+		os.Exit(1)
+	}
+	if config.Redis.Mode == startup.RedisClusterMode {
+		// earlier versions only supported a single server so their keys must be migrated before moving to a cluster
+		fmt.Fprintln(os.Stderr, "cannot migrate keys: redis mode is cluster")
+		os.Exit(1)
+	}
+
+	// only the redis client and the key space are needed, so the service's other dependencies are not resolved
+	logger := startup.NewLogger(config)
+	ids, err := internal.NewIDValidator(config.IDs.MaxLength, config.IDs.Pattern, config.IDs.UUIDUserIDs, config.IDs.UUIDStreamIDs)
+	if err != nil {
+		logger.Errorw("invalid id rules", "error", err)
+		os.Exit(1)
+	}
+	client, err := startup.NewRedisClient(config)
+	if err != nil {
+		logger.Errorw("cannot connect to redis", "error", err)
+		os.Exit(1)
+	}
+	logger.Infow("migrating keys...", "prefix", config.Redis.KeyPrefix, "match", *match, "dryRun", *dryRun)
+
+	migrated, err := internal.MigrateKeys(logger, client, internal.NewKeySpace(config.Redis.KeyPrefix), internal.MigrationOptions{
+		Match:         *match,
+		IDs:           ids,
+		LeaseDuration: time.Duration(config.Stream.LeaseDuration) * time.Second,
+		DryRun:        *dryRun,
+	})
+	if err != nil {
+		logger.Errorw("cannot migrate keys", "migrated", migrated, "error", err)
+		os.Exit(1)
+	}
+
+	logger.Infow("migrated keys", "migrated", migrated)
+}
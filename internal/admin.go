@@ -0,0 +1,226 @@
+package internal
+
+import (
+	"encoding/json"
+	"github.com/go-chi/chi"
+	"go.uber.org/zap"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// number of users returned per page when listing users if the count is not given
+	defaultUsersPageSize = 100
+)
+
+// usersResponse the JSON body returned when listing the users watching streams; the cursor is empty once all users
+// have been returned
+type usersResponse struct {
+	Users  []string `json:"users"`
+	Cursor string   `json:"cursor,omitempty"`
+}
+
+// userResponse the JSON body returned when fetching a user's session detail
+type userResponse struct {
+	UserID  string            `json:"userID"`
+	Limit   int               `json:"limit"`
+	Streams []sessionResponse `json:"streams"`
+}
+
+// limitRequest the JSON body of a request overriding a user's limit; the duration is given in seconds and the
+// override does not expire if it is zero
+type limitRequest struct {
+	Limit    int `json:"limit"`
+	Duration int `json:"duration"`
+}
+
+// limitResponse the JSON body returned when a user's limit is overridden
+type limitResponse struct {
+	UserID   string `json:"userID"`
+	Limit    int    `json:"limit"`
+	Duration int    `json:"duration"`
+}
+
+// adminRouter creates the routes of the admin API, which may only be used by callers having the admin role
+func adminRouter(logger *zap.SugaredLogger, store Store, authenticator *Authenticator, notifier Notifier, ids *IDValidator) http.Handler {
+	router := chi.NewRouter()
+	router.Use(authenticate(logger, authenticator))
+	router.Use(requireRole(logger, authenticator.adminRole))
+	router.Get("/users", listUsers(logger, store))
+	router.Route("/users/{userID}", func(r chi.Router) {
+		r.Use(validateURLParam(logger, ids, "userID"))
+		r.Get("/", getUser(logger, store))
+		r.Put("/limit", overrideLimit(logger, store, notifier))
+		r.Delete("/streams", terminateAllStreams(logger, store, notifier))
+		r.With(validateURLParam(logger, ids, "streamID")).Delete("/streams/{streamID}", terminateStream(logger, store, notifier))
+	})
+	return router
+}
+
+func listUsers(logger *zap.SugaredLogger, store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var cursor uint64
+		if value := r.URL.Query().Get("cursor"); value != "" {
+			var err error
+			if cursor, err = strconv.ParseUint(value, 10, 64); err != nil {
+				writeProblem(logger, w, invalidRequest("cursor", "cursor must be a cursor returned by a previous page"))
+				return
+			}
+		}
+		count := int64(defaultUsersPageSize)
+		if value := r.URL.Query().Get("count"); value != "" {
+			var err error
+			if count, err = strconv.ParseInt(value, 10, 64); err != nil || count <= 0 {
+				writeProblem(logger, w, invalidRequest("count", "count must be a positive integer"))
+				return
+			}
+		}
+
+		userIDs, next, err := store.ListUsers(r.Context(), cursor, count)
+		if err != nil {
+			logger.Errorw(
+				"cannot list users",
+				"error", err,
+			)
+			writeProblem(logger, w, storeProblem(err, "", ""))
+			return
+		}
+		response := usersResponse{Users: userIDs}
+		if response.Users == nil {
+			response.Users = []string{}
+		}
+		if next != 0 {
+			response.Cursor = strconv.FormatUint(next, 10)
+		}
+		writeJSON(logger, w, http.StatusOK, response)
+	}
+}
+
+func getUser(logger *zap.SugaredLogger, store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := chi.URLParam(r, "userID")
+		sessions, err := store.GetSessions(r.Context(), userID)
+		if err != nil {
+			logger.Errorw(
+				"cannot get sessions",
+				"userID", userID,
+				"error", err,
+			)
+			writeProblem(logger, w, storeProblem(err, userID, ""))
+			return
+		}
+		limit, err := store.GetLimit(r.Context(), userID)
+		if err != nil {
+			logger.Errorw(
+				"cannot get stream limit",
+				"userID", userID,
+				"error", err,
+			)
+			writeProblem(logger, w, storeProblem(err, userID, ""))
+			return
+		}
+		writeJSON(logger, w, http.StatusOK, userResponse{
+			UserID:  userID,
+			Limit:   limit,
+			Streams: toSessionResponses(sessions),
+		})
+	}
+}
+
+func overrideLimit(logger *zap.SugaredLogger, store Store, notifier Notifier) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := chi.URLParam(r, "userID")
+		var request limitRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeProblem(logger, w, invalidRequest("", "the body must be a JSON object holding the limit"))
+			return
+		}
+		if request.Limit < 0 {
+			writeProblem(logger, w, invalidRequest("limit", "limit must not be negative"))
+			return
+		}
+		if request.Duration < 0 {
+			writeProblem(logger, w, invalidRequest("duration", "duration must not be negative"))
+			return
+		}
+
+		duration := time.Duration(request.Duration) * time.Second
+		if err := store.SetLimit(r.Context(), userID, request.Limit, duration); err != nil {
+			logger.Errorw(
+				"cannot override stream limit",
+				"userID", userID,
+				"error", err,
+			)
+			writeProblem(logger, w, storeProblem(err, userID, ""))
+			return
+		}
+		logger.Infow(
+			"overrode stream limit",
+			"userID", userID,
+			"limit", request.Limit,
+			"duration", duration,
+		)
+		notify(r.Context(), logger, notifier, Event{Type: LimitChangedEvent, UserID: userID, Limit: &request.Limit})
+		writeJSON(logger, w, http.StatusOK, limitResponse{
+			UserID:   userID,
+			Limit:    request.Limit,
+			Duration: request.Duration,
+		})
+	}
+}
+
+func terminateAllStreams(logger *zap.SugaredLogger, store Store, notifier Notifier) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := chi.URLParam(r, "userID")
+		change, err := store.RemoveAllStreams(r.Context(), userID)
+		if err != nil {
+			logger.Errorw(
+				"cannot remove streams",
+				"userID", userID,
+				"error", err,
+			)
+			writeProblem(logger, w, storeProblem(err, userID, ""))
+			return
+		}
+		logger.Infow(
+			"terminated all streams",
+			"userID", userID,
+		)
+		notifyExpired(r.Context(), logger, notifier, userID, change.Expired)
+		notify(r.Context(), logger, notifier, Event{Type: SessionRevokedEvent, UserID: userID})
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func terminateStream(logger *zap.SugaredLogger, store Store, notifier Notifier) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, streamID := getURLParams(r)
+		change, err := store.RemoveStream(r.Context(), userID, streamID)
+		if err != nil {
+			logger.Errorw(
+				"cannot remove stream",
+				"userID", userID,
+				"streamID", streamID,
+				"error", err,
+			)
+			writeProblem(logger, w, storeProblem(err, userID, streamID))
+			return
+		}
+		logger.Infow(
+			"terminated stream",
+			"userID", userID,
+			"streamID", streamID,
+		)
+		notifyExpired(r.Context(), logger, notifier, userID, change.Expired)
+		notify(r.Context(), logger, notifier, Event{Type: SessionRevokedEvent, UserID: userID, StreamID: streamID})
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func invalidRequest(field, detail string) *problem {
+	p := newProblem(http.StatusBadRequest, invalidRequestCode, "Invalid request")
+	p.Detail = detail
+	p.Field = field
+	return p
+}
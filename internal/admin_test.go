@@ -0,0 +1,171 @@
+package internal
+
+import (
+	"bytes"
+	"github.com/golang-jwt/jwt"
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+	"github.com/prgodlonton/stream-controller/internal/session"
+	"github.com/prgodlonton/stream-controller/testing/mocks"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestShouldForbidCallerWithoutAdminRoleUsingAdminAPI(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+
+	w := serveAdmin(t, store, Roles{"service"}, "DELETE", "admin/v1/users/alan/streams", "")
+
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestShouldListUsersPageByPage(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+	store.EXPECT().ListUsers(gomock.Any(), uint64(0), int64(2)).Return([]string{"alan", "becky"}, uint64(17), nil)
+	store.EXPECT().ListUsers(gomock.Any(), uint64(17), int64(100)).Return([]string{"charles"}, uint64(0), nil)
+
+	w := serveAdmin(t, store, Roles{"admin"}, "GET", "admin/v1/users?count=2", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"users":["alan","becky"],"cursor":"17"}`, w.Body.String())
+
+	w = serveAdmin(t, store, Roles{"admin"}, "GET", "admin/v1/users?cursor=17", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"users":["charles"]}`, w.Body.String())
+}
+
+func TestShouldRejectInvalidUsersCursor(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+
+	w := serveAdmin(t, store, Roles{"admin"}, "GET", "admin/v1/users?cursor=abc", "")
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), `"field":"cursor"`)
+}
+
+func TestShouldReturnUserSessionDetail(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+	store.EXPECT().GetSessions(gomock.Any(), "alan").Return([]session.Session{
+		{StreamID: "boxing1", ExpiresAt: time.Date(2019, 11, 5, 20, 0, 30, 0, time.UTC)},
+		{StreamID: "arts5", Device: session.Device{DeviceType: "tv"}, ExpiresAt: time.Date(2019, 11, 5, 20, 0, 45, 0, time.UTC)},
+	}, nil)
+	store.EXPECT().GetLimit(gomock.Any(), "alan").Return(3, nil)
+
+	w := serveAdmin(t, store, Roles{"admin"}, "GET", "admin/v1/users/alan", "")
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(
+		t,
+		`{"userID":"alan","limit":3,"streams":[
+			{"streamID":"boxing1","device":{},"expiresAt":"2019-11-05T20:00:30Z"},
+			{"streamID":"arts5","device":{"deviceType":"tv"},"expiresAt":"2019-11-05T20:00:45Z"}
+		]}`,
+		w.Body.String(),
+	)
+}
+
+func TestShouldTerminateUserStreams(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+	store.EXPECT().RemoveStream(gomock.Any(), "alan", "boxing1").Return(session.Change{}, nil)
+	store.EXPECT().RemoveAllStreams(gomock.Any(), "alan").Return(session.Change{}, nil)
+
+	w := serveAdmin(t, store, Roles{"admin"}, "DELETE", "admin/v1/users/alan/streams/boxing1", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	w = serveAdmin(t, store, Roles{"admin"}, "DELETE", "admin/v1/users/alan/streams", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+}
+
+func TestShouldReturnInternalServerErrorWhenStreamsCannotBeTerminated(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+	store.EXPECT().RemoveAllStreams(gomock.Any(), "alan").Return(session.Change{}, errors.New("redis unavailable"))
+
+	w := serveAdmin(t, store, Roles{"admin"}, "DELETE", "admin/v1/users/alan/streams", "")
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+}
+
+func TestShouldOverrideUserLimitTemporarily(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+	store.EXPECT().SetLimit(gomock.Any(), "alan", 5, time.Hour).Return(nil)
+
+	w := serveAdmin(t, store, Roles{"admin"}, "PUT", "admin/v1/users/alan/limit", `{"limit":5,"duration":3600}`)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"userID":"alan","limit":5,"duration":3600}`, w.Body.String())
+}
+
+func TestShouldRejectInvalidLimitOverride(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+
+	bodies := []string{"", "not-json", `{"limit":-1}`, `{"limit":5,"duration":-60}`}
+	for _, body := range bodies {
+		w := serveAdmin(t, store, Roles{"admin"}, "PUT", "admin/v1/users/alan/limit", body)
+		assert.Equal(t, http.StatusBadRequest, w.Code, body)
+	}
+}
+
+func TestShouldNotifyPlayersOfRevokedStreamsAndChangedLimits(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+	store.EXPECT().RemoveStream(gomock.Any(), "alan", "boxing1").Return(session.Change{}, nil)
+	store.EXPECT().SetLimit(gomock.Any(), "alan", 0, time.Duration(0)).Return(nil)
+
+	notifier := NewMemoryNotifier()
+	events, unsubscribe := notifier.Subscribe("alan")
+	defer unsubscribe()
+
+	w := serveAdmin(t, store, Roles{"admin"}, "DELETE", "admin/v1/users/alan/streams/boxing1", "", WithNotifier(notifier))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	event := receiveEvent(t, events)
+	assert.Equal(t, SessionRevokedEvent, event.Type)
+	assert.Equal(t, "boxing1", event.StreamID)
+
+	w = serveAdmin(t, store, Roles{"admin"}, "PUT", "admin/v1/users/alan/limit", `{"limit":0}`, WithNotifier(notifier))
+	assert.Equal(t, http.StatusOK, w.Code)
+	event = receiveEvent(t, events)
+	assert.Equal(t, LimitChangedEvent, event.Type)
+	if assert.NotNil(t, event.Limit) {
+		assert.Equal(t, 0, *event.Limit)
+	}
+}
+
+func serveAdmin(t *testing.T, store Store, roles Roles, method, url, body string, opts ...Option) *httptest.ResponseRecorder {
+	r := createHTTPRequest(method, url)
+	r.Body = ioutil.NopCloser(bytes.NewReader([]byte(body)))
+	claims := Claims{StandardClaims: standardClaims("support-desk"), Roles: roles}
+	r.Header.Set("Authorization", "Bearer "+signToken(t, jwt.SigningMethodHS256, testSecret, "", claims))
+	w := httptest.NewRecorder()
+	authenticator := NewAuthenticator(testSecret, nil, "service", "admin", 0)
+	NewRouter(noopLogger, store, append(opts, WithAuthenticator(authenticator))...).ServeHTTP(w, r)
+	return w
+}
@@ -0,0 +1,302 @@
+package internal
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/go-chi/chi"
+	"github.com/golang-jwt/jwt"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// bearerScheme the authentication scheme of the authorization header, which is matched case-insensitively
+	bearerScheme = "Bearer "
+
+	// query parameter holding the bearer token of event streams, as browsers' EventSource cannot send headers
+	accessTokenParam = "access_token"
+
+	// maximum lifetime of tokens given in the query, which may be recorded in the logs of proxies
+	maxQueryTokenLifetime = 5 * time.Minute
+)
+
+// Claims the claims of a caller's bearer token
+type Claims struct {
+	jwt.StandardClaims
+	Roles Roles `json:"roles,omitempty"`
+}
+
+// Roles the roles granted to a caller; tokens may hold a single role as a string or several as a list
+type Roles []string
+
+// UnmarshalJSON reads roles given either as a string or a list of strings
+func (r *Roles) UnmarshalJSON(data []byte) error {
+	var role string
+	if err := json.Unmarshal(data, &role); err == nil {
+		*r = Roles{role}
+		return nil
+	}
+	var roles []string
+	if err := json.Unmarshal(data, &roles); err != nil {
+		return err
+	}
+	*r = roles
+	return nil
+}
+
+// Has returns true if the role is amongst the roles
+func (r Roles) Has(role string) bool {
+	for _, granted := range r {
+		if granted == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator validates the JWT bearer tokens presented by callers
+type Authenticator struct {
+	secret      []byte
+	keys        map[string]interface{}
+	serviceRole string
+	adminRole   string
+	maxLifetime time.Duration
+	parser      *jwt.Parser
+	now         func() time.Time
+}
+
+// NewAuthenticator creates a new authenticator accepting HS256 tokens signed with the secret, if it is not empty,
+// and RS256/ES256 tokens signed by the public keys, which are indexed by key ID; callers having the service role
+// may act on any user and only callers having the admin role may use the admin API; tokens must expire and, unless the
+// maximum lifetime is 0, must expire within the maximum lifetime
+func NewAuthenticator(secret []byte, keys map[string]interface{}, serviceRole, adminRole string, maxLifetime time.Duration) *Authenticator {
+	var methods []string
+	if len(secret) > 0 {
+		methods = append(methods, jwt.SigningMethodHS256.Alg())
+	}
+	if len(keys) > 0 {
+		methods = append(methods, jwt.SigningMethodRS256.Alg(), jwt.SigningMethodES256.Alg())
+	}
+	return &Authenticator{
+		secret:      secret,
+		keys:        keys,
+		serviceRole: serviceRole,
+		adminRole:   adminRole,
+		maxLifetime: maxLifetime,
+		parser:      &jwt.Parser{ValidMethods: methods},
+		now:         time.Now,
+	}
+}
+
+// Authenticate validates the request's bearer token and returns its claims
+func (a *Authenticator) Authenticate(r *http.Request) (*Claims, error) {
+	return a.authenticateHeader(r.Header.Get("Authorization"))
+}
+
+// authenticateQuery validates the request's bearer token, which may instead be given by the access_token query
+// parameter if it expires within five minutes, and returns its claims
+func (a *Authenticator) authenticateQuery(r *http.Request) (*Claims, error) {
+	token := r.URL.Query().Get(accessTokenParam)
+	if token == "" || r.Header.Get("Authorization") != "" {
+		return a.Authenticate(r)
+	}
+	claims, err := a.authenticateHeader(bearerScheme + token)
+	if err != nil {
+		return nil, err
+	}
+	if time.Unix(claims.ExpiresAt, 0).Sub(a.now()) > maxQueryTokenLifetime {
+		return nil, errors.Errorf("access token expires later than %v from now", maxQueryTokenLifetime)
+	}
+	return claims, nil
+}
+
+// authenticateHeader validates the bearer token held by the authorization header and returns its claims
+func (a *Authenticator) authenticateHeader(header string) (*Claims, error) {
+	if len(header) < len(bearerScheme) || !strings.EqualFold(header[:len(bearerScheme)], bearerScheme) {
+		return nil, errors.New("missing bearer token")
+	}
+	claims := &Claims{}
+	if _, err := a.parser.ParseWithClaims(header[len(bearerScheme):], claims, a.key); err != nil {
+		return nil, errors.Wrap(err, "invalid bearer token")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("bearer token has no subject")
+	}
+	if claims.ExpiresAt == 0 {
+		return nil, errors.New("bearer token has no expiry")
+	}
+	if a.maxLifetime > 0 && time.Unix(claims.ExpiresAt, 0).Sub(a.now()) > a.maxLifetime {
+		return nil, errors.Errorf("bearer token expires later than %v from now", a.maxLifetime)
+	}
+	return claims, nil
+}
+
+// key returns the key verifying the token's signature
+func (a *Authenticator) key(token *jwt.Token) (interface{}, error) {
+	if token.Method == jwt.SigningMethodHS256 {
+		return a.secret, nil
+	}
+	kid, _ := token.Header["kid"].(string)
+	if key, ok := a.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, errors.Errorf("unknown signing key %q", kid)
+}
+
+// authenticate middleware rejecting requests without a valid bearer token
+func authenticate(logger *zap.SugaredLogger, authenticator *Authenticator) func(http.Handler) http.Handler {
+	return authenticateWith(logger, authenticator.Authenticate)
+}
+
+// authenticateWith middleware rejecting requests whose bearer token cannot be validated by the function
+func authenticateWith(logger *zap.SugaredLogger, validate func(r *http.Request) (*Claims, error)) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, err := validate(r)
+			if err != nil {
+				logger.Debugw(
+					"cannot authenticate caller",
+					"error", err,
+				)
+				p := newProblem(http.StatusUnauthorized, unauthorizedCode, "Unauthorized")
+				p.Detail = "a valid bearer token is required"
+				w.Header().Set("WWW-Authenticate", `Bearer realm="stream-controller"`)
+				writeProblem(logger, w, p)
+				return
+			}
+			ctx := context.WithValue(r.Context(), claimsKey, claims)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// authorizeUser middleware rejecting callers acting on users other than the subject of their token unless they
+// have the service role
+func authorizeUser(logger *zap.SugaredLogger, authenticator *Authenticator) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims := callerClaims(r)
+			userID := chi.URLParam(r, "userID")
+			if claims == nil || (claims.Subject != userID && !claims.Roles.Has(authenticator.serviceRole)) {
+				logger.Debugw(
+					"caller cannot act on user",
+					"userID", userID,
+				)
+				p := newProblem(http.StatusForbidden, forbiddenCode, "Forbidden")
+				p.Detail = "the bearer token does not permit acting on this user"
+				p.UserID = userID
+				writeProblem(logger, w, p)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requireRole middleware rejecting callers who have not been granted the role
+func requireRole(logger *zap.SugaredLogger, role string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims := callerClaims(r)
+			if claims == nil || !claims.Roles.Has(role) {
+				logger.Debugw(
+					"caller does not have role",
+					"role", role,
+				)
+				p := newProblem(http.StatusForbidden, forbiddenCode, "Forbidden")
+				p.Detail = "the bearer token does not grant the " + role + " role"
+				writeProblem(logger, w, p)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// callerClaims returns the claims of the authenticated caller, or nil if the request is not authenticated
+func callerClaims(r *http.Request) *Claims {
+	claims, _ := r.Context().Value(claimsKey).(*Claims)
+	return claims
+}
+
+// jwk a JSON web key holding an RSA or elliptic curve public key
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// LoadJWKS reads the RSA and P-256 elliptic curve public keys in the JSON web key set file indexed by key ID
+func LoadJWKS(path string) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read jwks file")
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, errors.Wrap(err, "cannot parse jwks file")
+	}
+
+	keys := make(map[string]interface{}, len(set.Keys))
+	for _, k := range set.Keys {
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid key %q in jwks file", k.Kid)
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, errors.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	default:
+		return nil, errors.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot decode key parameter")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
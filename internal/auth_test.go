@@ -0,0 +1,238 @@
+package internal
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"github.com/golang-jwt/jwt"
+	"github.com/golang/mock/gomock"
+	"github.com/prgodlonton/stream-controller/internal/session"
+	"github.com/prgodlonton/stream-controller/testing/mocks"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+var testSecret = []byte("intentionally-insecure-secret")
+
+func TestShouldAllowCallerActingOnThemself(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+	store.EXPECT().AddStream(gomock.Any(), "alan", "boxing1", gomock.Any()).Return(session.Change{}, nil)
+
+	token := signToken(t, jwt.SigningMethodHS256, testSecret, "", Claims{StandardClaims: standardClaims("alan")})
+	w := serveAuthenticated(store, NewAuthenticator(testSecret, nil, "service", "admin", 0), "PUT", "v1/users/alan/streams/boxing1", token)
+
+	assert.Equal(t, http.StatusCreated, w.Code)
+}
+
+func TestShouldForbidCallerActingOnAnotherUser(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+
+	token := signToken(t, jwt.SigningMethodHS256, testSecret, "", Claims{StandardClaims: standardClaims("mallory")})
+	w := serveAuthenticated(store, NewAuthenticator(testSecret, nil, "service", "admin", 0), "DELETE", "v1/users/alan/streams/boxing1", token)
+
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestShouldAllowServiceActingOnAnyUser(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+	store.EXPECT().RemoveStream(gomock.Any(), "alan", "boxing1").Return(session.Change{}, nil)
+
+	claims := Claims{StandardClaims: standardClaims("session-gateway"), Roles: Roles{"service"}}
+	token := signToken(t, jwt.SigningMethodHS256, testSecret, "", claims)
+	w := serveAuthenticated(store, NewAuthenticator(testSecret, nil, "service", "admin", 0), "DELETE", "v1/users/alan/streams/boxing1", token)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestShouldRejectCallerWithoutValidToken(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+	authenticator := NewAuthenticator(testSecret, nil, "service", "admin", 0)
+
+	expired := standardClaims("alan")
+	expired.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+	tokens := []string{
+		signToken(t, jwt.SigningMethodHS256, testSecret, "", Claims{StandardClaims: jwt.StandardClaims{Subject: "alan"}}),
+		"",
+		"not-a-token",
+		signToken(t, jwt.SigningMethodHS256, []byte("wrong-secret"), "", Claims{StandardClaims: standardClaims("alan")}),
+		signToken(t, jwt.SigningMethodHS256, testSecret, "", Claims{StandardClaims: expired}),
+		signToken(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, "", Claims{StandardClaims: standardClaims("alan")}),
+	}
+	for _, token := range tokens {
+		w := serveAuthenticated(store, authenticator, "GET", "v1/users/alan", token)
+		assert.Equal(t, http.StatusUnauthorized, w.Code, "token: %q", token)
+		assert.NotEmpty(t, w.Header().Get("WWW-Authenticate"))
+	}
+}
+
+func TestShouldMatchBearerSchemeCaseInsensitively(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+	store.EXPECT().RenewStream(gomock.Any(), "alan", "boxing1").Times(2).Return(session.Change{}, nil)
+
+	router := NewRouter(noopLogger, store, WithAuthenticator(NewAuthenticator(testSecret, nil, "service", "admin", 0)))
+	token := signToken(t, jwt.SigningMethodHS256, testSecret, "", Claims{StandardClaims: standardClaims("alan")})
+	for _, scheme := range []string{"bearer ", "BEARER "} {
+		r := createHTTPRequest("POST", "v1/users/alan/streams/boxing1/heartbeat")
+		r.Header.Set("Authorization", scheme+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code, scheme)
+	}
+}
+
+func TestShouldRejectTokensExpiringLaterThanMaxLifetime(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+	store.EXPECT().RenewStream(gomock.Any(), "alan", "boxing1").Times(1).Return(session.Change{}, nil)
+	authenticator := NewAuthenticator(testSecret, nil, "service", "admin", 2*time.Hour)
+
+	claims := standardClaims("alan")
+	token := signToken(t, jwt.SigningMethodHS256, testSecret, "", Claims{StandardClaims: claims})
+	w := serveAuthenticated(store, authenticator, "POST", "v1/users/alan/streams/boxing1/heartbeat", token)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	claims.ExpiresAt = time.Now().Add(24 * time.Hour).Unix()
+	token = signToken(t, jwt.SigningMethodHS256, testSecret, "", Claims{StandardClaims: claims})
+	w = serveAuthenticated(store, authenticator, "POST", "v1/users/alan/streams/boxing1/heartbeat", token)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestShouldAcceptShortLivedQueryTokensOnlyForEventStreams(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	authenticator := NewAuthenticator(testSecret, nil, "service", "admin", 0)
+	router := NewRouter(noopLogger, mocks.NewMockStore(mockCtrl), WithAuthenticator(authenticator), WithNotifier(NewMemoryNotifier()))
+	shortLived := standardClaims("alan")
+	shortLived.ExpiresAt = time.Now().Add(time.Minute).Unix()
+	shortLivedToken := signToken(t, jwt.SigningMethodHS256, testSecret, "", Claims{StandardClaims: shortLived})
+	longLivedToken := signToken(t, jwt.SigningMethodHS256, testSecret, "", Claims{StandardClaims: standardClaims("alan")})
+
+	statuses := map[string]int{
+		"/v1/users/alan/events?access_token=" + shortLivedToken:  http.StatusOK,
+		"/v1/users/alan/events?access_token=" + longLivedToken:   http.StatusUnauthorized,
+		"/v1/users/becky/events?access_token=" + shortLivedToken: http.StatusForbidden,
+		"/v1/users/alan/?access_token=" + shortLivedToken:        http.StatusUnauthorized,
+	}
+	for url, status := range statuses {
+		// the event stream is held open until the request's context is done
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", url, nil).WithContext(ctx))
+		cancel()
+
+		assert.Equal(t, status, w.Code, url)
+	}
+}
+
+func TestShouldAcceptTokensSignedByKeysInJWKSFile(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+	store.EXPECT().RenewStream(gomock.Any(), "alan", "boxing1").Times(2).Return(session.Change{}, nil)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	path := writeJWKS(t, fmt.Sprintf(
+		`{"keys":[{"kty":"RSA","kid":"rsa1","n":"%v","e":"%v"},{"kty":"EC","kid":"ec1","crv":"P-256","x":"%v","y":"%v"}]}`,
+		encodeBigInt(rsaKey.N),
+		encodeBigInt(big.NewInt(int64(rsaKey.E))),
+		encodeBigInt(ecKey.X),
+		encodeBigInt(ecKey.Y),
+	))
+	defer os.Remove(path)
+
+	keys, err := LoadJWKS(path)
+	assert.NoError(t, err)
+	authenticator := NewAuthenticator(nil, keys, "service", "admin", 0)
+
+	claims := Claims{StandardClaims: standardClaims("alan")}
+	for _, token := range []string{
+		signToken(t, jwt.SigningMethodRS256, rsaKey, "rsa1", claims),
+		signToken(t, jwt.SigningMethodES256, ecKey, "ec1", claims),
+	} {
+		w := serveAuthenticated(store, authenticator, "POST", "v1/users/alan/streams/boxing1/heartbeat", token)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	// shared secret tokens are not accepted when no secret is configured
+	token := signToken(t, jwt.SigningMethodHS256, []byte(""), "", claims)
+	w := serveAuthenticated(store, authenticator, "POST", "v1/users/alan/streams/boxing1/heartbeat", token)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func serveAuthenticated(store Store, authenticator *Authenticator, method, url, token string) *httptest.ResponseRecorder {
+	r := createHTTPRequest(method, url)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	NewRouter(noopLogger, store, WithAuthenticator(authenticator)).ServeHTTP(w, r)
+	return w
+}
+
+func standardClaims(subject string) jwt.StandardClaims {
+	return jwt.StandardClaims{
+		Subject:   subject,
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func signToken(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims Claims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func writeJWKS(t *testing.T, jwks string) string {
+	file, err := ioutil.TempFile("", "jwks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(jwks); err != nil {
+		t.Fatal(err)
+	}
+	return file.Name()
+}
+
+func encodeBigInt(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
@@ -0,0 +1,161 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/prgodlonton/stream-controller/internal/session"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+)
+
+const (
+	// maximum number of operations in a batch
+	maxBatchSize = 1000
+
+	// maximum size in bytes of the JSON body holding a batch
+	maxBatchBodySize = 4 << 20
+
+	// results of the operations in a batch
+	createdResult       = "created"
+	removedResult       = "removed"
+	quotaExceededResult = "quota_exceeded"
+	errorResult         = "error"
+)
+
+// batchRequest the JSON body holding a batch of operations
+type batchRequest struct {
+	Operations []batchOperation `json:"operations"`
+}
+
+// batchOperation starts or stops a stream being watched by a user; the device is only used when starting a stream
+type batchOperation struct {
+	Op       string         `json:"op"`
+	UserID   string         `json:"userID"`
+	StreamID string         `json:"streamID"`
+	Device   session.Device `json:"device"`
+}
+
+// batchResponse the JSON body holding the result of each operation of a batch in the same order
+type batchResponse struct {
+	Results []batchResult `json:"results"`
+}
+
+// batchResult the result of an operation; streams started may evict others, streams rejected give the limit reached
+// and the user's active streams, and failed operations describe their error
+type batchResult struct {
+	Op         string   `json:"op"`
+	UserID     string   `json:"userID"`
+	StreamID   string   `json:"streamID"`
+	Result     string   `json:"result"`
+	Evicted    []string `json:"evicted,omitempty"`
+	Limit      *int     `json:"limit,omitempty"`
+	DeviceType string   `json:"deviceType,omitempty"`
+	Streams    []string `json:"streams,omitempty"`
+	Detail     string   `json:"detail,omitempty"`
+}
+
+// applyBatch applies a batch of operations in a single round trip to the store and responds with the result of each;
+// callers must be permitted to act on every user in the batch
+func applyBatch(logger *zap.SugaredLogger, store Store, authenticator *Authenticator, notifier Notifier, ids *IDValidator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request batchRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxBatchBodySize)).Decode(&request); err != nil {
+			writeProblem(logger, w, invalidRequest("", "the body must be a JSON object holding the operations"))
+			return
+		}
+		if p := validateBatch(request.Operations, ids); p != nil {
+			writeProblem(logger, w, p)
+			return
+		}
+		if authenticator != nil {
+			claims := callerClaims(r)
+			for _, op := range request.Operations {
+				if claims == nil || (claims.Subject != op.UserID && !claims.Roles.Has(authenticator.serviceRole)) {
+					logger.Debugw(
+						"caller cannot act on user",
+						"userID", op.UserID,
+					)
+					p := newProblem(http.StatusForbidden, forbiddenCode, "Forbidden")
+					p.Detail = "the bearer token does not permit acting on every user in the batch"
+					p.UserID = op.UserID
+					writeProblem(logger, w, p)
+					return
+				}
+			}
+		}
+
+		operations := make([]session.Operation, 0, len(request.Operations))
+		for _, op := range request.Operations {
+			operations = append(operations, session.Operation{
+				Op:       op.Op,
+				UserID:   op.UserID,
+				StreamID: op.StreamID,
+				Device:   op.Device,
+			})
+		}
+		results, err := store.Apply(r.Context(), operations)
+		if err != nil {
+			logger.Errorw(
+				"cannot apply batch",
+				"operations", len(operations),
+				"error", err,
+			)
+			writeProblem(logger, w, storeProblem(err, "", ""))
+			return
+		}
+
+		response := batchResponse{Results: make([]batchResult, 0, len(results))}
+		for i, result := range results {
+			op := operations[i]
+			br := batchResult{Op: op.Op, UserID: op.UserID, StreamID: op.StreamID}
+			notifyExpired(r.Context(), logger, notifier, op.UserID, result.Expired)
+			switch err := result.Err.(type) {
+			case nil:
+				br.Result = removedResult
+				if op.Op == session.StartOperation {
+					br.Result, br.Evicted = createdResult, result.Evicted
+					for _, evictedID := range result.Evicted {
+						notify(r.Context(), logger, notifier, Event{Type: SessionEvictedEvent, UserID: op.UserID, StreamID: evictedID})
+					}
+				}
+			case *QuotaExceededError:
+				br.Result, br.Limit, br.DeviceType, br.Streams = quotaExceededResult, &err.Limit, err.DeviceType, err.Streams
+			default:
+				logger.Errorw(
+					"cannot apply batch operation",
+					"op", op.Op,
+					"userID", op.UserID,
+					"streamID", op.StreamID,
+					"error", err,
+				)
+				br.Result, br.Detail = errorResult, storeProblem(err, "", "").Detail
+			}
+			response.Results = append(response.Results, br)
+		}
+		writeJSON(logger, w, http.StatusOK, response)
+	}
+}
+
+// validateBatch returns the problem with the first invalid operation, or nil if the batch is valid
+func validateBatch(operations []batchOperation, ids *IDValidator) *problem {
+	if len(operations) == 0 {
+		return invalidRequest("operations", "operations must not be empty")
+	}
+	if len(operations) > maxBatchSize {
+		return invalidRequest("operations", fmt.Sprintf("operations must hold at most %d operations", maxBatchSize))
+	}
+	for i, op := range operations {
+		field := fmt.Sprintf("operations[%d]", i)
+		if op.Op != session.StartOperation && op.Op != session.StopOperation {
+			return invalidRequest(field+".op", "op must be one of start or stop")
+		}
+		if err := ids.ValidateUserID("userID", op.UserID); err != nil {
+			return invalidRequest(field+".userID", err.Error())
+		}
+		if err := ids.ValidateStreamID("streamID", op.StreamID); err != nil {
+			return invalidRequest(field+".streamID", err.Error())
+		}
+	}
+	return nil
+}
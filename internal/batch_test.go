@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/golang-jwt/jwt"
+	"github.com/golang/mock/gomock"
+	"github.com/prgodlonton/stream-controller/internal/session"
+	"github.com/prgodlonton/stream-controller/testing/mocks"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestShouldReturnResultOfEachOperationInBatch(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+	store.EXPECT().Apply(gomock.Any(), []session.Operation{
+		{Op: session.StartOperation, UserID: "alan", StreamID: "boxing1", Device: session.Device{DeviceType: "tv"}},
+		{Op: session.StartOperation, UserID: "becky", StreamID: "rugby7"},
+		{Op: session.StopOperation, UserID: "charles", StreamID: "golf4"},
+		{Op: session.StopOperation, UserID: "dorothy", StreamID: "squash5"},
+	}).Return([]session.Result{
+		{Change: session.Change{Evicted: []string{"darts2"}}},
+		{Err: &QuotaExceededError{Limit: 1, Streams: []string{"tennis2"}}},
+		{},
+		{Err: errors.New("connection reset")},
+	}, nil)
+
+	w := serveBatch(store, nil, "", `{"operations":[
+		{"op":"start","userID":"alan","streamID":"boxing1","device":{"deviceType":"tv"}},
+		{"op":"start","userID":"becky","streamID":"rugby7"},
+		{"op":"stop","userID":"charles","streamID":"golf4"},
+		{"op":"stop","userID":"dorothy","streamID":"squash5"}
+	]}`)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	limit := 1
+	var response batchResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, []batchResult{
+		{Op: "start", UserID: "alan", StreamID: "boxing1", Result: createdResult, Evicted: []string{"darts2"}},
+		{Op: "start", UserID: "becky", StreamID: "rugby7", Result: quotaExceededResult, Limit: &limit, Streams: []string{"tennis2"}},
+		{Op: "stop", UserID: "charles", StreamID: "golf4", Result: removedResult},
+		{
+			Op:       "stop",
+			UserID:   "dorothy",
+			StreamID: "squash5",
+			Result:   errorResult,
+			Detail:   "the streams being watched cannot be read or updated; try again later",
+		},
+	}, response.Results)
+}
+
+func TestShouldReturnBadRequestWhenBatchOperationIsInvalid(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+	requests := map[string]string{
+		`[]`:                "",
+		`{"operations":[]}`: "operations",
+		`{"operations":[{"op":"stop","userID":"alan","streamID":"boxing1"},{"op":"renew","userID":"alan","streamID":"boxing1"}]}`: "operations[1].op",
+		`{"operations":[{"op":"start","streamID":"boxing1"}]}`:                                                                    "operations[0].userID",
+		`{"operations":[{"op":"start","userID":"alan"}]}`:                                                                         "operations[0].streamID",
+	}
+	for body, field := range requests {
+		w := serveBatch(store, nil, "", body)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code, body)
+		var p problem
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &p))
+		assert.Equal(t, invalidRequestCode, p.Code, body)
+		assert.Equal(t, field, p.Field, body)
+	}
+}
+
+func TestShouldReturnStoreProblemWhenBatchCannotBeApplied(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+	store.EXPECT().Apply(gomock.Any(), gomock.Any()).Return(nil, errors.New("connection refused"))
+
+	w := serveBatch(store, nil, "", `{"operations":[{"op":"stop","userID":"alan","streamID":"boxing1"}]}`)
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Contains(t, w.Body.String(), storeUnavailableCode)
+}
+
+func TestShouldForbidBatchActingOnAnotherUserWithoutServiceRole(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+	store.EXPECT().Apply(gomock.Any(), gomock.Any()).Times(1).Return([]session.Result{{}, {}}, nil)
+
+	authenticator := NewAuthenticator(testSecret, nil, "service", "admin", 0)
+	body := `{"operations":[{"op":"stop","userID":"alan","streamID":"boxing1"},{"op":"stop","userID":"becky","streamID":"rugby7"}]}`
+
+	w := serveBatch(store, authenticator, "", body)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	token := signToken(t, jwt.SigningMethodHS256, testSecret, "", Claims{StandardClaims: standardClaims("alan")})
+	w = serveBatch(store, authenticator, token, body)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	token = signToken(t, jwt.SigningMethodHS256, testSecret, "", Claims{StandardClaims: standardClaims("gateway"), Roles: Roles{"service"}})
+	w = serveBatch(store, authenticator, token, body)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func serveBatch(store Store, authenticator *Authenticator, token, body string) *httptest.ResponseRecorder {
+	var opts []Option
+	if authenticator != nil {
+		opts = append(opts, WithAuthenticator(authenticator))
+	}
+	r := httptest.NewRequest("POST", "/v1/batch", strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	NewRouter(noopLogger, store, opts...).ServeHTTP(w, r)
+	return w
+}
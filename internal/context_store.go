@@ -0,0 +1,150 @@
+package internal
+
+import (
+	"context"
+	"github.com/prgodlonton/stream-controller/internal/session"
+	"time"
+)
+
+// ContextStore a store decorator returning the context's error as soon as the context of an operation is done;
+// go-redis cannot interrupt commands already sent to Redis, so the abandoned operation completes in the background,
+// bounded by the client's read and write timeouts, and its outcome is discarded
+type ContextStore struct {
+	store Store
+}
+
+// NewContextStore creates a new store abandoning the operations of the given store whose contexts are done
+func NewContextStore(store Store) Store {
+	return &ContextStore{
+		store: store,
+	}
+}
+
+// AddStream records a user as watching a stream on the device and returns the streams evicted to make room for it
+func (cs *ContextStore) AddStream(ctx context.Context, userID, streamID string, device session.Device) (session.Change, error) {
+	var change session.Change
+	var err error
+	if abandoned := await(ctx, func() { change, err = cs.store.AddStream(ctx, userID, streamID, device) }); abandoned != nil {
+		return session.Change{}, abandoned
+	}
+	return change, err
+}
+
+// Apply applies the batch of operations, returning the result of each in the same order
+func (cs *ContextStore) Apply(ctx context.Context, operations []session.Operation) ([]session.Result, error) {
+	var results []session.Result
+	var err error
+	if abandoned := await(ctx, func() { results, err = cs.store.Apply(ctx, operations) }); abandoned != nil {
+		return nil, abandoned
+	}
+	return results, err
+}
+
+// ExpireStreams removes the user's streams whose leases have expired and returns them
+func (cs *ContextStore) ExpireStreams(ctx context.Context, userID string) (session.Change, error) {
+	var change session.Change
+	var err error
+	if abandoned := await(ctx, func() { change, err = cs.store.ExpireStreams(ctx, userID) }); abandoned != nil {
+		return session.Change{}, abandoned
+	}
+	return change, err
+}
+
+// GetLimit returns the number of streams the user may watch concurrently
+func (cs *ContextStore) GetLimit(ctx context.Context, userID string) (int, error) {
+	var limit int
+	var err error
+	if abandoned := await(ctx, func() { limit, err = cs.store.GetLimit(ctx, userID) }); abandoned != nil {
+		return 0, abandoned
+	}
+	return limit, err
+}
+
+// GetSessions returns the streams being watched by a single user with their devices
+func (cs *ContextStore) GetSessions(ctx context.Context, userID string) ([]session.Session, error) {
+	var sessions []session.Session
+	var err error
+	if abandoned := await(ctx, func() { sessions, err = cs.store.GetSessions(ctx, userID) }); abandoned != nil {
+		return nil, abandoned
+	}
+	return sessions, err
+}
+
+// GetStreams returns all streams being watched by a single user
+func (cs *ContextStore) GetStreams(ctx context.Context, userID string) ([]string, error) {
+	var streamIDs []string
+	var err error
+	if abandoned := await(ctx, func() { streamIDs, err = cs.store.GetStreams(ctx, userID) }); abandoned != nil {
+		return nil, abandoned
+	}
+	return streamIDs, err
+}
+
+// ListUsers returns a page of the users watching streams and the cursor of the next page
+func (cs *ContextStore) ListUsers(ctx context.Context, cursor uint64, count int64) ([]string, uint64, error) {
+	var userIDs []string
+	var next uint64
+	var err error
+	if abandoned := await(ctx, func() { userIDs, next, err = cs.store.ListUsers(ctx, cursor, count) }); abandoned != nil {
+		return nil, 0, abandoned
+	}
+	return userIDs, next, err
+}
+
+// RemoveAllStreams removes the records of all streams being watched by a user
+func (cs *ContextStore) RemoveAllStreams(ctx context.Context, userID string) (session.Change, error) {
+	var change session.Change
+	var err error
+	if abandoned := await(ctx, func() { change, err = cs.store.RemoveAllStreams(ctx, userID) }); abandoned != nil {
+		return session.Change{}, abandoned
+	}
+	return change, err
+}
+
+// RemoveStream removes the record of a user watching a stream
+func (cs *ContextStore) RemoveStream(ctx context.Context, userID, streamID string) (session.Change, error) {
+	var change session.Change
+	var err error
+	if abandoned := await(ctx, func() { change, err = cs.store.RemoveStream(ctx, userID, streamID) }); abandoned != nil {
+		return session.Change{}, abandoned
+	}
+	return change, err
+}
+
+// RenewStream extends the lease of a stream the user is watching
+func (cs *ContextStore) RenewStream(ctx context.Context, userID, streamID string) (session.Change, error) {
+	var change session.Change
+	var err error
+	if abandoned := await(ctx, func() { change, err = cs.store.RenewStream(ctx, userID, streamID) }); abandoned != nil {
+		return session.Change{}, abandoned
+	}
+	return change, err
+}
+
+// SetLimit overrides the number of streams the user may watch concurrently
+func (cs *ContextStore) SetLimit(ctx context.Context, userID string, limit int, duration time.Duration) error {
+	var err error
+	if abandoned := await(ctx, func() { err = cs.store.SetLimit(ctx, userID, limit, duration) }); abandoned != nil {
+		return abandoned
+	}
+	return err
+}
+
+// await runs the operation in the background and waits for it to complete, or returns the context's error if the
+// context is done first, in which case the operation's results must not be read
+func await(ctx context.Context, operation func()) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	go func() {
+		operation()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
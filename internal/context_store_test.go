@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"context"
+	"github.com/golang/mock/gomock"
+	"github.com/prgodlonton/stream-controller/internal/session"
+	"github.com/prgodlonton/stream-controller/testing/mocks"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestShouldReturnOnceContextIsDoneWithoutWaitingForStore(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	release := make(chan struct{})
+	defer close(release)
+	store := mocks.NewMockStore(mockCtrl)
+	store.EXPECT().AddStream(gomock.Any(), "alan", "boxing1", gomock.Any()).Times(1).DoAndReturn(
+		func(context.Context, string, string, session.Device) (session.Change, error) {
+			<-release
+			return session.Change{}, nil
+		},
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	change, err := NewContextStore(store).AddStream(ctx, "alan", "boxing1", session.Device{})
+
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Nil(t, change.Evicted)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestShouldReturnResultsOfStoreCompletingBeforeDeadline(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+	store.EXPECT().GetStreams(gomock.Any(), "becky").Times(1).Return([]string{"rugby7"}, nil)
+	store.EXPECT().RenewStream(gomock.Any(), "becky", "golf4").Times(1).Return(session.Change{}, streamNotFound)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	contextStore := NewContextStore(store)
+	streamIDs, err := contextStore.GetStreams(ctx, "becky")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"rugby7"}, streamIDs)
+	_, err = contextStore.RenewStream(ctx, "becky", "golf4")
+	assert.Equal(t, streamNotFound, err)
+
+	cancel()
+	_, err = contextStore.RemoveStream(ctx, "becky", "rugby7")
+	assert.Equal(t, context.Canceled, err)
+}
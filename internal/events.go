@@ -0,0 +1,308 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/chi"
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// SessionRevokedEvent notifies players that an operator terminated one or all of the user's streams
+	SessionRevokedEvent = "session_revoked"
+
+	// SessionEvictedEvent notifies players that a stream was ended by the eviction policy to make room for another
+	SessionEvictedEvent = "session_evicted"
+
+	// SessionExpiredEvent notifies players that a stream ended because its lease was not renewed in time
+	SessionExpiredEvent = "session_expired"
+
+	// LimitChangedEvent notifies players that an operator overrode the user's limit
+	LimitChangedEvent = "limit_changed"
+
+	// content type of server-sent event streams
+	eventStreamContentType = "text/event-stream"
+
+	// number of events buffered for each subscriber; events are dropped for subscribers that fall further behind
+	subscriberBufferSize = 16
+
+	// interval between the comments sent to keep idle event streams open through proxies
+	eventKeepAliveInterval = 15 * time.Second
+)
+
+// Event notifies a user's players of a change to their sessions; the stream is omitted when all of the user's
+// streams were revoked and the limit is only given when it changed
+type Event struct {
+	Type     string    `json:"type"`
+	UserID   string    `json:"userID"`
+	StreamID string    `json:"streamID,omitempty"`
+	Limit    *int      `json:"limit,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// Notifier delivers events to the subscribers of the user to which they relate
+type Notifier interface {
+	Notify(ctx context.Context, event Event) error
+
+	// Subscribe returns the channel receiving the user's events and the function ending the subscription
+	Subscribe(userID string) (<-chan Event, func())
+
+	// Close closes the channels of every subscriber so that they stop waiting for events
+	Close() error
+}
+
+// eventHub fans events out to the subscribers of each user held by this instance
+type eventHub struct {
+	mu          sync.Mutex
+	closed      bool
+	subscribers map[string]map[chan Event]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{
+		subscribers: make(map[string]map[chan Event]struct{}),
+	}
+}
+
+// Subscribe returns the channel receiving the user's events and the function ending the subscription
+func (h *eventHub) Subscribe(userID string) (<-chan Event, func()) {
+	events := make(chan Event, subscriberBufferSize)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		close(events)
+		return events, func() {}
+	}
+	if _, ok := h.subscribers[userID]; !ok {
+		h.subscribers[userID] = make(map[chan Event]struct{})
+	}
+	h.subscribers[userID][events] = struct{}{}
+
+	var once sync.Once
+	return events, func() {
+		once.Do(func() {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+
+			delete(h.subscribers[userID], events)
+			if len(h.subscribers[userID]) == 0 {
+				delete(h.subscribers, userID)
+			}
+		})
+	}
+}
+
+// dispatch sends the event to the user's subscribers without blocking, dropping it for those whose buffers are full
+func (h *eventHub) dispatch(event Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for events := range h.subscribers[event.UserID] {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+// closeSubscribers closes the channels of every subscriber and of those subscribing later
+func (h *eventHub) closeSubscribers() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, subscribers := range h.subscribers {
+		for events := range subscribers {
+			close(events)
+		}
+	}
+	h.subscribers = make(map[string]map[chan Event]struct{})
+	h.closed = true
+}
+
+// MemoryNotifier delivers events to the subscribers held by this instance only
+type MemoryNotifier struct {
+	*eventHub
+}
+
+// NewMemoryNotifier creates a new notifier for a single instance
+func NewMemoryNotifier() Notifier {
+	return &MemoryNotifier{
+		eventHub: newEventHub(),
+	}
+}
+
+// Notify delivers the event to the user's subscribers
+func (mn *MemoryNotifier) Notify(ctx context.Context, event Event) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	mn.dispatch(event)
+	return nil
+}
+
+// Close closes the channels of every subscriber
+func (mn *MemoryNotifier) Close() error {
+	mn.closeSubscribers()
+	return nil
+}
+
+// RedisNotifier publishes events to a Redis channel to which every instance subscribes, so that events reach the
+// user's subscribers whichever instance holds them
+type RedisNotifier struct {
+	*eventHub
+	logger  *zap.SugaredLogger
+	client  redis.UniversalClient
+	channel string
+	pubsub  *redis.PubSub
+}
+
+// NewRedisNotifier creates a new notifier subscribed to the key space's events channel
+func NewRedisNotifier(logger *zap.SugaredLogger, client redis.UniversalClient, keys KeySpace) (*RedisNotifier, error) {
+	pubsub := client.Subscribe(keys.Events())
+	if _, err := pubsub.Receive(); err != nil {
+		pubsub.Close()
+		return nil, errors.Wrap(err, "failed to subscribe to events channel")
+	}
+	rn := &RedisNotifier{
+		eventHub: newEventHub(),
+		logger:   logger,
+		client:   client,
+		channel:  keys.Events(),
+		pubsub:   pubsub,
+	}
+	go rn.receive()
+	return rn, nil
+}
+
+// Notify publishes the event to every instance
+func (rn *RedisNotifier) Notify(ctx context.Context, event Event) error {
+	client, err := withContext(ctx, rn.client)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrap(err, "cannot encode event")
+	}
+	if err := client.Publish(rn.channel, data).Err(); err != nil {
+		return errors.Wrap(err, "failed to publish event")
+	}
+	return nil
+}
+
+// Close unsubscribes from the events channel and closes the channels of every subscriber
+func (rn *RedisNotifier) Close() error {
+	rn.closeSubscribers()
+	return rn.pubsub.Close()
+}
+
+// receive dispatches the events published by every instance until the subscription is closed
+func (rn *RedisNotifier) receive() {
+	for message := range rn.pubsub.Channel() {
+		var event Event
+		if err := json.Unmarshal([]byte(message.Payload), &event); err != nil {
+			rn.logger.Errorw(
+				"cannot decode event",
+				"payload", message.Payload,
+				"error", err,
+			)
+			continue
+		}
+		rn.dispatch(event)
+	}
+}
+
+// notify delivers the event, logging rather than failing the request if it cannot be delivered
+func notify(ctx context.Context, logger *zap.SugaredLogger, notifier Notifier, event Event) {
+	if notifier == nil {
+		return
+	}
+	event.Time = time.Now().UTC()
+	if err := notifier.Notify(ctx, event); err != nil {
+		logger.Errorw(
+			"cannot notify players",
+			"userID", event.UserID,
+			"streamID", event.StreamID,
+			"type", event.Type,
+			"error", err,
+		)
+	}
+}
+
+// notifyExpired notifies the user's players of each stream whose lease expired
+func notifyExpired(ctx context.Context, logger *zap.SugaredLogger, notifier Notifier, userID string, expired []string) {
+	for _, streamID := range expired {
+		notify(ctx, logger, notifier, Event{Type: SessionExpiredEvent, UserID: userID, StreamID: streamID})
+	}
+}
+
+// streamEvents streams the user's events as server-sent events until the client disconnects or the notifier is closed
+func streamEvents(logger *zap.SugaredLogger, notifier Notifier) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := chi.URLParam(r, "userID")
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			logger.Errorw(
+				"cannot stream events as response writer cannot be flushed",
+				"userID", userID,
+			)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		// the stream is held open beyond the server's write timeout
+		if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+			logger.Debugw(
+				"cannot clear write deadline of event stream",
+				"userID", userID,
+				"error", err,
+			)
+		}
+
+		events, unsubscribe := notifier.Subscribe(userID)
+		defer unsubscribe()
+
+		w.Header().Set(contentTypeHeader, eventStreamContentType)
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		keepAlive := time.NewTicker(eventKeepAliveInterval)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-keepAlive.C:
+				if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+					return
+				}
+			case event, ok := <-events:
+				if !ok {
+					return
+				}
+				data, err := json.Marshal(event)
+				if err != nil {
+					logger.Errorw(
+						"cannot encode event",
+						"userID", userID,
+						"error", err,
+					)
+					continue
+				}
+				if _, err := fmt.Fprintf(w, "event: %v\ndata: %s\n\n", event.Type, data); err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+		}
+	}
+}
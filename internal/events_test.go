@@ -0,0 +1,133 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"github.com/golang/mock/gomock"
+	"github.com/prgodlonton/stream-controller/internal/session"
+	"github.com/prgodlonton/stream-controller/testing/mocks"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestShouldDeliverEventsToSubscribersOfUser(t *testing.T) {
+	notifier := NewMemoryNotifier()
+	first, unsubscribeFirst := notifier.Subscribe("alan")
+	second, unsubscribeSecond := notifier.Subscribe("alan")
+	defer unsubscribeSecond()
+	other, unsubscribeOther := notifier.Subscribe("becky")
+	defer unsubscribeOther()
+
+	event := Event{Type: SessionRevokedEvent, UserID: "alan", StreamID: "boxing1"}
+	assert.NoError(t, notifier.Notify(context.Background(), event))
+	assert.Equal(t, event, receiveEvent(t, first))
+	assert.Equal(t, event, receiveEvent(t, second))
+	assert.Empty(t, other)
+
+	unsubscribeFirst()
+	assert.NoError(t, notifier.Notify(context.Background(), event))
+	assert.Empty(t, first)
+	assert.Equal(t, event, receiveEvent(t, second))
+}
+
+func TestShouldCloseSubscriptionsWhenNotifierIsClosed(t *testing.T) {
+	notifier := NewMemoryNotifier()
+	events, unsubscribe := notifier.Subscribe("alan")
+	defer unsubscribe()
+
+	assert.NoError(t, notifier.Close())
+	_, ok := <-events
+	assert.False(t, ok)
+
+	events, _ = notifier.Subscribe("becky")
+	_, ok = <-events
+	assert.False(t, ok)
+}
+
+func TestShouldStreamUsersEventsAsServerSentEvents(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	notifier := NewMemoryNotifier()
+	server := httptest.NewUnstartedServer(NewRouter(noopLogger, mocks.NewMockStore(mockCtrl), WithNotifier(notifier)))
+	server.Config.WriteTimeout = 50 * time.Millisecond
+	server.Start()
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/v1/users/alan/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, eventStreamContentType, resp.Header.Get(contentTypeHeader))
+
+	// the stream is still open once the server's write timeout has passed
+	time.Sleep(100 * time.Millisecond)
+	event := Event{Type: SessionEvictedEvent, UserID: "alan", StreamID: "boxing1", Time: time.Date(2019, 11, 5, 20, 0, 0, 0, time.UTC)}
+	assert.NoError(t, notifier.Notify(context.Background(), event))
+
+	reader := bufio.NewReader(resp.Body)
+	for _, expected := range []string{
+		"event: session_evicted\n",
+		`data: {"type":"session_evicted","userID":"alan","streamID":"boxing1","time":"2019-11-05T20:00:00Z"}` + "\n",
+		"\n",
+	} {
+		line, err := reader.ReadString('\n')
+		assert.NoError(t, err)
+		assert.Equal(t, expected, line)
+	}
+}
+
+func TestShouldNotifyPlayersOfEvictedStreams(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+	store.EXPECT().AddStream(gomock.Any(), "alan", "tennis2", gomock.Any()).Return(session.Change{Evicted: []string{"boxing1"}}, nil)
+
+	notifier := NewMemoryNotifier()
+	events, unsubscribe := notifier.Subscribe("alan")
+	defer unsubscribe()
+
+	w := httptest.NewRecorder()
+	NewRouter(noopLogger, store, WithNotifier(notifier)).ServeHTTP(w, createHTTPRequest("PUT", "v1/users/alan/streams/tennis2"))
+
+	assert.Equal(t, http.StatusCreated, w.Code)
+	event := receiveEvent(t, events)
+	assert.Equal(t, SessionEvictedEvent, event.Type)
+	assert.Equal(t, "boxing1", event.StreamID)
+}
+
+func TestShouldNotifyPlayersOfExpiredStreams(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+	store.EXPECT().RenewStream(gomock.Any(), "alan", "boxing1").Return(session.Change{Expired: []string{"boxing1"}}, streamNotFound)
+
+	notifier := NewMemoryNotifier()
+	events, unsubscribe := notifier.Subscribe("alan")
+	defer unsubscribe()
+
+	w := httptest.NewRecorder()
+	NewRouter(noopLogger, store, WithNotifier(notifier)).ServeHTTP(w, createHTTPRequest("POST", "v1/users/alan/streams/boxing1/heartbeat"))
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	event := receiveEvent(t, events)
+	assert.Equal(t, SessionExpiredEvent, event.Type)
+	assert.Equal(t, "boxing1", event.StreamID)
+}
+
+func receiveEvent(t *testing.T, events <-chan Event) Event {
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for event")
+		return Event{}
+	}
+}
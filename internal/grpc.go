@@ -0,0 +1,304 @@
+package internal
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/prgodlonton/stream-controller/api"
+	"github.com/prgodlonton/stream-controller/internal/session"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"net"
+	"strings"
+)
+
+// userRequest a gRPC request acting on a user
+type userRequest interface {
+	GetUserId() string
+}
+
+// NewGRPCServer creates a new gRPC server serving the StreamController service from the store; the options
+// authenticating callers, notifying players and bounding store operations apply as they do to the router
+func NewGRPCServer(logger *zap.SugaredLogger, store Store, opts ...Option) *grpc.Server {
+	o := newOptions(opts)
+	var interceptors []grpc.UnaryServerInterceptor
+	if o.authenticator != nil {
+		interceptors = append(interceptors, authorizeCall(logger, o.authenticator))
+	}
+	if o.storeTimeout != nil {
+		interceptors = append(interceptors, withCallDeadline(o.storeTimeout))
+	}
+	server := grpc.NewServer(grpc.ChainUnaryInterceptor(interceptors...))
+	api.RegisterStreamControllerServer(server, &streamControllerServer{
+		logger:   logger,
+		store:    store,
+		notifier: o.notifier,
+		ids:      o.ids,
+	})
+	return server
+}
+
+// streamControllerServer serves the StreamController service as the router serves the REST endpoints
+type streamControllerServer struct {
+	api.UnimplementedStreamControllerServer
+	logger   *zap.SugaredLogger
+	store    Store
+	notifier Notifier
+	ids      *IDValidator
+}
+
+// StartStream records the user as watching the stream on the device
+func (s *streamControllerServer) StartStream(ctx context.Context, req *api.StartStreamRequest) (*api.StartStreamResponse, error) {
+	userID, streamID := req.GetUserId(), req.GetStreamId()
+	if err := s.validateIDs(userID, streamID); err != nil {
+		return nil, err
+	}
+	device := callerDevice(ctx, req.GetDevice())
+	change, err := s.store.AddStream(ctx, userID, streamID, device)
+	notifyExpired(ctx, s.logger, s.notifier, userID, change.Expired)
+	if err != nil {
+		if qe, ok := err.(*QuotaExceededError); ok {
+			s.logger.Debugw(
+				"user exceeded streaming quota",
+				"userID", userID,
+				"streamID", streamID,
+				"limit", qe.Limit,
+				"deviceType", qe.DeviceType,
+			)
+			return nil, quotaExceededStatus(qe, userID, streamID)
+		}
+		s.logger.Errorw(
+			"cannot create stream",
+			"userID", userID,
+			"streamID", streamID,
+			"error", err,
+		)
+		return nil, storeStatus(err)
+	}
+	if len(change.Evicted) > 0 {
+		s.logger.Infow(
+			"evicted streams to make room for stream",
+			"userID", userID,
+			"streamID", streamID,
+			"evicted", change.Evicted,
+		)
+		for _, evictedID := range change.Evicted {
+			notify(ctx, s.logger, s.notifier, Event{Type: SessionEvictedEvent, UserID: userID, StreamID: evictedID})
+		}
+	}
+	return &api.StartStreamResponse{UserId: userID, StreamId: streamID, Evicted: change.Evicted}, nil
+}
+
+// StopStream removes the record of the user watching the stream
+func (s *streamControllerServer) StopStream(ctx context.Context, req *api.StopStreamRequest) (*api.StopStreamResponse, error) {
+	userID, streamID := req.GetUserId(), req.GetStreamId()
+	if err := s.validateIDs(userID, streamID); err != nil {
+		return nil, err
+	}
+	change, err := s.store.RemoveStream(ctx, userID, streamID)
+	if err != nil {
+		s.logger.Errorw(
+			"cannot remove stream",
+			"userID", userID,
+			"streamID", streamID,
+			"error", err,
+		)
+		return nil, storeStatus(err)
+	}
+	notifyExpired(ctx, s.logger, s.notifier, userID, change.Expired)
+	return &api.StopStreamResponse{UserId: userID, StreamId: streamID}, nil
+}
+
+// ListStreams returns the streams being watched by the user with their devices and the user's limit
+func (s *streamControllerServer) ListStreams(ctx context.Context, req *api.ListStreamsRequest) (*api.ListStreamsResponse, error) {
+	userID := req.GetUserId()
+	if err := s.ids.ValidateUserID("user_id", userID); err != nil {
+		return nil, invalidIDStatus(err)
+	}
+	sessions, err := s.store.GetSessions(ctx, userID)
+	if err != nil {
+		s.logger.Debugw(
+			"cannot list streams",
+			"userID", userID,
+			"error", err,
+		)
+		return nil, storeStatus(err)
+	}
+	limit, err := s.store.GetLimit(ctx, userID)
+	if err != nil {
+		s.logger.Debugw(
+			"cannot get stream limit",
+			"userID", userID,
+			"error", err,
+		)
+		return nil, storeStatus(err)
+	}
+	return &api.ListStreamsResponse{
+		UserId:    userID,
+		Sessions:  toSessionMessages(sessions),
+		Limit:     int32(limit),
+		Remaining: int32(remaining(limit, len(sessions))),
+	}, nil
+}
+
+// Heartbeat extends the lease of a stream the user is watching
+func (s *streamControllerServer) Heartbeat(ctx context.Context, req *api.HeartbeatRequest) (*api.HeartbeatResponse, error) {
+	userID, streamID := req.GetUserId(), req.GetStreamId()
+	if err := s.validateIDs(userID, streamID); err != nil {
+		return nil, err
+	}
+	change, err := s.store.RenewStream(ctx, userID, streamID)
+	notifyExpired(ctx, s.logger, s.notifier, userID, change.Expired)
+	if err != nil {
+		if err == streamNotFound {
+			s.logger.Debugw(
+				"user is not watching stream",
+				"userID", userID,
+				"streamID", streamID,
+			)
+			return nil, status.Error(codes.NotFound, "the user is not watching the stream or its lease has expired")
+		}
+		s.logger.Errorw(
+			"cannot renew stream",
+			"userID", userID,
+			"streamID", streamID,
+			"error", err,
+		)
+		return nil, storeStatus(err)
+	}
+	return &api.HeartbeatResponse{UserId: userID, StreamId: streamID}, nil
+}
+
+// callerDevice returns the device described by the request; the IP address and user agent default to those of the
+// caller
+func callerDevice(ctx context.Context, d *api.Device) session.Device {
+	device := session.Device{
+		DeviceID:   d.GetDeviceId(),
+		DeviceType: d.GetDeviceType(),
+		AppVersion: d.GetAppVersion(),
+		IP:         d.GetIp(),
+		UserAgent:  d.GetUserAgent(),
+	}
+	if p, ok := peer.FromContext(ctx); ok && device.IP == "" {
+		device.IP, _, _ = net.SplitHostPort(p.Addr.String())
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok && device.UserAgent == "" {
+		device.UserAgent = strings.Join(md.Get("user-agent"), " ")
+	}
+	return device
+}
+
+func toSessionMessages(sessions []session.Session) []*api.Session {
+	messages := make([]*api.Session, 0, len(sessions))
+	for _, s := range sessions {
+		messages = append(messages, &api.Session{
+			StreamId: s.StreamID,
+			Device: &api.Device{
+				DeviceId:   s.Device.DeviceID,
+				DeviceType: s.Device.DeviceType,
+				AppVersion: s.Device.AppVersion,
+				Ip:         s.Device.IP,
+				UserAgent:  s.Device.UserAgent,
+			},
+			ExpiresAt: timestamppb.New(s.ExpiresAt),
+		})
+	}
+	return messages
+}
+
+func (s *streamControllerServer) validateIDs(userID, streamID string) error {
+	if err := s.ids.ValidateUserID("user_id", userID); err != nil {
+		return invalidIDStatus(err)
+	}
+	if err := s.ids.ValidateStreamID("stream_id", streamID); err != nil {
+		return invalidIDStatus(err)
+	}
+	return nil
+}
+
+func invalidIDStatus(err error) error {
+	return status.Error(codes.InvalidArgument, err.Error())
+}
+
+// quotaExceededStatus returns the status of a rejected stream detailed by the limit that was reached
+func quotaExceededStatus(qe *QuotaExceededError, userID, streamID string) error {
+	message := "stop watching one of the active streams to watch this stream"
+	if qe.DeviceType != "" {
+		message = "stop watching one of the active streams on " + qe.DeviceType + " devices to watch this stream"
+	}
+	detail := &api.QuotaExceeded{
+		UserId:     userID,
+		StreamId:   streamID,
+		Streams:    qe.Streams,
+		Limit:      int32(qe.Limit),
+		DeviceType: qe.DeviceType,
+	}
+	if qe.RetryAfter > 0 {
+		detail.RetryAfter = durationpb.New(qe.RetryAfter)
+	}
+	st, err := status.New(codes.ResourceExhausted, message).WithDetails(detail)
+	if err != nil {
+		return status.Error(codes.ResourceExhausted, message)
+	}
+	return st.Err()
+}
+
+// storeStatus returns the status reported when the store fails; timeouts and cancellations are distinguished from
+// other failures so that callers know the store may succeed if the call is retried
+func storeStatus(err error) error {
+	switch {
+	case isTimeout(err):
+		return status.Error(codes.DeadlineExceeded, "the store did not respond before the deadline; try again later")
+	case errors.Cause(err) == context.Canceled:
+		return status.Error(codes.Canceled, "the call was cancelled before the store responded")
+	default:
+		return status.Error(codes.Unavailable, "the streams being watched cannot be read or updated; try again later")
+	}
+}
+
+// authorizeCall interceptor rejecting calls without a valid bearer token and those acting on users other than the
+// subject of the token unless the caller has the service role
+func authorizeCall(logger *zap.SugaredLogger, authenticator *Authenticator) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		var header string
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			header = strings.Join(md.Get("authorization"), "")
+		}
+		claims, err := authenticator.authenticateHeader(header)
+		if err != nil {
+			logger.Debugw(
+				"cannot authenticate caller",
+				"method", info.FullMethod,
+				"error", err,
+			)
+			return nil, status.Error(codes.Unauthenticated, "a valid bearer token is required")
+		}
+		if ur, ok := req.(userRequest); ok && claims.Subject != ur.GetUserId() && !claims.Roles.Has(authenticator.serviceRole) {
+			logger.Debugw(
+				"caller cannot act on user",
+				"method", info.FullMethod,
+				"userID", ur.GetUserId(),
+			)
+			return nil, status.Error(codes.PermissionDenied, "the bearer token does not permit acting on this user")
+		}
+		return handler(context.WithValue(ctx, claimsKey, claims), req)
+	}
+}
+
+// withCallDeadline interceptor bounding the time the handlers may spend waiting on the store
+func withCallDeadline(timeout *StoreTimeout) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		duration := timeout.Duration()
+		if duration <= 0 {
+			return handler(ctx, req)
+		}
+		ctx, cancel := context.WithTimeout(ctx, duration)
+		defer cancel()
+		return handler(ctx, req)
+	}
+}
@@ -0,0 +1,175 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"github.com/golang-jwt/jwt"
+	"github.com/golang/mock/gomock"
+	"github.com/prgodlonton/stream-controller/api"
+	"github.com/prgodlonton/stream-controller/internal/session"
+	"github.com/prgodlonton/stream-controller/testing/mocks"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestShouldStartStreamOverGRPC(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+	store.EXPECT().AddStream(gomock.Any(), "alan", "boxing1", session.Device{DeviceType: "tv", IP: "10.0.0.1", UserAgent: "tv-app"}).Return(session.Change{Evicted: []string{"darts2"}}, nil)
+
+	notifier := NewMemoryNotifier()
+	events, unsubscribe := notifier.Subscribe("alan")
+	defer unsubscribe()
+
+	client := dialGRPC(t, store, WithNotifier(notifier))
+	resp, err := client.StartStream(context.Background(), &api.StartStreamRequest{
+		UserId:   "alan",
+		StreamId: "boxing1",
+		Device:   &api.Device{DeviceType: "tv", Ip: "10.0.0.1", UserAgent: "tv-app"},
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"darts2"}, resp.GetEvicted())
+	event := receiveEvent(t, events)
+	assert.Equal(t, SessionEvictedEvent, event.Type)
+	assert.Equal(t, "darts2", event.StreamID)
+}
+
+func TestShouldReturnResourceExhaustedOverGRPCWhenUserHasReachedStreamQuotaLimit(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+	store.EXPECT().AddStream(gomock.Any(), "olive", "snooker8", gomock.Any()).Return(
+		session.Change{}, &QuotaExceededError{Limit: 1, DeviceType: "tv", Streams: []string{"darts2"}, RetryAfter: 1500 * time.Millisecond},
+	)
+
+	client := dialGRPC(t, store)
+	_, err := client.StartStream(context.Background(), &api.StartStreamRequest{UserId: "olive", StreamId: "snooker8"})
+
+	st := status.Convert(err)
+	assert.Equal(t, codes.ResourceExhausted, st.Code())
+	if assert.Len(t, st.Details(), 1) {
+		detail, ok := st.Details()[0].(*api.QuotaExceeded)
+		if assert.True(t, ok) {
+			assert.Equal(t, int32(1), detail.GetLimit())
+			assert.Equal(t, "tv", detail.GetDeviceType())
+			assert.Equal(t, []string{"darts2"}, detail.GetStreams())
+			assert.Equal(t, 1500*time.Millisecond, detail.GetRetryAfter().AsDuration())
+		}
+	}
+}
+
+func TestShouldListStreamsOverGRPC(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	expiresAt := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	store := mocks.NewMockStore(mockCtrl)
+	store.EXPECT().GetSessions(gomock.Any(), "alan").Return([]session.Session{
+		{StreamID: "boxing1", Device: session.Device{DeviceType: "mobile"}, ExpiresAt: expiresAt},
+	}, nil)
+	store.EXPECT().GetLimit(gomock.Any(), "alan").Return(3, nil)
+
+	client := dialGRPC(t, store)
+	resp, err := client.ListStreams(context.Background(), &api.ListStreamsRequest{UserId: "alan"})
+
+	assert.NoError(t, err)
+	assert.Equal(t, int32(3), resp.GetLimit())
+	assert.Equal(t, int32(2), resp.GetRemaining())
+	if assert.Len(t, resp.GetSessions(), 1) {
+		assert.Equal(t, "boxing1", resp.GetSessions()[0].GetStreamId())
+		assert.Equal(t, "mobile", resp.GetSessions()[0].GetDevice().GetDeviceType())
+		assert.Equal(t, expiresAt, resp.GetSessions()[0].GetExpiresAt().AsTime())
+	}
+}
+
+func TestShouldReturnNotFoundOverGRPCWhenRenewedStreamIsNotBeingWatched(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+	store.EXPECT().RenewStream(gomock.Any(), "alan", "boxing1").Return(session.Change{}, streamNotFound)
+
+	client := dialGRPC(t, store)
+	_, err := client.Heartbeat(context.Background(), &api.HeartbeatRequest{UserId: "alan", StreamId: "boxing1"})
+
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestShouldReturnUnavailableOverGRPCWhenStoreFails(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+	store.EXPECT().RemoveStream(gomock.Any(), "alan", "boxing1").Return(session.Change{}, errors.New("connection refused"))
+
+	client := dialGRPC(t, store)
+	_, err := client.StopStream(context.Background(), &api.StopStreamRequest{UserId: "alan", StreamId: "boxing1"})
+
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestShouldReturnInvalidArgumentOverGRPCWhenStreamIDIsEmpty(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	client := dialGRPC(t, mocks.NewMockStore(mockCtrl))
+	_, err := client.StopStream(context.Background(), &api.StopStreamRequest{UserId: "alan"})
+
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Equal(t, "stream_id must not be empty", status.Convert(err).Message())
+}
+
+func TestShouldAuthorizeCallsOverGRPC(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+	store.EXPECT().RenewStream(gomock.Any(), "alan", "boxing1").Return(session.Change{}, nil)
+
+	client := dialGRPC(t, store, WithAuthenticator(NewAuthenticator(testSecret, nil, "service", "admin", 0)))
+	req := &api.HeartbeatRequest{UserId: "alan", StreamId: "boxing1"}
+
+	_, err := client.Heartbeat(context.Background(), req)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	token := signToken(t, jwt.SigningMethodHS256, testSecret, "", Claims{StandardClaims: standardClaims("mallory")})
+	_, err = client.Heartbeat(metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token), req)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	token = signToken(t, jwt.SigningMethodHS256, testSecret, "", Claims{StandardClaims: standardClaims("alan")})
+	_, err = client.Heartbeat(metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token), req)
+	assert.NoError(t, err)
+}
+
+// dialGRPC serves the gRPC API from the store over an in-memory connection and returns a client calling it
+func dialGRPC(t *testing.T, store Store, opts ...Option) api.StreamControllerClient {
+	listener := bufconn.Listen(1024 * 1024)
+	server := NewGRPCServer(noopLogger, store, opts...)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial(
+		"bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return api.NewStreamControllerClient(conn)
+}
@@ -0,0 +1,125 @@
+package internal
+
+import (
+	"context"
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// HealthCheck checks that a dependency of the service is available, giving up once the context is done
+type HealthCheck func(ctx context.Context) error
+
+// Health reports whether the service is alive and ready to receive requests
+type Health struct {
+	draining int32
+	timeout  int64
+	checks   map[string]HealthCheck
+}
+
+// healthResponse the JSON body returned by the readiness endpoint
+type healthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// NewHealth creates a new health reporter whose readiness checks must each pass within the timeout
+func NewHealth(timeout time.Duration, checks map[string]HealthCheck) *Health {
+	return &Health{
+		timeout: int64(timeout),
+		checks:  checks,
+	}
+}
+
+// SetTimeout changes the time within which each readiness check must pass
+func (h *Health) SetTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&h.timeout, int64(timeout))
+}
+
+// Drain marks the service as not ready so that load balancers stop sending it requests before it shuts down
+func (h *Health) Drain() {
+	atomic.StoreInt32(&h.draining, 1)
+}
+
+// Check runs the readiness checks and returns their results by name; the service is ready if the error is nil
+func (h *Health) Check(ctx context.Context) (map[string]string, error) {
+	results := make(map[string]string, len(h.checks))
+	var failed []string
+	for name, check := range h.checks {
+		if err := h.run(ctx, check); err != nil {
+			results[name] = err.Error()
+			failed = append(failed, name)
+			continue
+		}
+		results[name] = "ok"
+	}
+	if atomic.LoadInt32(&h.draining) == 1 {
+		return results, errors.New("service is draining")
+	}
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return results, errors.Errorf("failed health checks: %v", failed)
+	}
+	return results, nil
+}
+
+// run runs the check giving up once the timeout has elapsed, when the check's context is cancelled so that it stops
+func (h *Health) run(ctx context.Context, check HealthCheck) error {
+	timeout := time.Duration(atomic.LoadInt64(&h.timeout))
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- check(ctx)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return errors.Errorf("timed out after %v", timeout)
+		}
+		return ctx.Err()
+	}
+}
+
+// RedisHealthCheck returns the check that Redis responds to a ping; go-redis does not interrupt commands in flight,
+// so a ping already sent is bounded by the client's read timeout rather than the context
+func RedisHealthCheck(client redis.UniversalClient) HealthCheck {
+	return func(ctx context.Context) error {
+		c, err := withContext(ctx, client)
+		if err != nil {
+			return err
+		}
+		return c.Ping().Err()
+	}
+}
+
+// liveness returns OK whilst the process is able to serve requests
+func liveness() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// readiness returns OK if the readiness checks pass, otherwise Service Unavailable
+func readiness(logger *zap.SugaredLogger, health *Health) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		results, err := health.Check(r.Context())
+		if err != nil {
+			logger.Warnw(
+				"service is not ready",
+				"checks", results,
+				"error", err,
+			)
+			writeJSON(logger, w, http.StatusServiceUnavailable, healthResponse{Status: "unavailable", Checks: results})
+			return
+		}
+		writeJSON(logger, w, http.StatusOK, healthResponse{Status: "ready", Checks: results})
+	}
+}
@@ -0,0 +1,83 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestShouldReturnOKWhenServiceIsReady(t *testing.T) {
+	health := NewHealth(time.Second, map[string]HealthCheck{
+		"redis": func(ctx context.Context) error { return nil },
+	})
+
+	w := httptest.NewRecorder()
+	router := NewRouter(noopLogger, nil, WithHealth(health))
+	router.ServeHTTP(w, createHTTPRequest("GET", "readyz"))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"status":"ready","checks":{"redis":"ok"}}`, w.Body.String())
+}
+
+func TestShouldReturnServiceUnavailableWhenHealthCheckFails(t *testing.T) {
+	health := NewHealth(time.Second, map[string]HealthCheck{
+		"redis": func(ctx context.Context) error { return errors.New("intentional error") },
+	})
+
+	w := httptest.NewRecorder()
+	router := NewRouter(noopLogger, nil, WithHealth(health))
+	router.ServeHTTP(w, createHTTPRequest("GET", "readyz"))
+
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.JSONEq(t, `{"status":"unavailable","checks":{"redis":"intentional error"}}`, w.Body.String())
+}
+
+func TestShouldReturnServiceUnavailableWhenHealthCheckTimesOut(t *testing.T) {
+	health := NewHealth(10*time.Millisecond, map[string]HealthCheck{
+		"redis": func(ctx context.Context) error {
+			time.Sleep(time.Second)
+			return nil
+		},
+	})
+
+	_, err := health.Check(context.Background())
+	assert.Error(t, err)
+}
+
+func TestShouldCancelHealthCheckThatTimesOut(t *testing.T) {
+	cancelled := make(chan struct{})
+	health := NewHealth(10*time.Millisecond, map[string]HealthCheck{
+		"consul": func(ctx context.Context) error {
+			<-ctx.Done()
+			close(cancelled)
+			return ctx.Err()
+		},
+	})
+
+	results, err := health.Check(context.Background())
+	assert.Error(t, err)
+	assert.Equal(t, "timed out after 10ms", results["consul"])
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("health check was not cancelled")
+	}
+}
+
+func TestShouldReturnServiceUnavailableWhenDrainingButStillAlive(t *testing.T) {
+	health := NewHealth(time.Second, map[string]HealthCheck{})
+	health.Drain()
+	router := NewRouter(noopLogger, nil, WithHealth(health))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, createHTTPRequest("GET", "readyz"))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, createHTTPRequest("GET", "healthz"))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
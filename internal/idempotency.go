@@ -0,0 +1,340 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// header holding the client's key identifying retries of the same request
+	idempotencyKeyHeader = "Idempotency-Key"
+
+	// header marking responses replayed for retried requests
+	idempotentReplayedHeader = "Idempotent-Replayed"
+
+	// maximum length of idempotency keys
+	maxIdempotencyKeyLength = 255
+
+	// time for which a key is held whilst its first request is in flight, after which it may be retried
+	idempotencyLockDuration = time.Minute
+
+	// lua script returning the response recorded for the key KEYS[1], if any, otherwise recording the pending
+	// response ARGV[1] for ARGV[2] milliseconds
+	reserveIdempotencyKey = `
+local recorded = redis.call("GET",KEYS[1])
+if recorded then
+	return recorded
+end
+redis.call("SET",KEYS[1],ARGV[1],"PX",ARGV[2])
+return false`
+)
+
+// IdempotentResponse the response recorded for an idempotency key along with the fingerprint of the request that
+// produced it; the response is pending whilst the request is in flight
+type IdempotentResponse struct {
+	Fingerprint string      `json:"fingerprint"`
+	Pending     bool        `json:"pending,omitempty"`
+	Status      int         `json:"status,omitempty"`
+	Header      http.Header `json:"header,omitempty"`
+	Body        []byte      `json:"body,omitempty"`
+}
+
+// IdempotencyStore records the responses to requests by the user's idempotency keys so that they may be replayed
+type IdempotencyStore interface {
+	// Reserve records a pending response for the key unless a response is already recorded, which is returned
+	// instead; it returns nil if the key was reserved
+	Reserve(ctx context.Context, userID, key, fingerprint string) (*IdempotentResponse, error)
+
+	// Save records the response for the key
+	Save(ctx context.Context, userID, key string, response IdempotentResponse) error
+
+	// Release forgets the key so that its request may be retried
+	Release(ctx context.Context, userID, key string) error
+}
+
+// RedisIdempotencyStore records responses in Redis until they expire
+type RedisIdempotencyStore struct {
+	client redis.UniversalClient
+	keys   KeySpace
+	ttl    time.Duration
+}
+
+// NewRedisIdempotencyStore creates a new store recording responses in the key space for the ttl
+func NewRedisIdempotencyStore(client redis.UniversalClient, keys KeySpace, ttl time.Duration) IdempotencyStore {
+	return &RedisIdempotencyStore{
+		client: client,
+		keys:   keys,
+		ttl:    ttl,
+	}
+}
+
+// Reserve records a pending response for the key unless a response is already recorded, which is returned instead
+func (ris *RedisIdempotencyStore) Reserve(ctx context.Context, userID, key, fingerprint string) (*IdempotentResponse, error) {
+	client, err := withContext(ctx, ris.client)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := json.Marshal(IdempotentResponse{Fingerprint: fingerprint, Pending: true})
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot encode pending response")
+	}
+	cmd := client.Eval(
+		reserveIdempotencyKey,
+		[]string{ris.keys.Idempotency(userID, key)},
+		pending,
+		idempotencyLockDuration.Nanoseconds()/int64(time.Millisecond),
+	)
+	val, err := cmd.Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to reserve idempotency key")
+	}
+	recorded, ok := val.(string)
+	if !ok {
+		return nil, errors.New("cannot convert redis eval return value to string")
+	}
+	response := &IdempotentResponse{}
+	if err := json.Unmarshal([]byte(recorded), response); err != nil {
+		return nil, errors.Wrap(err, "cannot decode recorded response")
+	}
+	return response, nil
+}
+
+// Save records the response for the key until the ttl passes
+func (ris *RedisIdempotencyStore) Save(ctx context.Context, userID, key string, response IdempotentResponse) error {
+	client, err := withContext(ctx, ris.client)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(response)
+	if err != nil {
+		return errors.Wrap(err, "cannot encode response")
+	}
+	if err := client.Set(ris.keys.Idempotency(userID, key), data, ris.ttl).Err(); err != nil {
+		return errors.Wrap(err, "failed to save response")
+	}
+	return nil
+}
+
+// Release forgets the key
+func (ris *RedisIdempotencyStore) Release(ctx context.Context, userID, key string) error {
+	client, err := withContext(ctx, ris.client)
+	if err != nil {
+		return err
+	}
+	if err := client.Del(ris.keys.Idempotency(userID, key)).Err(); err != nil {
+		return errors.Wrap(err, "failed to release idempotency key")
+	}
+	return nil
+}
+
+// MemoryIdempotencyStore records responses in memory for local development and testing
+type MemoryIdempotencyStore struct {
+	mu        sync.Mutex
+	responses map[string]memoryResponse
+	ttl       time.Duration
+	now       func() time.Time
+}
+
+type memoryResponse struct {
+	response IdempotentResponse
+	expiry   time.Time
+}
+
+// NewMemoryIdempotencyStore creates a new store recording responses in memory for the ttl
+func NewMemoryIdempotencyStore(ttl time.Duration) IdempotencyStore {
+	return &MemoryIdempotencyStore{
+		responses: make(map[string]memoryResponse),
+		ttl:       ttl,
+		now:       time.Now,
+	}
+}
+
+// Reserve records a pending response for the key unless a response is already recorded, which is returned instead
+func (mis *MemoryIdempotencyStore) Reserve(ctx context.Context, userID, key, fingerprint string) (*IdempotentResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	mis.mu.Lock()
+	defer mis.mu.Unlock()
+
+	now := mis.now()
+	mis.prune(now)
+	if recorded, ok := mis.responses[userID+"\x00"+key]; ok {
+		response := recorded.response
+		return &response, nil
+	}
+	mis.responses[userID+"\x00"+key] = memoryResponse{
+		response: IdempotentResponse{Fingerprint: fingerprint, Pending: true},
+		expiry:   now.Add(idempotencyLockDuration),
+	}
+	return nil, nil
+}
+
+// Save records the response for the key until the ttl passes
+func (mis *MemoryIdempotencyStore) Save(ctx context.Context, userID, key string, response IdempotentResponse) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	mis.mu.Lock()
+	defer mis.mu.Unlock()
+
+	mis.responses[userID+"\x00"+key] = memoryResponse{response: response, expiry: mis.now().Add(mis.ttl)}
+	return nil
+}
+
+// Release forgets the key
+func (mis *MemoryIdempotencyStore) Release(ctx context.Context, userID, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	mis.mu.Lock()
+	defer mis.mu.Unlock()
+
+	delete(mis.responses, userID+"\x00"+key)
+	return nil
+}
+
+// prune forgets the expired responses
+func (mis *MemoryIdempotencyStore) prune(now time.Time) {
+	for key, recorded := range mis.responses {
+		if !recorded.expiry.After(now) {
+			delete(mis.responses, key)
+		}
+	}
+}
+
+// idempotent middleware replaying the recorded response to PUT and DELETE requests retried with the same idempotency
+// key; keys reused for different requests, or whose first request is still in flight, are rejected as conflicts and
+// responses to requests that failed with server errors are not recorded so that they may be retried
+func idempotent(logger *zap.SugaredLogger, store IdempotencyStore) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(idempotencyKeyHeader)
+			if key == "" || (r.Method != http.MethodPut && r.Method != http.MethodDelete) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			userID := chi.URLParam(r, "userID")
+			if len(key) > maxIdempotencyKeyLength {
+				writeProblem(logger, w, invalidRequest(idempotencyKeyHeader, "the idempotency key must be at most 255 characters"))
+				return
+			}
+			body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxDeviceSize+1))
+			if err != nil {
+				writeProblem(logger, w, invalidRequest("", "the body cannot be read"))
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			fingerprint := requestFingerprint(r, body)
+
+			recorded, err := store.Reserve(r.Context(), userID, key, fingerprint)
+			if err != nil {
+				logger.Errorw(
+					"cannot reserve idempotency key",
+					"userID", userID,
+					"error", err,
+				)
+				writeProblem(logger, w, storeProblem(err, userID, ""))
+				return
+			}
+			if recorded != nil {
+				replay(logger, w, recorded, fingerprint, userID)
+				return
+			}
+
+			var recordedBody bytes.Buffer
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			ww.Tee(&recordedBody)
+			next.ServeHTTP(ww, r)
+
+			// the outcome is recorded even if the client has gone away so that its retries are replayed
+			ctx := context.Background()
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+			if status >= http.StatusInternalServerError {
+				if err := store.Release(ctx, userID, key); err != nil {
+					logger.Errorw(
+						"cannot release idempotency key",
+						"userID", userID,
+						"error", err,
+					)
+				}
+				return
+			}
+			response := IdempotentResponse{
+				Fingerprint: fingerprint,
+				Status:      status,
+				Header:      w.Header().Clone(),
+				Body:        recordedBody.Bytes(),
+			}
+			if err := store.Save(ctx, userID, key, response); err != nil {
+				logger.Errorw(
+					"cannot save response for idempotency key",
+					"userID", userID,
+					"error", err,
+				)
+			}
+		})
+	}
+}
+
+// replay writes the response recorded for a request retried with the same idempotency key
+func replay(logger *zap.SugaredLogger, w http.ResponseWriter, recorded *IdempotentResponse, fingerprint, userID string) {
+	if recorded.Fingerprint != fingerprint {
+		logger.Debugw(
+			"idempotency key reused for a different request",
+			"userID", userID,
+		)
+		p := newProblem(http.StatusConflict, idempotencyKeyReusedCode, "Idempotency key reused")
+		p.Detail = "the idempotency key was used for a different request; use a new key for each request"
+		p.UserID = userID
+		writeProblem(logger, w, p)
+		return
+	}
+	if recorded.Pending {
+		p := newProblem(http.StatusConflict, requestInProgressCode, "Request in progress")
+		p.Detail = "the first request with the idempotency key has not completed; try again later"
+		p.UserID = userID
+		writeProblem(logger, w, p)
+		return
+	}
+	for name, values := range recorded.Header {
+		w.Header()[name] = values
+	}
+	w.Header().Set(idempotentReplayedHeader, "true")
+	w.WriteHeader(recorded.Status)
+	if _, err := w.Write(recorded.Body); err != nil {
+		logger.Errorw(
+			"cannot write to http response",
+			"userID", userID,
+			"error", err,
+		)
+	}
+}
+
+// requestFingerprint returns the hash of the request's method, path, negotiated content type and body identifying
+// retries of the request, so that a recorded response is only replayed in the format it was requested in
+func requestFingerprint(r *http.Request, body []byte) string {
+	hash := sha256.New()
+	io.WriteString(hash, r.Method+" "+r.URL.Path+" "+responseContentType(r)+"\n")
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
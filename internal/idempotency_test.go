@@ -0,0 +1,149 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/golang/mock/gomock"
+	"github.com/prgodlonton/stream-controller/internal/session"
+	"github.com/prgodlonton/stream-controller/testing/mocks"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShouldReplayResponseToRequestRetriedWithSameIdempotencyKey(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+	store.EXPECT().AddStream(gomock.Any(), "alan", "boxing1", gomock.Any()).Times(1).Return(session.Change{Evicted: []string{"darts2"}}, nil)
+
+	router := NewRouter(noopLogger, store, WithIdempotency(NewMemoryIdempotencyStore(time.Hour)))
+	first := serveIdempotent(router, "PUT", "/v1/users/alan/streams/boxing1", "key-1", `{"deviceType":"tv"}`)
+	retried := serveIdempotent(router, "PUT", "/v1/users/alan/streams/boxing1", "key-1", `{"deviceType":"tv"}`)
+
+	assert.Equal(t, http.StatusCreated, first.Code)
+	assert.Equal(t, first.Code, retried.Code)
+	assert.Equal(t, first.Body.String(), retried.Body.String())
+	assert.Equal(t, "darts2", retried.Header().Get(evictedHeader))
+	assert.Equal(t, "true", retried.Header().Get(idempotentReplayedHeader))
+	assert.Empty(t, first.Header().Get(idempotentReplayedHeader))
+}
+
+func TestShouldReturnConflictWhenIdempotencyKeyIsReusedForDifferentRequest(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+	store.EXPECT().RemoveStream(gomock.Any(), "becky", "rugby7").Times(1).Return(session.Change{}, nil)
+
+	router := NewRouter(noopLogger, store, WithIdempotency(NewMemoryIdempotencyStore(time.Hour)))
+	serveIdempotent(router, "DELETE", "/v1/users/becky/streams/rugby7", "key-2", "")
+	w := serveIdempotent(router, "DELETE", "/v1/users/becky/streams/tennis2", "key-2", "")
+
+	assert.Equal(t, http.StatusConflict, w.Code)
+	var p problem
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &p))
+	assert.Equal(t, idempotencyKeyReusedCode, p.Code)
+}
+
+func TestShouldReturnConflictWhenIdempotencyKeyIsReusedForDifferentContentType(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+	store.EXPECT().RemoveStream(gomock.Any(), "becky", "rugby7").Times(1).Return(session.Change{}, nil)
+
+	router := NewRouter(noopLogger, store, WithIdempotency(NewMemoryIdempotencyStore(time.Hour)))
+	var codes []int
+	for _, accept := range []string{textContentType, jsonContentType} {
+		r := httptest.NewRequest("DELETE", "/v1/users/becky/streams/rugby7", nil)
+		r.Header.Set(idempotencyKeyHeader, "key-7")
+		r.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		codes = append(codes, w.Code)
+		if accept == jsonContentType {
+			assert.Contains(t, w.Body.String(), idempotencyKeyReusedCode)
+		}
+	}
+
+	assert.Equal(t, []int{http.StatusOK, http.StatusConflict}, codes)
+}
+
+func TestShouldReturnConflictWhenFirstRequestWithIdempotencyKeyIsInFlight(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	idempotency := NewMemoryIdempotencyStore(time.Hour)
+	fingerprint := requestFingerprint(httptest.NewRequest("DELETE", "/v1/users/charles/streams/golf4", nil), nil)
+	_, err := idempotency.Reserve(context.Background(), "charles", "key-3", fingerprint)
+	assert.NoError(t, err)
+
+	router := NewRouter(noopLogger, mocks.NewMockStore(mockCtrl), WithIdempotency(idempotency))
+	w := serveIdempotent(router, "DELETE", "/v1/users/charles/streams/golf4", "key-3", "")
+
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), requestInProgressCode)
+}
+
+func TestShouldNotRecordServerErrorsForIdempotencyKey(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+	gomock.InOrder(
+		store.EXPECT().RemoveStream(gomock.Any(), "dorothy", "squash5").Return(session.Change{}, errors.New("connection refused")),
+		store.EXPECT().RemoveStream(gomock.Any(), "dorothy", "squash5").Return(session.Change{}, nil),
+	)
+
+	router := NewRouter(noopLogger, store, WithIdempotency(NewMemoryIdempotencyStore(time.Hour)))
+	first := serveIdempotent(router, "DELETE", "/v1/users/dorothy/streams/squash5", "key-4", "")
+	retried := serveIdempotent(router, "DELETE", "/v1/users/dorothy/streams/squash5", "key-4", "")
+
+	assert.Equal(t, http.StatusInternalServerError, first.Code)
+	assert.Equal(t, http.StatusOK, retried.Code)
+	assert.Empty(t, retried.Header().Get(idempotentReplayedHeader))
+}
+
+func TestShouldRejectIdempotencyKeyLongerThanLimit(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	router := NewRouter(noopLogger, mocks.NewMockStore(mockCtrl), WithIdempotency(NewMemoryIdempotencyStore(time.Hour)))
+	w := serveIdempotent(router, "PUT", "/v1/users/edward/streams/boxing1", strings.Repeat("k", 256), "")
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	var p problem
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &p))
+	assert.Equal(t, idempotencyKeyHeader, p.Field)
+}
+
+func TestShouldForgetRecordedResponsesOnceExpired(t *testing.T) {
+	idempotency := NewMemoryIdempotencyStore(time.Minute).(*MemoryIdempotencyStore)
+	now := time.Now()
+	idempotency.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	assert.NoError(t, idempotency.Save(ctx, "frank", "key-5", IdempotentResponse{Fingerprint: "abc", Status: http.StatusOK}))
+	recorded, err := idempotency.Reserve(ctx, "frank", "key-5", "abc")
+	assert.NoError(t, err)
+	assert.Equal(t, &IdempotentResponse{Fingerprint: "abc", Status: http.StatusOK}, recorded)
+
+	now = now.Add(2 * time.Minute)
+	recorded, err = idempotency.Reserve(ctx, "frank", "key-5", "abc")
+	assert.NoError(t, err)
+	assert.Nil(t, recorded)
+}
+
+func serveIdempotent(router http.Handler, method, path, key, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set(idempotencyKeyHeader, key)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"strings"
+)
+
+const (
+	// characters with special meaning in the patterns matched by the redis SCAN command
+	globCharacters = `*?[]^\`
+)
+
+// KeySpace names the Redis keys holding the store's data under a common prefix; each user's keys hold the user ID as
+// a hash tag so that they are all stored in the same Redis Cluster slot
+type KeySpace struct {
+	prefix string
+}
+
+// NewKeySpace creates a new key space whose keys are prefixed by the given prefix, e.g. "sc:prod"
+func NewKeySpace(prefix string) KeySpace {
+	if prefix != "" && !strings.HasSuffix(prefix, ":") {
+		prefix += ":"
+	}
+	return KeySpace{prefix: prefix}
+}
+
+// Streams returns the key of the sorted set holding the leases of the streams being watched by the user
+func (ks KeySpace) Streams(userID string) string {
+	return ks.prefix + "user:{" + userID + "}:streams"
+}
+
+// Devices returns the key of the hash holding the devices on which the user is watching streams indexed by stream
+func (ks KeySpace) Devices(userID string) string {
+	return ks.prefix + "user:{" + userID + "}:devices"
+}
+
+// Started returns the key of the sorted set holding the streams being watched by the user scored by the time in
+// milliseconds that each was started
+func (ks KeySpace) Started(userID string) string {
+	return ks.prefix + "user:{" + userID + "}:started"
+}
+
+// Idempotency returns the key of the string holding the response recorded for the user's idempotency key
+func (ks KeySpace) Idempotency(userID, key string) string {
+	return ks.prefix + "user:{" + userID + "}:idempotency:" + key
+}
+
+// Quotas returns the key of the hash holding the per-user limits that override the default limit
+func (ks KeySpace) Quotas() string {
+	return ks.prefix + "quotas"
+}
+
+// Events returns the name of the channel on which events are published to every instance
+func (ks KeySpace) Events() string {
+	return ks.prefix + "events"
+}
+
+// DomainEvents returns the key of the stream to which domain events are published for other services
+func (ks KeySpace) DomainEvents() string {
+	return ks.prefix + "domain-events"
+}
+
+// StreamsPattern returns the pattern matching the keys of every user's streams
+func (ks KeySpace) StreamsPattern() string {
+	return escapeGlob(ks.prefix) + "user:{*}:streams"
+}
+
+// UserID returns the user whose streams are held by the key, or false if the key does not hold a user's streams
+func (ks KeySpace) UserID(key string) (string, bool) {
+	head, tail := ks.prefix+"user:{", "}:streams"
+	if len(key) <= len(head)+len(tail) || !strings.HasPrefix(key, head) || !strings.HasSuffix(key, tail) {
+		return "", false
+	}
+	return key[len(head) : len(key)-len(tail)], true
+}
+
+// Owns returns true if the key is in the key space
+func (ks KeySpace) Owns(key string) bool {
+	_, ok := ks.UserID(key)
+	if ok || key == ks.Quotas() || key == ks.DomainEvents() {
+		return true
+	}
+	head := ks.prefix + "user:{"
+	if !strings.HasPrefix(key, head) {
+		return false
+	}
+	return strings.HasSuffix(key, "}:devices") || strings.HasSuffix(key, "}:started") || strings.Contains(key, "}:idempotency:")
+}
+
+func escapeGlob(s string) string {
+	var sb strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(globCharacters, r) {
+			sb.WriteRune('\\')
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
@@ -0,0 +1,47 @@
+package internal
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestShouldNameKeysWithinPrefixUsingUserIDAsHashTag(t *testing.T) {
+	keys := NewKeySpace("sc:prod")
+
+	assert.Equal(t, "sc:prod:user:{alan}:streams", keys.Streams("alan"))
+	assert.Equal(t, "sc:prod:user:{alan}:started", keys.Started("alan"))
+	assert.Equal(t, "sc:prod:user:{alan}:idempotency:key-1", keys.Idempotency("alan", "key-1"))
+	assert.Equal(t, "sc:prod:quotas", keys.Quotas())
+	assert.Equal(t, "sc:prod:events", keys.Events())
+	assert.Equal(t, "sc:prod:domain-events", keys.DomainEvents())
+	assert.Equal(t, "sc:prod:user:{*}:streams", keys.StreamsPattern())
+	assert.Equal(t, "user:{alan}:streams", NewKeySpace("").Streams("alan"))
+}
+
+func TestShouldReturnUserIDOfStreamsKey(t *testing.T) {
+	keys := NewKeySpace("sc:")
+
+	userID, ok := keys.UserID("sc:user:{alan}:streams")
+	assert.True(t, ok)
+	assert.Equal(t, "alan", userID)
+
+	for _, key := range []string{"alan", "sc:quotas", "sc:user:{}:streams", "other:user:{alan}:streams"} {
+		_, ok := keys.UserID(key)
+		assert.False(t, ok, key)
+	}
+}
+
+func TestShouldOwnKeysWithinPrefix(t *testing.T) {
+	keys := NewKeySpace("sc")
+
+	for _, key := range []string{keys.Streams("alan"), keys.Devices("alan"), keys.Idempotency("alan", "key-1"), keys.Quotas()} {
+		assert.True(t, keys.Owns(key), key)
+	}
+	for _, key := range []string{"alan", "quotas", "other:user:{alan}:idempotency:key-1"} {
+		assert.False(t, keys.Owns(key), key)
+	}
+}
+
+func TestShouldEscapeGlobCharactersOfPrefixInStreamsPattern(t *testing.T) {
+	assert.Equal(t, `sc\*\[1\]:user:{*}:streams`, NewKeySpace("sc*[1]").StreamsPattern())
+}
@@ -0,0 +1,328 @@
+package internal
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/prgodlonton/stream-controller/internal/session"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore an in-memory store for local development and testing
+type MemoryStore struct {
+	mu            sync.Mutex
+	sessions      map[string]map[string]session.Session
+	quotas        Quotas
+	leaseDuration time.Duration
+	now           func() time.Time
+}
+
+// NewMemoryStore creates a new in-memory store whose streams expire unless renewed within the lease duration
+func NewMemoryStore(quotas Quotas, leaseDuration time.Duration) Store {
+	return &MemoryStore{
+		sessions:      make(map[string]map[string]session.Session),
+		quotas:        quotas,
+		leaseDuration: leaseDuration,
+		now:           time.Now,
+	}
+}
+
+// AddStream records a user as watching a stream on the device, evicting streams to make room for it if the eviction
+// policy allows, and returns the evicted streams
+func (ms *MemoryStore) AddStream(ctx context.Context, userID, streamID string, device session.Device) (session.Change, error) {
+	limit, err := ms.quotas.Limit(ctx, userID)
+	if err != nil {
+		return session.Change{}, err
+	}
+	policy := ms.quotas.EvictionPolicy()
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	now := ms.now()
+	sessions, expired := ms.prune(userID, now)
+	existing, held := sessions[streamID]
+	change := session.Change{Expired: expired}
+	if !held && len(sessions) >= limit && (policy == RejectPolicy || limit < 1) {
+		return change, &QuotaExceededError{
+			Limit:      limit,
+			Streams:    sortedStreamIDs(sessions),
+			RetryAfter: soonestExpiry(sessions).Sub(now),
+		}
+	}
+	deviceLimit, limited := ms.quotas.DeviceLimit(device.DeviceType)
+	limited = limited && device.DeviceType != ""
+	typed := make(map[string]session.Session)
+	if limited {
+		for otherID, s := range sessions {
+			if otherID != streamID && s.Device.DeviceType == device.DeviceType {
+				typed[otherID] = s
+			}
+		}
+		if len(typed) >= deviceLimit && (policy == RejectPolicy || deviceLimit < 1) {
+			return change, &QuotaExceededError{
+				Limit:      deviceLimit,
+				DeviceType: device.DeviceType,
+				Streams:    sortedStreamIDs(typed),
+				RetryAfter: soonestExpiry(typed).Sub(now),
+			}
+		}
+	}
+
+	for limited && len(typed) >= deviceLimit {
+		victim := selectVictim(typed, policy)
+		delete(typed, victim)
+		delete(sessions, victim)
+		change.Evicted = append(change.Evicted, victim)
+	}
+	for !held && len(sessions) >= limit {
+		victim := selectVictim(sessions, policy)
+		delete(sessions, victim)
+		change.Evicted = append(change.Evicted, victim)
+	}
+
+	if sessions == nil {
+		sessions = make(map[string]session.Session)
+		ms.sessions[userID] = sessions
+	}
+	startedAt := now
+	if held {
+		startedAt = existing.StartedAt
+	}
+	sessions[streamID] = session.Session{
+		StreamID:  streamID,
+		Device:    device,
+		StartedAt: startedAt,
+		ExpiresAt: now.Add(ms.leaseDuration),
+	}
+	change.Changed = !held
+	return change, nil
+}
+
+// Apply applies the batch of operations in turn, returning the result of each in the same order
+func (ms *MemoryStore) Apply(ctx context.Context, operations []session.Operation) ([]session.Result, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	results := make([]session.Result, len(operations))
+	for i, op := range operations {
+		switch op.Op {
+		case session.StartOperation:
+			results[i].Change, results[i].Err = ms.AddStream(ctx, op.UserID, op.StreamID, op.Device)
+		case session.StopOperation:
+			results[i].Change, results[i].Err = ms.RemoveStream(ctx, op.UserID, op.StreamID)
+		default:
+			results[i].Err = errors.Errorf("unknown operation %q", op.Op)
+		}
+	}
+	return results, nil
+}
+
+// ExpireStreams removes the user's streams whose leases have expired and returns them
+func (ms *MemoryStore) ExpireStreams(ctx context.Context, userID string) (session.Change, error) {
+	if err := ctx.Err(); err != nil {
+		return session.Change{}, err
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	_, expired := ms.prune(userID, ms.now())
+	return session.Change{Expired: expired}, nil
+}
+
+// GetLimit returns the number of streams the user may watch concurrently
+func (ms *MemoryStore) GetLimit(ctx context.Context, userID string) (int, error) {
+	return ms.quotas.Limit(ctx, userID)
+}
+
+// GetSessions returns the streams being watched by a single user, ordered by lease expiry, with their devices and
+// start times
+func (ms *MemoryStore) GetSessions(ctx context.Context, userID string) ([]session.Session, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	sessions := ms.live(userID, ms.now())
+	sorted := make([]session.Session, 0, len(sessions))
+	for _, streamID := range sortedStreamIDs(sessions) {
+		sorted = append(sorted, sessions[streamID])
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].ExpiresAt.Before(sorted[j].ExpiresAt)
+	})
+	return sorted, nil
+}
+
+// GetStreams returns all streams being watched by a single user
+func (ms *MemoryStore) GetStreams(ctx context.Context, userID string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return []string{}, err
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	return sortedStreamIDs(ms.live(userID, ms.now())), nil
+}
+
+// ListUsers returns a page of the users watching streams, or whose expired streams have not yet been removed, and
+// the cursor of the next page, which is zero once all users have been returned
+func (ms *MemoryStore) ListUsers(ctx context.Context, cursor uint64, count int64) ([]string, uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return []string{}, 0, err
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	userIDs := make([]string, 0, len(ms.sessions))
+	for userID := range ms.sessions {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Strings(userIDs)
+
+	if cursor >= uint64(len(userIDs)) {
+		return []string{}, 0, nil
+	}
+	end := cursor + uint64(count)
+	if count <= 0 || end >= uint64(len(userIDs)) {
+		return userIDs[cursor:], 0, nil
+	}
+	return userIDs[cursor:end], end, nil
+}
+
+// RemoveAllStreams removes the records of all streams being watched by a user
+func (ms *MemoryStore) RemoveAllStreams(ctx context.Context, userID string) (session.Change, error) {
+	if err := ctx.Err(); err != nil {
+		return session.Change{}, err
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	sessions, expired := ms.prune(userID, ms.now())
+	delete(ms.sessions, userID)
+	return session.Change{Changed: len(sessions) > 0, Expired: expired}, nil
+}
+
+// RemoveStream removes the record of a user watching a stream
+func (ms *MemoryStore) RemoveStream(ctx context.Context, userID, streamID string) (session.Change, error) {
+	if err := ctx.Err(); err != nil {
+		return session.Change{}, err
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	sessions, expired := ms.prune(userID, ms.now())
+	_, held := sessions[streamID]
+	if held {
+		delete(sessions, streamID)
+		if len(sessions) == 0 {
+			delete(ms.sessions, userID)
+		}
+	}
+	return session.Change{Changed: held, Expired: expired}, nil
+}
+
+// RenewStream extends the lease of a stream the user is watching
+func (ms *MemoryStore) RenewStream(ctx context.Context, userID, streamID string) (session.Change, error) {
+	if err := ctx.Err(); err != nil {
+		return session.Change{}, err
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	now := ms.now()
+	sessions, expired := ms.prune(userID, now)
+	change := session.Change{Expired: expired}
+	s, ok := sessions[streamID]
+	if !ok {
+		return change, streamNotFound
+	}
+	s.ExpiresAt = now.Add(ms.leaseDuration)
+	sessions[streamID] = s
+	change.Changed = true
+	return change, nil
+}
+
+// SetLimit overrides the number of streams the user may watch concurrently for the duration, or indefinitely if the
+// duration is zero
+func (ms *MemoryStore) SetLimit(ctx context.Context, userID string, limit int, duration time.Duration) error {
+	return ms.quotas.Override(ctx, userID, limit, duration)
+}
+
+// prune removes the user's expired sessions and returns those remaining along with the expired streams, in order;
+// the caller must hold the lock
+func (ms *MemoryStore) prune(userID string, now time.Time) (map[string]session.Session, []string) {
+	sessions, ok := ms.sessions[userID]
+	if !ok {
+		return nil, nil
+	}
+	var expired []string
+	for _, streamID := range sortedStreamIDs(sessions) {
+		if !sessions[streamID].ExpiresAt.After(now) {
+			delete(sessions, streamID)
+			expired = append(expired, streamID)
+		}
+	}
+	if len(sessions) == 0 {
+		delete(ms.sessions, userID)
+		return nil, expired
+	}
+	return sessions, expired
+}
+
+// live returns the user's sessions whose leases have not expired, leaving the expired sessions to be pruned by the
+// operations changing the user's streams so that they are reported; the caller must hold the lock
+func (ms *MemoryStore) live(userID string, now time.Time) map[string]session.Session {
+	sessions := make(map[string]session.Session, len(ms.sessions[userID]))
+	for streamID, s := range ms.sessions[userID] {
+		if s.ExpiresAt.After(now) {
+			sessions[streamID] = s
+		}
+	}
+	return sessions
+}
+
+func sortedStreamIDs(sessions map[string]session.Session) []string {
+	streamIDs := make([]string, 0, len(sessions))
+	for streamID := range sessions {
+		streamIDs = append(streamIDs, streamID)
+	}
+	sort.Strings(streamIDs)
+	return streamIDs
+}
+
+// selectVictim returns the stream to evict under the policy, which is the stream started first unless the policy
+// evicts the stream whose lease was least recently renewed
+func selectVictim(sessions map[string]session.Session, policy EvictionPolicy) string {
+	var victim string
+	var lowest time.Time
+	for _, streamID := range sortedStreamIDs(sessions) {
+		t := sessions[streamID].StartedAt
+		if policy == EvictIdlePolicy {
+			t = sessions[streamID].ExpiresAt
+		}
+		if victim == "" || t.Before(lowest) {
+			victim, lowest = streamID, t
+		}
+	}
+	return victim
+}
+
+func soonestExpiry(sessions map[string]session.Session) time.Time {
+	var soonest time.Time
+	for _, s := range sessions {
+		if soonest.IsZero() || s.ExpiresAt.Before(soonest) {
+			soonest = s.ExpiresAt
+		}
+	}
+	return soonest
+}
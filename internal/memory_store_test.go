@@ -0,0 +1,226 @@
+package internal
+
+import (
+	"context"
+	"github.com/prgodlonton/stream-controller/internal/session"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreShouldRejectStreamsBeyondTheUsersLimit(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	store := NewMemoryStore(NewMemoryQuotas(2), time.Minute).(*MemoryStore)
+	store.now = clock.Now
+
+	assert.NoError(t, addStream(store, "alan", "boxing1", session.Device{}))
+	clock.Advance(10 * time.Second)
+	assert.NoError(t, addStream(store, "alan", "tennis2", session.Device{}))
+	assert.Equal(
+		t,
+		&QuotaExceededError{Limit: 2, Streams: []string{"boxing1", "tennis2"}, RetryAfter: 50 * time.Second},
+		addStream(store, "alan", "sumo3", session.Device{}),
+	)
+
+	streamIDs, err := store.GetStreams(context.Background(), "alan")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"boxing1", "tennis2"}, streamIDs)
+}
+
+func TestMemoryStoreShouldRejectStreamsBeyondTheDeviceTypesLimit(t *testing.T) {
+	quotas := NewMemoryQuotas(3)
+	quotas.SetDeviceLimits(map[string]int{"tv": 1})
+	store := NewMemoryStore(quotas, time.Minute)
+	tv := session.Device{DeviceType: "tv"}
+
+	assert.NoError(t, addStream(store, "alan", "boxing1", tv))
+	assert.NoError(t, addStream(store, "alan", "boxing1", tv))
+	assert.NoError(t, addStream(store, "alan", "tennis2", session.Device{DeviceType: "mobile"}))
+
+	err := addStream(store, "alan", "sumo3", tv)
+	if assert.IsType(t, &QuotaExceededError{}, err) {
+		qe := err.(*QuotaExceededError)
+		assert.Equal(t, 1, qe.Limit)
+		assert.Equal(t, "tv", qe.DeviceType)
+		assert.Equal(t, []string{"boxing1"}, qe.Streams)
+	}
+}
+
+func TestMemoryStoreShouldEvictStreamsUnderEvictionPolicy(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	quotas := NewMemoryQuotas(2)
+	quotas.SetDeviceLimits(map[string]int{"tv": 1})
+	store := NewMemoryStore(quotas, time.Minute).(*MemoryStore)
+	store.now = clock.Now
+
+	assert.NoError(t, addStream(store, "alan", "boxing1", session.Device{}))
+	clock.Advance(10 * time.Second)
+	assert.NoError(t, addStream(store, "alan", "tennis2", session.Device{}))
+	clock.Advance(10 * time.Second)
+	assert.NoError(t, renewLease(store, "alan", "boxing1"))
+
+	quotas.SetEvictionPolicy(EvictIdlePolicy)
+	change, err := store.AddStream(context.Background(), "alan", "sumo3", session.Device{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"tennis2"}, change.Evicted)
+
+	quotas.SetEvictionPolicy(EvictOldestPolicy)
+	change, err = store.AddStream(context.Background(), "alan", "golf4", session.Device{DeviceType: "tv"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"boxing1"}, change.Evicted)
+
+	change, err = store.AddStream(context.Background(), "alan", "darts5", session.Device{DeviceType: "tv"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"golf4"}, change.Evicted)
+
+	streamIDs, err := store.GetStreams(context.Background(), "alan")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"darts5", "sumo3"}, streamIDs)
+}
+
+func TestMemoryStoreShouldAcceptStreamsAlreadyBeingWatchedWhenAtTheUsersLimit(t *testing.T) {
+	store := NewMemoryStore(NewMemoryQuotas(1), time.Minute)
+
+	assert.NoError(t, addStream(store, "becky", "rugby7", session.Device{}))
+	assert.NoError(t, addStream(store, "becky", "rugby7", session.Device{}))
+}
+
+func TestMemoryStoreShouldFreeSlotWhenStreamIsRemoved(t *testing.T) {
+	store := NewMemoryStore(NewMemoryQuotas(1), time.Minute)
+
+	assert.NoError(t, addStream(store, "charles", "boxing1", session.Device{}))
+	assert.NoError(t, removeStream(store, "charles", "boxing1"))
+	assert.NoError(t, addStream(store, "charles", "golf4", session.Device{}))
+
+	streamIDs, err := store.GetStreams(context.Background(), "charles")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"golf4"}, streamIDs)
+}
+
+func TestMemoryStoreShouldExpireStreamsWhoseLeasesAreNotRenewed(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	store := NewMemoryStore(NewMemoryQuotas(2), time.Minute).(*MemoryStore)
+	store.now = clock.Now
+
+	assert.NoError(t, addStream(store, "diane", "cycling2", session.Device{}))
+	assert.NoError(t, addStream(store, "diane", "karate3", session.Device{}))
+
+	clock.Advance(30 * time.Second)
+	assert.NoError(t, renewLease(store, "diane", "karate3"))
+
+	clock.Advance(45 * time.Second)
+	assert.Equal(t, streamNotFound, renewLease(store, "diane", "cycling2"))
+	assert.NoError(t, addStream(store, "diane", "golf4", session.Device{}))
+
+	streamIDs, err := store.GetStreams(context.Background(), "diane")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"golf4", "karate3"}, streamIDs)
+}
+
+func TestMemoryStoreShouldReportStreamsWhoseLeasesExpired(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	store := NewMemoryStore(NewMemoryQuotas(2), time.Minute).(*MemoryStore)
+	store.now = clock.Now
+
+	assert.NoError(t, addStream(store, "edward", "boxing1", session.Device{}))
+	assert.NoError(t, addStream(store, "edward", "tennis2", session.Device{}))
+	clock.Advance(2 * time.Minute)
+
+	streamIDs, err := store.GetStreams(context.Background(), "edward")
+	assert.NoError(t, err)
+	assert.Empty(t, streamIDs)
+	change, err := store.AddStream(context.Background(), "edward", "sumo3", session.Device{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"boxing1", "tennis2"}, change.Expired)
+
+	clock.Advance(2 * time.Minute)
+	change, err = store.ExpireStreams(context.Background(), "edward")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"sumo3"}, change.Expired)
+	change, err = store.ExpireStreams(context.Background(), "edward")
+	assert.NoError(t, err)
+	assert.Empty(t, change.Expired)
+}
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (fc *fakeClock) Now() time.Time {
+	return fc.now
+}
+
+func (fc *fakeClock) Advance(d time.Duration) {
+	fc.now = fc.now.Add(d)
+}
+
+func TestMemoryStoreShouldListUsersWatchingStreamsPageByPage(t *testing.T) {
+	store := NewMemoryStore(NewMemoryQuotas(1), time.Minute)
+
+	assert.NoError(t, addStream(store, "becky", "rugby7", session.Device{}))
+	assert.NoError(t, addStream(store, "alan", "boxing1", session.Device{}))
+	assert.NoError(t, addStream(store, "charles", "golf4", session.Device{}))
+	assert.NoError(t, removeAllStreams(store, "charles"))
+
+	userIDs, cursor, err := store.ListUsers(context.Background(), 0, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"alan"}, userIDs)
+
+	userIDs, cursor, err = store.ListUsers(context.Background(), cursor, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"becky"}, userIDs)
+	assert.Equal(t, uint64(0), cursor)
+}
+
+func TestMemoryStoreShouldApplyOverriddenLimitUntilItExpires(t *testing.T) {
+	quotas := NewMemoryQuotas(1)
+	store := NewMemoryStore(quotas, time.Minute)
+
+	assert.NoError(t, store.SetLimit(context.Background(), "diane", 2, time.Hour))
+	assert.NoError(t, addStream(store, "diane", "cycling2", session.Device{}))
+	assert.NoError(t, addStream(store, "diane", "karate3", session.Device{}))
+
+	assert.NoError(t, quotas.Override(context.Background(), "diane", 2, time.Nanosecond))
+	time.Sleep(time.Millisecond)
+	limit, err := store.GetLimit(context.Background(), "diane")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, limit)
+}
+
+func TestMemoryStoreShouldApplyBatchOfOperations(t *testing.T) {
+	store := NewMemoryStore(NewMemoryQuotas(1), time.Minute)
+	assert.NoError(t, addStream(store, "alan", "boxing1", session.Device{}))
+
+	results, err := store.Apply(context.Background(), []session.Operation{
+		{Op: session.StartOperation, UserID: "alan", StreamID: "darts2"},
+		{Op: session.StopOperation, UserID: "alan", StreamID: "boxing1"},
+		{Op: session.StartOperation, UserID: "alan", StreamID: "darts2"},
+	})
+
+	assert.NoError(t, err)
+	assert.IsType(t, &QuotaExceededError{}, results[0].Err)
+	assert.NoError(t, results[1].Err)
+	assert.NoError(t, results[2].Err)
+	streams, _ := store.GetStreams(context.Background(), "alan")
+	assert.Equal(t, []string{"darts2"}, streams)
+}
+
+func addStream(store Store, userID, streamID string, device session.Device) error {
+	_, err := store.AddStream(context.Background(), userID, streamID, device)
+	return err
+}
+
+func removeStream(store Store, userID, streamID string) error {
+	_, err := store.RemoveStream(context.Background(), userID, streamID)
+	return err
+}
+
+func removeAllStreams(store Store, userID string) error {
+	_, err := store.RemoveAllStreams(context.Background(), userID)
+	return err
+}
+
+func renewLease(store Store, userID, streamID string) error {
+	_, err := store.RenewStream(context.Background(), userID, streamID)
+	return err
+}
@@ -0,0 +1,240 @@
+package internal
+
+import (
+	"context"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/prgodlonton/stream-controller/internal/session"
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	metricsNamespace = "stream_controller"
+
+	// route label given to requests that do not match any route
+	unmatchedRoute = "unmatched"
+)
+
+// Metrics holds the prometheus collectors instrumenting the service
+type Metrics struct {
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	storeDuration   *prometheus.HistogramVec
+	storeErrors     *prometheus.CounterVec
+	quotaRejections prometheus.Counter
+	quotaEvictions  prometheus.Counter
+}
+
+// NewMetrics creates the collectors and registers them with the registerer
+func NewMetrics(registerer prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		requests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: metricsNamespace,
+				Subsystem: "http",
+				Name:      "requests_total",
+				Help:      "Number of HTTP requests by route, method and status.",
+			},
+			[]string{"route", "method", "status"},
+		),
+		requestDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: metricsNamespace,
+				Subsystem: "http",
+				Name:      "request_duration_seconds",
+				Help:      "Duration of HTTP requests by route, method and status.",
+				Buckets:   prometheus.DefBuckets,
+			},
+			[]string{"route", "method", "status"},
+		),
+		storeDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: metricsNamespace,
+				Subsystem: "store",
+				Name:      "operation_duration_seconds",
+				Help:      "Duration of store operations by operation.",
+				Buckets:   prometheus.DefBuckets,
+			},
+			[]string{"operation"},
+		),
+		storeErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: metricsNamespace,
+				Subsystem: "store",
+				Name:      "errors_total",
+				Help:      "Number of store operations that failed by operation.",
+			},
+			[]string{"operation"},
+		),
+		quotaRejections: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: metricsNamespace,
+				Subsystem: "quota",
+				Name:      "rejections_total",
+				Help:      "Number of streams rejected because the user exceeded their streaming quota.",
+			},
+		),
+		quotaEvictions: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: metricsNamespace,
+				Subsystem: "quota",
+				Name:      "evictions_total",
+				Help:      "Number of streams evicted to make room for streams started beyond the user's streaming quota.",
+			},
+		),
+	}
+	registerer.MustRegister(
+		m.requests,
+		m.requestDuration,
+		m.storeDuration,
+		m.storeErrors,
+		m.quotaRejections,
+		m.quotaEvictions,
+	)
+	return m
+}
+
+// Middleware records the count and duration of requests by chi route pattern, method and status
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := unmatchedRoute
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		labels := prometheus.Labels{
+			"route":  route,
+			"method": r.Method,
+			"status": strconv.Itoa(status),
+		}
+		m.requests.With(labels).Inc()
+		m.requestDuration.With(labels).Observe(time.Since(start).Seconds())
+	})
+}
+
+// InstrumentedStore a store decorator recording the duration and errors of the operations of another store
+type InstrumentedStore struct {
+	store   Store
+	metrics *Metrics
+}
+
+// NewInstrumentedStore creates a new store recording the operations of the given store
+func NewInstrumentedStore(store Store, metrics *Metrics) Store {
+	return &InstrumentedStore{
+		store:   store,
+		metrics: metrics,
+	}
+}
+
+// AddStream records a user as watching a stream on the device and returns the streams evicted to make room for it
+func (is *InstrumentedStore) AddStream(ctx context.Context, userID, streamID string, device session.Device) (session.Change, error) {
+	defer is.observe("add_stream", time.Now())
+	change, err := is.store.AddStream(ctx, userID, streamID, device)
+	if _, ok := err.(*QuotaExceededError); ok {
+		is.metrics.quotaRejections.Inc()
+		return change, err
+	}
+	is.metrics.quotaEvictions.Add(float64(len(change.Evicted)))
+	return change, is.countError("add_stream", err)
+}
+
+// Apply applies the batch of operations, counting the streams rejected and evicted and the operations that failed
+func (is *InstrumentedStore) Apply(ctx context.Context, operations []session.Operation) ([]session.Result, error) {
+	defer is.observe("apply", time.Now())
+	results, err := is.store.Apply(ctx, operations)
+	for _, result := range results {
+		if _, ok := result.Err.(*QuotaExceededError); ok {
+			is.metrics.quotaRejections.Inc()
+			continue
+		}
+		is.metrics.quotaEvictions.Add(float64(len(result.Evicted)))
+		is.countError("apply", result.Err)
+	}
+	return results, is.countError("apply", err)
+}
+
+// ExpireStreams removes the user's streams whose leases have expired and returns them
+func (is *InstrumentedStore) ExpireStreams(ctx context.Context, userID string) (session.Change, error) {
+	defer is.observe("expire_streams", time.Now())
+	change, err := is.store.ExpireStreams(ctx, userID)
+	return change, is.countError("expire_streams", err)
+}
+
+// GetLimit returns the number of streams the user may watch concurrently
+func (is *InstrumentedStore) GetLimit(ctx context.Context, userID string) (int, error) {
+	defer is.observe("get_limit", time.Now())
+	limit, err := is.store.GetLimit(ctx, userID)
+	return limit, is.countError("get_limit", err)
+}
+
+// GetSessions returns the streams being watched by a single user with their devices
+func (is *InstrumentedStore) GetSessions(ctx context.Context, userID string) ([]session.Session, error) {
+	defer is.observe("get_sessions", time.Now())
+	sessions, err := is.store.GetSessions(ctx, userID)
+	return sessions, is.countError("get_sessions", err)
+}
+
+// GetStreams returns all streams being watched by a single user
+func (is *InstrumentedStore) GetStreams(ctx context.Context, userID string) ([]string, error) {
+	defer is.observe("get_streams", time.Now())
+	streamIDs, err := is.store.GetStreams(ctx, userID)
+	return streamIDs, is.countError("get_streams", err)
+}
+
+// ListUsers returns a page of the users watching streams and the cursor of the next page
+func (is *InstrumentedStore) ListUsers(ctx context.Context, cursor uint64, count int64) ([]string, uint64, error) {
+	defer is.observe("list_users", time.Now())
+	userIDs, next, err := is.store.ListUsers(ctx, cursor, count)
+	return userIDs, next, is.countError("list_users", err)
+}
+
+// RemoveAllStreams removes the records of all streams being watched by a user
+func (is *InstrumentedStore) RemoveAllStreams(ctx context.Context, userID string) (session.Change, error) {
+	defer is.observe("remove_all_streams", time.Now())
+	change, err := is.store.RemoveAllStreams(ctx, userID)
+	return change, is.countError("remove_all_streams", err)
+}
+
+// RemoveStream removes the record of a user watching a stream
+func (is *InstrumentedStore) RemoveStream(ctx context.Context, userID, streamID string) (session.Change, error) {
+	defer is.observe("remove_stream", time.Now())
+	change, err := is.store.RemoveStream(ctx, userID, streamID)
+	return change, is.countError("remove_stream", err)
+}
+
+// RenewStream extends the lease of a stream the user is watching
+func (is *InstrumentedStore) RenewStream(ctx context.Context, userID, streamID string) (session.Change, error) {
+	defer is.observe("renew_stream", time.Now())
+	change, err := is.store.RenewStream(ctx, userID, streamID)
+	if err == streamNotFound {
+		return change, err
+	}
+	return change, is.countError("renew_stream", err)
+}
+
+// SetLimit overrides the number of streams the user may watch concurrently
+func (is *InstrumentedStore) SetLimit(ctx context.Context, userID string, limit int, duration time.Duration) error {
+	defer is.observe("set_limit", time.Now())
+	return is.countError("set_limit", is.store.SetLimit(ctx, userID, limit, duration))
+}
+
+func (is *InstrumentedStore) observe(operation string, start time.Time) {
+	is.metrics.storeDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+func (is *InstrumentedStore) countError(operation string, err error) error {
+	if err != nil {
+		is.metrics.storeErrors.WithLabelValues(operation).Inc()
+	}
+	return err
+}
@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"github.com/golang/mock/gomock"
+	"github.com/prgodlonton/stream-controller/internal/session"
+	"github.com/prgodlonton/stream-controller/testing/mocks"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestInstrumentedStoreShouldCountQuotaRejectionsAndEvictionsSeparatelyFromErrors(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+	store.EXPECT().AddStream(gomock.Any(), "olivia", "judo1", gomock.Any()).Return(session.Change{}, &QuotaExceededError{Limit: 3})
+	store.EXPECT().AddStream(gomock.Any(), "olivia", "judo2", gomock.Any()).Return(session.Change{}, errors.New("intentional error"))
+	store.EXPECT().AddStream(gomock.Any(), "olivia", "judo3", gomock.Any()).Return(session.Change{Evicted: []string{"judo0"}}, nil)
+
+	metrics := NewMetrics(prometheus.NewRegistry())
+	instrumented := NewInstrumentedStore(store, metrics)
+
+	_, err := instrumented.AddStream(context.Background(), "olivia", "judo1", session.Device{})
+	assert.Error(t, err)
+	_, err = instrumented.AddStream(context.Background(), "olivia", "judo2", session.Device{})
+	assert.Error(t, err)
+	change, err := instrumented.AddStream(context.Background(), "olivia", "judo3", session.Device{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"judo0"}, change.Evicted)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.quotaRejections))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.quotaEvictions))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.storeErrors.WithLabelValues("add_stream")))
+}
+
+func TestMetricsMiddlewareShouldCountRequestsByRoutePattern(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+	store.EXPECT().RemoveStream(gomock.Any(), "peter", "rowing3").Return(session.Change{}, nil)
+	store.EXPECT().RemoveStream(gomock.Any(), "quentin", "rowing4").Return(session.Change{}, nil)
+
+	metrics := NewMetrics(prometheus.NewRegistry())
+	router := NewRouter(noopLogger, store, WithMetrics(metrics))
+	router.ServeHTTP(httptest.NewRecorder(), createHTTPRequest("DELETE", "v1/users/peter/streams/rowing3"))
+	router.ServeHTTP(httptest.NewRecorder(), createHTTPRequest("DELETE", "v1/users/quentin/streams/rowing4"))
+	router.ServeHTTP(httptest.NewRecorder(), createHTTPRequest("GET", "v2/unknown"))
+
+	deleted := metrics.requests.WithLabelValues("/v1/users/{userID}/streams/{streamID}/", "DELETE", "200")
+	assert.Equal(t, 2.0, testutil.ToFloat64(deleted))
+	unmatched := metrics.requests.WithLabelValues(unmatchedRoute, "GET", strconv.Itoa(http.StatusNotFound))
+	assert.Equal(t, 1.0, testutil.ToFloat64(unmatched))
+}
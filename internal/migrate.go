@@ -0,0 +1,163 @@
+package internal
+
+import (
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"time"
+)
+
+const (
+	// key of the hash holding per-user limit overrides before keys were namespaced
+	legacyQuotasKey = "quotas"
+
+	// number of keys requested from each SCAN of the keyspace during migration
+	migrationScanCount = 100
+
+	// *atomic* lua script to merge the streams in the legacy set or sorted set KEYS[1] into the namespaced sorted set
+	// KEYS[2], keeping the later expiry of streams held in both, and then delete the legacy key; streams in a plain set
+	// are leased until ARGV[2] and expired leases, before ARGV[1], are dropped. The legacy key is only deleted once
+	// copied, so nothing is changed and 0 is returned if it is neither kind of set. Both keys hash to the same cluster
+	// slot as the namespaced key's hash tag is the legacy key
+	migrateLeases = `
+local keyType = redis.call("TYPE",KEYS[1])
+keyType = keyType.ok or keyType
+if keyType == "set" then
+	for _, streamID in ipairs(redis.call("SMEMBERS",KEYS[1])) do
+		local expiry = redis.call("ZSCORE",KEYS[2],streamID)
+		if not expiry or tonumber(expiry) < tonumber(ARGV[2]) then
+			redis.call("ZADD",KEYS[2],ARGV[2],streamID)
+		end
+	end
+elseif keyType == "zset" then
+	redis.call("ZUNIONSTORE",KEYS[2],2,KEYS[2],KEYS[1],"AGGREGATE","MAX")
+else
+	return 0
+end
+redis.call("DEL",KEYS[1])
+redis.call("ZREMRANGEBYSCORE",KEYS[2],"-inf",ARGV[1])
+if redis.call("ZCARD",KEYS[2]) > 0 then
+	redis.call("PEXPIREAT",KEYS[2],string.format("%.0f",tonumber(redis.call("ZRANGE",KEYS[2],-1,-1,"WITHSCORES")[2])+600000))
+end
+return 1`
+
+	// *atomic* lua script to copy the overrides in the legacy hash to the namespaced hash, keeping any overrides
+	// already set in the namespaced hash, and then delete the legacy hash; nothing is changed and 0 is returned if
+	// the legacy key is not a hash
+	migrateQuotas = `
+local keyType = redis.call("TYPE",KEYS[1])
+if (keyType.ok or keyType) ~= "hash" then
+	return 0
+end
+local overrides = redis.call("HGETALL",KEYS[1])
+for i = 1, #overrides, 2 do
+	redis.call("HSETNX",KEYS[2],overrides[i],overrides[i+1])
+end
+redis.call("DEL",KEYS[1])
+return 1`
+)
+
+// MigrationOptions select the legacy keys to migrate; earlier versions held each user's streams under the bare user
+// ID so only keys matching the SCAN pattern whose names are valid user IDs are migrated, along with the quotas hash.
+// Nothing is changed in a dry run
+type MigrationOptions struct {
+	Match         string
+	IDs           *IDValidator
+	LeaseDuration time.Duration
+	DryRun        bool
+}
+
+// MigrateKeys moves the sets and sorted sets of streams and the quotas hash held under unprefixed keys by earlier
+// versions into the key space, merging them with any data already held there so that in-flight sessions are kept; it
+// may be run repeatedly and returns the number of keys migrated, or that would be migrated in a dry run
+func MigrateKeys(logger *zap.SugaredLogger, client redis.UniversalClient, keys KeySpace, options MigrationOptions) (int, error) {
+	if options.Match == "" {
+		return 0, errors.New("a pattern matching the legacy keys is required")
+	}
+	if options.IDs == nil {
+		options.IDs = defaultIDValidator()
+	}
+	migrated := 0
+	ok, err := migrateKey(logger, client, keys, legacyQuotasKey, options)
+	if err != nil {
+		return migrated, errors.Wrapf(err, "failed to migrate key %q", legacyQuotasKey)
+	}
+	if ok {
+		migrated++
+	}
+
+	var cursor uint64
+	for {
+		cmd := client.Scan(cursor, options.Match, migrationScanCount)
+		page, next, err := cmd.Result()
+		if err != nil {
+			return migrated, errors.Wrap(err, "failed to scan keys")
+		}
+		for _, key := range page {
+			if key == legacyQuotasKey || keys.Owns(key) || options.IDs.ValidateUserID("key", key) != nil {
+				continue
+			}
+			ok, err := migrateKey(logger, client, keys, key, options)
+			if err != nil {
+				return migrated, errors.Wrapf(err, "failed to migrate key %q", key)
+			}
+			if ok {
+				migrated++
+			}
+		}
+		if next == 0 {
+			return migrated, nil
+		}
+		cursor = next
+	}
+}
+
+// migrateKey migrates the legacy key into the key space and returns true, or returns false if the key is not of the
+// type written by earlier versions or is already the key space's own key; in a dry run the key is only checked
+func migrateKey(logger *zap.SugaredLogger, client redis.UniversalClient, keys KeySpace, key string, options MigrationOptions) (bool, error) {
+	if key == keys.Quotas() {
+		// merging the quotas hash into itself would delete it
+		return false, nil
+	}
+	keyType, err := client.Type(key).Result()
+	if err != nil {
+		return false, err
+	}
+	isQuotas := key == legacyQuotasKey
+	if (isQuotas && keyType != "hash") || (!isQuotas && keyType != "set" && keyType != "zset") {
+		return false, nil
+	}
+	if options.DryRun {
+		logger.Infow(
+			"would migrate key",
+			"key", key,
+			"type", keyType,
+		)
+		return true, nil
+	}
+
+	var cmd *redis.Cmd
+	if isQuotas {
+		cmd = client.Eval(migrateQuotas, []string{key, keys.Quotas()})
+	} else {
+		now := time.Now()
+		cmd = client.Eval(
+			migrateLeases,
+			[]string{key, keys.Streams(key)},
+			toMillis(now),
+			toMillis(now.Add(options.LeaseDuration)),
+		)
+	}
+	copied, err := cmd.Int64()
+	if err != nil {
+		return false, err
+	}
+	if copied == 1 {
+		logger.Debugw(
+			"migrated key",
+			"key", key,
+			"type", keyType,
+		)
+	}
+	return copied == 1, nil
+}
@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"github.com/alicebob/miniredis"
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestShouldMigrateLegacyKeysIntoKeySpace(t *testing.T) {
+	client, server := newMigrationServer(t)
+	server.SetAdd("alan", "boxing1", "tennis2")
+	server.ZAdd("becky", float64(toMillis(time.Now().Add(time.Minute))), "rugby7")
+	server.ZAdd("sc:user:{becky}:streams", float64(toMillis(time.Now().Add(time.Hour))), "golf4")
+	server.HSet("quotas", "alan", "5")
+	server.HSet("sc:quotas", "becky", "2")
+
+	migrated, err := MigrateKeys(noopLogger, client, NewKeySpace("sc"), MigrationOptions{Match: "*", LeaseDuration: time.Minute})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, migrated)
+
+	for _, key := range []string{"alan", "becky", "quotas"} {
+		assert.False(t, server.Exists(key), key)
+	}
+	streams, err := server.SortedSet("sc:user:{alan}:streams")
+	assert.NoError(t, err)
+	assert.Len(t, streams, 2)
+	streams, err = server.SortedSet("sc:user:{becky}:streams")
+	assert.NoError(t, err)
+	assert.Len(t, streams, 2)
+	assert.Equal(t, "5", server.HGet("sc:quotas", "alan"))
+	assert.Equal(t, "2", server.HGet("sc:quotas", "becky"))
+}
+
+func TestShouldOnlyMigrateMatchingKeysOfTypesWrittenByEarlierVersions(t *testing.T) {
+	client, server := newMigrationServer(t)
+	server.SetAdd("alan", "boxing1")
+	server.SetAdd("session:alan", "boxing1")
+	server.SetAdd("other:{charles}", "golf4")
+	server.Set("becky", "not-a-set")
+	server.HSet("charles", "boxing1", "1")
+	server.SetAdd("quotas", "alan")
+
+	keys := NewKeySpace("sc")
+	migrated, err := MigrateKeys(noopLogger, client, keys, MigrationOptions{Match: "[a-c]*", LeaseDuration: time.Minute})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, migrated)
+
+	for _, key := range []string{"session:alan", "other:{charles}", "becky", "charles", "quotas"} {
+		assert.True(t, server.Exists(key), key)
+	}
+	assert.False(t, server.Exists("alan"))
+
+	_, err = MigrateKeys(noopLogger, client, keys, MigrationOptions{LeaseDuration: time.Minute})
+	assert.Error(t, err)
+}
+
+func TestShouldNotChangeKeysInDryRun(t *testing.T) {
+	client, server := newMigrationServer(t)
+	server.SetAdd("alan", "boxing1")
+	server.HSet("quotas", "alan", "5")
+
+	migrated, err := MigrateKeys(noopLogger, client, NewKeySpace("sc"), MigrationOptions{Match: "*", DryRun: true})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, migrated)
+	assert.Equal(t, "set", server.Type("alan"))
+	assert.Equal(t, "hash", server.Type("quotas"))
+	assert.False(t, server.Exists("sc:user:{alan}:streams"))
+	assert.False(t, server.Exists("sc:quotas"))
+}
+
+func TestShouldKeepQuotasWhenKeySpaceHasNoPrefix(t *testing.T) {
+	client, server := newMigrationServer(t)
+	server.SetAdd("alan", "boxing1")
+	server.HSet("quotas", "alan", "5")
+
+	migrated, err := MigrateKeys(noopLogger, client, NewKeySpace(""), MigrationOptions{Match: "*", LeaseDuration: time.Minute})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, migrated)
+	assert.Equal(t, "5", server.HGet("quotas", "alan"))
+	assert.False(t, server.Exists("alan"))
+}
+
+func newMigrationServer(t *testing.T) (redis.UniversalClient, *miniredis.Miniredis) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return client, server
+}
@@ -0,0 +1,110 @@
+package internal
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Option configures the router and the gRPC server
+type Option func(*options)
+
+type options struct {
+	authenticator       *Authenticator
+	health              *Health
+	idempotency         IdempotencyStore
+	ids                 *IDValidator
+	metrics             *Metrics
+	notifier            Notifier
+	quotaExceededStatus int
+	storeTimeout        *StoreTimeout
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		ids:                 defaultIDValidator(),
+		quotaExceededStatus: http.StatusConflict,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithQuotaExceededStatus sets the status returned when a user has exceeded their streaming quota
+func WithQuotaExceededStatus(status int) Option {
+	return func(o *options) {
+		o.quotaExceededStatus = status
+	}
+}
+
+// WithAuthenticator requires callers to present bearer tokens permitting them to act on the user
+func WithAuthenticator(authenticator *Authenticator) Option {
+	return func(o *options) {
+		o.authenticator = authenticator
+	}
+}
+
+// WithHealth mounts the liveness and readiness endpoints reporting the health of the service
+func WithHealth(health *Health) Option {
+	return func(o *options) {
+		o.health = health
+	}
+}
+
+// WithIDValidator rejects user and stream IDs that are invalid under the validator's rules rather than the default
+// rules
+func WithIDValidator(ids *IDValidator) Option {
+	return func(o *options) {
+		o.ids = ids
+	}
+}
+
+// WithIdempotency replays the recorded responses to PUT and DELETE requests retried with the same Idempotency-Key
+func WithIdempotency(store IdempotencyStore) Option {
+	return func(o *options) {
+		o.idempotency = store
+	}
+}
+
+// WithMetrics records the count and duration of the router's requests
+func WithMetrics(metrics *Metrics) Option {
+	return func(o *options) {
+		o.metrics = metrics
+	}
+}
+
+// WithNotifier notifies players of changes to their sessions and serves the events endpoint streaming them
+func WithNotifier(notifier Notifier) Option {
+	return func(o *options) {
+		o.notifier = notifier
+	}
+}
+
+// WithStoreTimeout sets the deadline of each request's store operations; requests have no deadline by default
+func WithStoreTimeout(timeout *StoreTimeout) Option {
+	return func(o *options) {
+		o.storeTimeout = timeout
+	}
+}
+
+// StoreTimeout the deadline of each request's store operations, which may be changed whilst the service is running;
+// requests have no deadline whilst it is zero
+type StoreTimeout struct {
+	timeout int64
+}
+
+// NewStoreTimeout creates a new deadline of the given duration
+func NewStoreTimeout(timeout time.Duration) *StoreTimeout {
+	return &StoreTimeout{timeout: int64(timeout)}
+}
+
+// Duration returns the current deadline
+func (st *StoreTimeout) Duration() time.Duration {
+	return time.Duration(atomic.LoadInt64(&st.timeout))
+}
+
+// Set changes the deadline of the requests received from now on
+func (st *StoreTimeout) Set(timeout time.Duration) {
+	atomic.StoreInt64(&st.timeout, int64(timeout))
+}
@@ -0,0 +1,328 @@
+package internal
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/prgodlonton/stream-controller/internal/session"
+	"go.uber.org/zap"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// SessionStartedEvent records a user starting to watch a stream
+	SessionStartedEvent = "session_started"
+
+	// SessionStoppedEvent records a user no longer watching a stream
+	SessionStoppedEvent = "session_stopped"
+
+	// SessionRejectedEvent records a stream being rejected because the user exceeded their streaming quota
+	SessionRejectedEvent = "session_rejected"
+
+	// reasons given for streams being stopped
+	removedReason = "removed"
+	evictedReason = "evicted"
+	expiredReason = "expired"
+
+	// time allowed for each attempt to deliver an event to the sink
+	publishTimeout = 5 * time.Second
+
+	// delay before the first retry of an event that could not be delivered, which doubles with each retry
+	publishBackoff = 100 * time.Millisecond
+)
+
+// DomainEvent records a change to the streams being watched by a user for other services; the stream is omitted
+// when all of the user's streams were stopped, and the limit and device type are those of the limit that was
+// reached when a stream is rejected
+type DomainEvent struct {
+	Type       string          `json:"type"`
+	UserID     string          `json:"userID"`
+	StreamID   string          `json:"streamID,omitempty"`
+	Device     *session.Device `json:"device,omitempty"`
+	Reason     string          `json:"reason,omitempty"`
+	Limit      *int            `json:"limit,omitempty"`
+	DeviceType string          `json:"deviceType,omitempty"`
+	Time       time.Time       `json:"time"`
+}
+
+// EventPublisher publishes domain events without blocking the caller
+type EventPublisher interface {
+	Publish(event DomainEvent)
+}
+
+// EventSink delivers domain events to another service
+type EventSink interface {
+	Send(ctx context.Context, event DomainEvent) error
+}
+
+// AsyncPublisher queues domain events and delivers them to a sink in the background, retrying those that cannot be
+// delivered; events are dropped when the queue is full so that publishing never blocks
+type AsyncPublisher struct {
+	logger  *zap.SugaredLogger
+	sink    EventSink
+	retries int
+	backoff time.Duration
+
+	mu     sync.RWMutex
+	closed bool
+	queue  chan DomainEvent
+	done   chan struct{}
+}
+
+// NewAsyncPublisher creates a new publisher queueing up to the queue size events for delivery to the sink, each of
+// which is retried up to the given number of times
+func NewAsyncPublisher(logger *zap.SugaredLogger, sink EventSink, queueSize, retries int) *AsyncPublisher {
+	ap := &AsyncPublisher{
+		logger:  logger,
+		sink:    sink,
+		retries: retries,
+		backoff: publishBackoff,
+		queue:   make(chan DomainEvent, queueSize),
+		done:    make(chan struct{}),
+	}
+	go ap.run()
+	return ap
+}
+
+// Publish queues the event for delivery, dropping it if the queue is full or the publisher is closed
+func (ap *AsyncPublisher) Publish(event DomainEvent) {
+	ap.mu.RLock()
+	defer ap.mu.RUnlock()
+
+	if !ap.closed {
+		select {
+		case ap.queue <- event:
+			return
+		default:
+		}
+	}
+	ap.logger.Warnw(
+		"dropped domain event",
+		"type", event.Type,
+		"userID", event.UserID,
+		"streamID", event.StreamID,
+	)
+}
+
+// Close stops accepting events and waits until those already queued are delivered or the context is done; the sink
+// is then closed if it holds resources such as an open file
+func (ap *AsyncPublisher) Close(ctx context.Context) error {
+	ap.mu.Lock()
+	if !ap.closed {
+		ap.closed = true
+		close(ap.queue)
+	}
+	ap.mu.Unlock()
+
+	select {
+	case <-ap.done:
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "queued domain events were not delivered")
+	}
+	if closer, ok := ap.sink.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			return errors.Wrap(err, "cannot close domain event sink")
+		}
+	}
+	return nil
+}
+
+// run delivers the queued events in turn until the queue is closed and drained
+func (ap *AsyncPublisher) run() {
+	defer close(ap.done)
+	for event := range ap.queue {
+		ap.deliver(event)
+	}
+}
+
+// deliver sends the event to the sink, retrying with exponential backoff until it is delivered or the retries are
+// exhausted
+func (ap *AsyncPublisher) deliver(event DomainEvent) {
+	backoff := ap.backoff
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+		err := ap.sink.Send(ctx, event)
+		cancel()
+		if err == nil {
+			return
+		}
+		if attempt >= ap.retries {
+			ap.logger.Errorw(
+				"cannot deliver domain event",
+				"type", event.Type,
+				"userID", event.UserID,
+				"streamID", event.StreamID,
+				"attempts", attempt+1,
+				"error", err,
+			)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// PublishingStore a store decorator publishing the streams started, stopped, expired and rejected by another store;
+// streams are only published as started or stopped when the store reports that they were not already held or were
+// held respectively
+type PublishingStore struct {
+	store     Store
+	publisher EventPublisher
+}
+
+// NewPublishingStore creates a new store publishing the changes made through the given store
+func NewPublishingStore(store Store, publisher EventPublisher) Store {
+	return &PublishingStore{
+		store:     store,
+		publisher: publisher,
+	}
+}
+
+// AddStream records a user as watching a stream on the device and publishes the stream being started along with any
+// streams evicted to make room for it, or its rejection
+func (ps *PublishingStore) AddStream(ctx context.Context, userID, streamID string, device session.Device) (session.Change, error) {
+	change, err := ps.store.AddStream(ctx, userID, streamID, device)
+	ps.publishAdded(userID, streamID, device, change, err, time.Now().UTC())
+	return change, err
+}
+
+// Apply applies the batch of operations and publishes the streams started, stopped and rejected by them
+func (ps *PublishingStore) Apply(ctx context.Context, operations []session.Operation) ([]session.Result, error) {
+	results, err := ps.store.Apply(ctx, operations)
+	now := time.Now().UTC()
+	for i, result := range results {
+		op := operations[i]
+		switch op.Op {
+		case session.StartOperation:
+			ps.publishAdded(op.UserID, op.StreamID, op.Device, result.Change, result.Err, now)
+		case session.StopOperation:
+			ps.publishRemoved(op.UserID, op.StreamID, result.Change, now)
+		}
+	}
+	return results, err
+}
+
+// publishAdded publishes the streams that expired, then the stream being started, if it was not already held, along
+// with any streams evicted to make room for it, or its rejection; nothing else is published if the stream could not
+// be added for any other reason
+func (ps *PublishingStore) publishAdded(userID, streamID string, device session.Device, change session.Change, err error, now time.Time) {
+	ps.publishExpired(userID, change.Expired, now)
+	if qe, ok := err.(*QuotaExceededError); ok {
+		limit := qe.Limit
+		ps.publisher.Publish(DomainEvent{
+			Type:       SessionRejectedEvent,
+			UserID:     userID,
+			StreamID:   streamID,
+			Device:     &device,
+			Limit:      &limit,
+			DeviceType: qe.DeviceType,
+			Time:       now,
+		})
+		return
+	}
+	if err != nil {
+		return
+	}
+	for _, evictedID := range change.Evicted {
+		ps.publisher.Publish(DomainEvent{
+			Type:     SessionStoppedEvent,
+			UserID:   userID,
+			StreamID: evictedID,
+			Reason:   evictedReason,
+			Time:     now,
+		})
+	}
+	if change.Changed {
+		ps.publisher.Publish(DomainEvent{
+			Type:     SessionStartedEvent,
+			UserID:   userID,
+			StreamID: streamID,
+			Device:   &device,
+			Time:     now,
+		})
+	}
+}
+
+// publishRemoved publishes the streams that expired, then the stream being stopped, or all of the user's streams if
+// the stream is empty, if any were held
+func (ps *PublishingStore) publishRemoved(userID, streamID string, change session.Change, now time.Time) {
+	ps.publishExpired(userID, change.Expired, now)
+	if !change.Changed {
+		return
+	}
+	ps.publisher.Publish(DomainEvent{
+		Type:     SessionStoppedEvent,
+		UserID:   userID,
+		StreamID: streamID,
+		Reason:   removedReason,
+		Time:     now,
+	})
+}
+
+// publishExpired publishes each of the user's streams whose leases expired as stopped
+func (ps *PublishingStore) publishExpired(userID string, expired []string, now time.Time) {
+	for _, streamID := range expired {
+		ps.publisher.Publish(DomainEvent{
+			Type:     SessionStoppedEvent,
+			UserID:   userID,
+			StreamID: streamID,
+			Reason:   expiredReason,
+			Time:     now,
+		})
+	}
+}
+
+// ExpireStreams removes the user's streams whose leases have expired and publishes them being stopped
+func (ps *PublishingStore) ExpireStreams(ctx context.Context, userID string) (session.Change, error) {
+	change, err := ps.store.ExpireStreams(ctx, userID)
+	ps.publishExpired(userID, change.Expired, time.Now().UTC())
+	return change, err
+}
+
+// GetLimit returns the number of streams the user may watch concurrently
+func (ps *PublishingStore) GetLimit(ctx context.Context, userID string) (int, error) {
+	return ps.store.GetLimit(ctx, userID)
+}
+
+// GetSessions returns the streams being watched by a single user with their devices
+func (ps *PublishingStore) GetSessions(ctx context.Context, userID string) ([]session.Session, error) {
+	return ps.store.GetSessions(ctx, userID)
+}
+
+// GetStreams returns all streams being watched by a single user
+func (ps *PublishingStore) GetStreams(ctx context.Context, userID string) ([]string, error) {
+	return ps.store.GetStreams(ctx, userID)
+}
+
+// ListUsers returns a page of the users watching streams and the cursor of the next page
+func (ps *PublishingStore) ListUsers(ctx context.Context, cursor uint64, count int64) ([]string, uint64, error) {
+	return ps.store.ListUsers(ctx, cursor, count)
+}
+
+// RemoveAllStreams removes the records of all streams being watched by a user and publishes them being stopped
+func (ps *PublishingStore) RemoveAllStreams(ctx context.Context, userID string) (session.Change, error) {
+	change, err := ps.store.RemoveAllStreams(ctx, userID)
+	ps.publishRemoved(userID, "", change, time.Now().UTC())
+	return change, err
+}
+
+// RemoveStream removes the record of a user watching a stream and publishes it being stopped
+func (ps *PublishingStore) RemoveStream(ctx context.Context, userID, streamID string) (session.Change, error) {
+	change, err := ps.store.RemoveStream(ctx, userID, streamID)
+	ps.publishRemoved(userID, streamID, change, time.Now().UTC())
+	return change, err
+}
+
+// RenewStream extends the lease of a stream the user is watching and publishes the streams that expired
+func (ps *PublishingStore) RenewStream(ctx context.Context, userID, streamID string) (session.Change, error) {
+	change, err := ps.store.RenewStream(ctx, userID, streamID)
+	ps.publishExpired(userID, change.Expired, time.Now().UTC())
+	return change, err
+}
+
+// SetLimit overrides the number of streams the user may watch concurrently for the duration, or indefinitely if the
+// duration is zero
+func (ps *PublishingStore) SetLimit(ctx context.Context, userID string, limit int, duration time.Duration) error {
+	return ps.store.SetLimit(ctx, userID, limit, duration)
+}
@@ -0,0 +1,211 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/prgodlonton/stream-controller/internal/session"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPublishingStoreShouldPublishStreamsStartedStoppedAndRejected(t *testing.T) {
+	quotas := NewMemoryQuotas(1)
+	publisher := &recordingPublisher{}
+	store := NewPublishingStore(NewMemoryStore(quotas, time.Minute), publisher)
+	tv := session.Device{DeviceType: "tv"}
+	limit := 1
+
+	_, err := store.AddStream(context.Background(), "alan", "boxing1", tv)
+	assert.NoError(t, err)
+	_, err = store.AddStream(context.Background(), "alan", "tennis2", tv)
+	assert.Error(t, err)
+	quotas.SetEvictionPolicy(EvictOldestPolicy)
+	_, err = store.AddStream(context.Background(), "alan", "tennis2", tv)
+	assert.NoError(t, err)
+	assert.NoError(t, removeStream(store, "alan", "tennis2"))
+
+	assert.Equal(t, []DomainEvent{
+		{Type: SessionStartedEvent, UserID: "alan", StreamID: "boxing1", Device: &tv},
+		{Type: SessionRejectedEvent, UserID: "alan", StreamID: "tennis2", Device: &tv, Limit: &limit},
+		{Type: SessionStoppedEvent, UserID: "alan", StreamID: "boxing1", Reason: evictedReason},
+		{Type: SessionStartedEvent, UserID: "alan", StreamID: "tennis2", Device: &tv},
+		{Type: SessionStoppedEvent, UserID: "alan", StreamID: "tennis2", Reason: removedReason},
+	}, publisher.withoutTimes())
+}
+
+func TestPublishingStoreShouldPublishStreamsStartedStoppedAndRejectedByBatch(t *testing.T) {
+	publisher := &recordingPublisher{}
+	store := NewPublishingStore(NewMemoryStore(NewMemoryQuotas(1), time.Minute), publisher)
+	limit := 1
+
+	_, err := store.Apply(context.Background(), []session.Operation{
+		{Op: session.StartOperation, UserID: "alan", StreamID: "boxing1"},
+		{Op: session.StartOperation, UserID: "alan", StreamID: "tennis2"},
+		{Op: session.StopOperation, UserID: "alan", StreamID: "boxing1"},
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []DomainEvent{
+		{Type: SessionStartedEvent, UserID: "alan", StreamID: "boxing1", Device: &session.Device{}},
+		{Type: SessionRejectedEvent, UserID: "alan", StreamID: "tennis2", Device: &session.Device{}, Limit: &limit},
+		{Type: SessionStoppedEvent, UserID: "alan", StreamID: "boxing1", Reason: removedReason},
+	}, publisher.withoutTimes())
+}
+
+func TestPublishingStoreShouldOnlyPublishStreamsStartedAndStoppedOnceAndThoseExpired(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	memoryStore := NewMemoryStore(NewMemoryQuotas(2), time.Minute).(*MemoryStore)
+	memoryStore.now = clock.Now
+	publisher := &recordingPublisher{}
+	store := NewPublishingStore(memoryStore, publisher)
+
+	assert.NoError(t, addStream(store, "becky", "rugby7", session.Device{}))
+	assert.NoError(t, addStream(store, "becky", "rugby7", session.Device{}))
+	assert.NoError(t, addStream(store, "becky", "golf4", session.Device{}))
+	assert.NoError(t, removeStream(store, "becky", "golf4"))
+	assert.NoError(t, removeStream(store, "becky", "golf4"))
+	clock.Advance(2 * time.Minute)
+	assert.Equal(t, streamNotFound, renewLease(store, "becky", "rugby7"))
+	assert.NoError(t, removeAllStreams(store, "becky"))
+
+	assert.Equal(t, []DomainEvent{
+		{Type: SessionStartedEvent, UserID: "becky", StreamID: "rugby7", Device: &session.Device{}},
+		{Type: SessionStartedEvent, UserID: "becky", StreamID: "golf4", Device: &session.Device{}},
+		{Type: SessionStoppedEvent, UserID: "becky", StreamID: "golf4", Reason: removedReason},
+		{Type: SessionStoppedEvent, UserID: "becky", StreamID: "rugby7", Reason: expiredReason},
+	}, publisher.withoutTimes())
+}
+
+func TestPublishingStoreShouldPublishRejectionsAtLimitOfZero(t *testing.T) {
+	publisher := &recordingPublisher{}
+	store := NewPublishingStore(NewMemoryStore(NewMemoryQuotas(0), time.Minute), publisher)
+
+	assert.Error(t, addStream(store, "charles", "darts2", session.Device{}))
+
+	data, err := json.Marshal(publisher.withoutTimes()[0])
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"limit":0`)
+}
+
+func TestAsyncPublisherShouldCloseSinkOnceQueuedEventsAreDelivered(t *testing.T) {
+	dir, err := ioutil.TempDir("", "events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events.ndjson")
+	sink, err := NewFileSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publisher := NewAsyncPublisher(noopLogger, sink, 10, 0)
+
+	publisher.Publish(DomainEvent{Type: SessionStartedEvent, UserID: "alan"})
+	assert.NoError(t, publisher.Close(context.Background()))
+
+	assert.Error(t, sink.Send(context.Background(), DomainEvent{Type: SessionStartedEvent, UserID: "becky"}))
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"userID":"alan"`)
+}
+
+func TestAsyncPublisherShouldRetryEventsUntilDelivered(t *testing.T) {
+	sink := &flakySink{failures: 2}
+	publisher := NewAsyncPublisher(noopLogger, sink, 10, 2)
+	publisher.backoff = time.Millisecond
+
+	publisher.Publish(DomainEvent{Type: SessionStartedEvent, UserID: "alan"})
+	assert.NoError(t, publisher.Close(context.Background()))
+
+	assert.Equal(t, 3, sink.attempts)
+	assert.Len(t, sink.delivered, 1)
+}
+
+func TestAsyncPublisherShouldDropEventsOnceRetriesAreExhausted(t *testing.T) {
+	sink := &flakySink{failures: 2}
+	publisher := NewAsyncPublisher(noopLogger, sink, 10, 1)
+	publisher.backoff = time.Millisecond
+
+	publisher.Publish(DomainEvent{Type: SessionStartedEvent, UserID: "alan"})
+	publisher.Publish(DomainEvent{Type: SessionStartedEvent, UserID: "becky"})
+	assert.NoError(t, publisher.Close(context.Background()))
+
+	assert.Equal(t, 3, sink.attempts)
+	if assert.Len(t, sink.delivered, 1) {
+		assert.Equal(t, "becky", sink.delivered[0].UserID)
+	}
+}
+
+func TestAsyncPublisherShouldNotBlockWhenQueueIsFull(t *testing.T) {
+	sink := &blockingSink{release: make(chan struct{})}
+	publisher := NewAsyncPublisher(noopLogger, sink, 1, 0)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			publisher.Publish(DomainEvent{Type: SessionStartedEvent, UserID: "alan"})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("publishing blocked")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Error(t, publisher.Close(ctx))
+	close(sink.release)
+}
+
+type recordingPublisher struct {
+	events []DomainEvent
+}
+
+func (rp *recordingPublisher) Publish(event DomainEvent) {
+	rp.events = append(rp.events, event)
+}
+
+func (rp *recordingPublisher) withoutTimes() []DomainEvent {
+	events := make([]DomainEvent, 0, len(rp.events))
+	for _, event := range rp.events {
+		event.Time = time.Time{}
+		events = append(events, event)
+	}
+	return events
+}
+
+type flakySink struct {
+	mu        sync.Mutex
+	failures  int
+	attempts  int
+	delivered []DomainEvent
+}
+
+func (fs *flakySink) Send(ctx context.Context, event DomainEvent) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.attempts++
+	if fs.attempts <= fs.failures {
+		return errors.New("intentional error")
+	}
+	fs.delivered = append(fs.delivered, event)
+	return nil
+}
+
+type blockingSink struct {
+	release chan struct{}
+}
+
+func (bs *blockingSink) Send(ctx context.Context, event DomainEvent) error {
+	<-bs.release
+	return nil
+}
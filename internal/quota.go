@@ -0,0 +1,333 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EvictionPolicy decides whether a stream started by a user already watching as many streams as they are allowed is
+// rejected, or admitted by ending one of the streams counted against the limit
+type EvictionPolicy string
+
+const (
+	// RejectPolicy rejects the new stream
+	RejectPolicy EvictionPolicy = "reject"
+
+	// EvictOldestPolicy ends the stream that was started first
+	EvictOldestPolicy EvictionPolicy = "evict-oldest"
+
+	// EvictIdlePolicy ends the stream whose lease was least recently renewed
+	EvictIdlePolicy EvictionPolicy = "evict-idle"
+)
+
+// QuotaExceededError is returned when a user is already watching as many streams as they are allowed, either in total
+// or on the device type if it is given
+type QuotaExceededError struct {
+	Limit      int
+	DeviceType string
+	Streams    []string
+
+	// RetryAfter the time until the soonest lease of the streams counted against the limit expires
+	RetryAfter time.Duration
+}
+
+func (e *QuotaExceededError) Error() string {
+	if e.DeviceType != "" {
+		return fmt.Sprintf("user has exceeded streaming quota of %d streams on %v devices", e.Limit, e.DeviceType)
+	}
+	return fmt.Sprintf("user has exceeded streaming quota of %d streams", e.Limit)
+}
+
+// Quotas provides the number of streams that users may watch concurrently in total and on each device type
+type Quotas interface {
+	Limit(ctx context.Context, userID string) (int, error)
+
+	// Limits returns the limits of several users at once indexed by user
+	Limits(ctx context.Context, userIDs []string) (map[string]int, error)
+
+	// DeviceLimit returns the number of streams that may be watched concurrently on the device type, or false if
+	// only the total limit applies
+	DeviceLimit(deviceType string) (int, bool)
+
+	// EvictionPolicy returns the policy applied when a user starts a stream beyond one of their limits
+	EvictionPolicy() EvictionPolicy
+
+	// Override sets the user's limit for the duration, or indefinitely if the duration is zero
+	Override(ctx context.Context, userID string, limit int, duration time.Duration) error
+}
+
+// AdjustableQuotas quotas whose default and device type limits and eviction policy can be changed whilst the service
+// is running
+type AdjustableQuotas interface {
+	Quotas
+	SetDefaultLimit(limit int)
+	SetDeviceLimits(limits map[string]int)
+	SetEvictionPolicy(policy EvictionPolicy)
+}
+
+// deviceLimits the limits of each device type shared by all users
+type deviceLimits struct {
+	limits atomic.Value
+}
+
+// DeviceLimit returns the number of streams that may be watched concurrently on the device type, or false if only
+// the total limit applies
+func (dl *deviceLimits) DeviceLimit(deviceType string) (int, bool) {
+	limits, _ := dl.limits.Load().(map[string]int)
+	limit, ok := limits[deviceType]
+	return limit, ok
+}
+
+// SetDeviceLimits replaces the limits of each device type
+func (dl *deviceLimits) SetDeviceLimits(limits map[string]int) {
+	copied := make(map[string]int, len(limits))
+	for deviceType, limit := range limits {
+		copied[deviceType] = limit
+	}
+	dl.limits.Store(copied)
+}
+
+// evictionPolicy the eviction policy shared by all users, which rejects new streams unless set
+type evictionPolicy struct {
+	policy atomic.Value
+}
+
+// EvictionPolicy returns the policy applied when a user starts a stream beyond one of their limits
+func (ep *evictionPolicy) EvictionPolicy() EvictionPolicy {
+	if policy, ok := ep.policy.Load().(EvictionPolicy); ok {
+		return policy
+	}
+	return RejectPolicy
+}
+
+// SetEvictionPolicy changes the policy applied when a user starts a stream beyond one of their limits
+func (ep *evictionPolicy) SetEvictionPolicy(policy EvictionPolicy) {
+	ep.policy.Store(policy)
+}
+
+// *atomic* lua script to delete the expired overrides of the hash KEYS[1] given by the pairs of user and override in
+// ARGV, keeping those replaced since they were read, and return the number deleted
+const deleteExpiredOverrides = `
+local deleted = 0
+for i = 1, #ARGV, 2 do
+	if redis.call("HGET",KEYS[1],ARGV[i]) == ARGV[i+1] then
+		deleted = deleted + redis.call("HDEL",KEYS[1],ARGV[i])
+	end
+end
+return deleted`
+
+// RedisQuotas a default limit with per-user overrides held in a Redis hash; temporary overrides are held as the limit
+// and expiry time in milliseconds separated by a colon and are deleted when read once expired
+type RedisQuotas struct {
+	deviceLimits
+	evictionPolicy
+	client       redis.UniversalClient
+	keys         KeySpace
+	defaultLimit int64
+}
+
+// NewRedisQuotas creates a new quota source with per-user overrides held in the key space's quotas hash
+func NewRedisQuotas(client redis.UniversalClient, keys KeySpace, defaultLimit int) AdjustableQuotas {
+	return &RedisQuotas{
+		client:       client,
+		keys:         keys,
+		defaultLimit: int64(defaultLimit),
+	}
+}
+
+// Limit returns the user's overridden limit if one exists, otherwise the default limit
+func (rq *RedisQuotas) Limit(ctx context.Context, userID string) (int, error) {
+	client, err := withContext(ctx, rq.client)
+	if err != nil {
+		return 0, err
+	}
+	cmd := client.HGet(rq.keys.Quotas(), userID)
+	val, err := cmd.Result()
+	if err == redis.Nil {
+		return int(atomic.LoadInt64(&rq.defaultLimit)), nil
+	}
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to get user quota")
+	}
+	limit, expired, err := rq.parseLimit(userID, val)
+	if err != nil {
+		return 0, err
+	}
+	if expired {
+		if err := deleteOverrides(client, rq.keys.Quotas(), []string{userID, val}); err != nil {
+			return 0, err
+		}
+	}
+	return limit, nil
+}
+
+// Limits returns the limits of several users with a single command
+func (rq *RedisQuotas) Limits(ctx context.Context, userIDs []string) (map[string]int, error) {
+	limits := make(map[string]int, len(userIDs))
+	if len(userIDs) == 0 {
+		return limits, nil
+	}
+	client, err := withContext(ctx, rq.client)
+	if err != nil {
+		return nil, err
+	}
+	vals, err := client.HMGet(rq.keys.Quotas(), userIDs...).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get user quotas")
+	}
+	var expired []string
+	for i, userID := range userIDs {
+		val, ok := vals[i].(string)
+		if !ok {
+			limits[userID] = int(atomic.LoadInt64(&rq.defaultLimit))
+			continue
+		}
+		limit, isExpired, err := rq.parseLimit(userID, val)
+		if err != nil {
+			return nil, err
+		}
+		if isExpired {
+			expired = append(expired, userID, val)
+		}
+		limits[userID] = limit
+	}
+	if len(expired) > 0 {
+		if err := deleteOverrides(client, rq.keys.Quotas(), expired); err != nil {
+			return nil, err
+		}
+	}
+	return limits, nil
+}
+
+// parseLimit reads an overridden limit, returning the default limit and true if the override has expired
+func (rq *RedisQuotas) parseLimit(userID, val string) (int, bool, error) {
+	parts := strings.SplitN(val, ":", 2)
+	limit, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, false, errors.Wrapf(err, "invalid quota override for user %v", userID)
+	}
+	if len(parts) == 2 {
+		expiry, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return 0, false, errors.Wrapf(err, "invalid quota override expiry for user %v", userID)
+		}
+		if expiry <= toMillis(time.Now()) {
+			return int(atomic.LoadInt64(&rq.defaultLimit)), true, nil
+		}
+	}
+	return limit, false, nil
+}
+
+// deleteOverrides deletes the expired overrides given by the pairs of user and override unless they have since been
+// replaced
+func deleteOverrides(client redis.UniversalClient, key string, overrides []string) error {
+	args := make([]interface{}, len(overrides))
+	for i, arg := range overrides {
+		args[i] = arg
+	}
+	if err := client.Eval(deleteExpiredOverrides, []string{key}, args...).Err(); err != nil {
+		return errors.Wrap(err, "failed to delete expired user quotas")
+	}
+	return nil
+}
+
+// Override sets the user's limit for the duration, or indefinitely if the duration is zero
+func (rq *RedisQuotas) Override(ctx context.Context, userID string, limit int, duration time.Duration) error {
+	val := strconv.Itoa(limit)
+	if duration > 0 {
+		val += ":" + strconv.FormatInt(toMillis(time.Now().Add(duration)), 10)
+	}
+	client, err := withContext(ctx, rq.client)
+	if err != nil {
+		return err
+	}
+	if err := client.HSet(rq.keys.Quotas(), userID, val).Err(); err != nil {
+		return errors.Wrap(err, "failed to set user quota")
+	}
+	return nil
+}
+
+// SetDefaultLimit changes the limit of users without overridden limits
+func (rq *RedisQuotas) SetDefaultLimit(limit int) {
+	atomic.StoreInt64(&rq.defaultLimit, int64(limit))
+}
+
+// MemoryQuotas a default limit with per-user overrides held in memory
+type MemoryQuotas struct {
+	deviceLimits
+	evictionPolicy
+	mu           sync.Mutex
+	defaultLimit int
+	overrides    map[string]memoryOverride
+}
+
+type memoryOverride struct {
+	limit  int
+	expiry time.Time
+}
+
+// NewMemoryQuotas creates a new quota source with per-user overrides held in memory
+func NewMemoryQuotas(defaultLimit int) AdjustableQuotas {
+	return &MemoryQuotas{
+		defaultLimit: defaultLimit,
+		overrides:    make(map[string]memoryOverride),
+	}
+}
+
+// Limit returns the user's overridden limit if one exists, otherwise the default limit
+func (mq *MemoryQuotas) Limit(ctx context.Context, userID string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	override, ok := mq.overrides[userID]
+	if !ok || (!override.expiry.IsZero() && !override.expiry.After(time.Now())) {
+		return mq.defaultLimit, nil
+	}
+	return override.limit, nil
+}
+
+// Limits returns the limits of several users at once
+func (mq *MemoryQuotas) Limits(ctx context.Context, userIDs []string) (map[string]int, error) {
+	limits := make(map[string]int, len(userIDs))
+	for _, userID := range userIDs {
+		limit, err := mq.Limit(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+		limits[userID] = limit
+	}
+	return limits, nil
+}
+
+// Override sets the user's limit for the duration, or indefinitely if the duration is zero
+func (mq *MemoryQuotas) Override(ctx context.Context, userID string, limit int, duration time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	override := memoryOverride{limit: limit}
+	if duration > 0 {
+		override.expiry = time.Now().Add(duration)
+	}
+	mq.overrides[userID] = override
+	return nil
+}
+
+// SetDefaultLimit changes the limit of users without overridden limits
+func (mq *MemoryQuotas) SetDefaultLimit(limit int) {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+	mq.defaultLimit = limit
+}
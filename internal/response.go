@@ -0,0 +1,228 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/prgodlonton/stream-controller/internal/session"
+	"go.uber.org/zap"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type contextKey int
+
+const (
+	contentTypeKey contextKey = iota
+	claimsKey
+)
+
+const (
+	contentTypeHeader = "Content-Type"
+
+	// content types offered in order of preference when the client has no preference
+	textContentType = "text/plain"
+	jsonContentType = "application/json"
+)
+
+var offeredContentTypes = []string{textContentType, jsonContentType}
+
+// streamResponse the JSON body returned when a stream is added, renewed or removed; adding a stream may evict others
+type streamResponse struct {
+	UserID   string   `json:"userID"`
+	StreamID string   `json:"streamID"`
+	Evicted  []string `json:"evicted,omitempty"`
+}
+
+// streamsResponse the JSON body returned when listing the streams being watched by a user
+type streamsResponse struct {
+	UserID    string            `json:"userID"`
+	Streams   []string          `json:"streams"`
+	Sessions  []sessionResponse `json:"sessions"`
+	Limit     int               `json:"limit"`
+	Remaining int               `json:"remaining"`
+}
+
+// sessionResponse a stream being watched by a user, the device it is watched on and when its lease expires
+type sessionResponse struct {
+	StreamID  string         `json:"streamID"`
+	Device    session.Device `json:"device"`
+	ExpiresAt time.Time      `json:"expiresAt"`
+}
+
+func toSessionResponses(sessions []session.Session) []sessionResponse {
+	responses := make([]sessionResponse, 0, len(sessions))
+	for _, s := range sessions {
+		responses = append(responses, sessionResponse{
+			StreamID:  s.StreamID,
+			Device:    s.Device,
+			ExpiresAt: s.ExpiresAt.UTC(),
+		})
+	}
+	return responses
+}
+
+// negotiateContentType middleware selecting the response content type from the request's Accept header
+func negotiateContentType(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType := selectContentType(r.Header.Get("Accept"))
+		if contentType == "" {
+			w.WriteHeader(http.StatusNotAcceptable)
+			return
+		}
+		ctx := context.WithValue(r.Context(), contentTypeKey, contentType)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// responseContentType returns the content type negotiated for the request
+func responseContentType(r *http.Request) string {
+	if contentType, ok := r.Context().Value(contentTypeKey).(string); ok {
+		return contentType
+	}
+	return textContentType
+}
+
+// selectContentType returns the offered content type with the highest quality in the accept header, or an empty
+// string if none are acceptable; legacy clients sending no accept header receive plain text
+func selectContentType(accept string) string {
+	if strings.TrimSpace(accept) == "" {
+		return textContentType
+	}
+
+	selected, selectedQuality := "", 0.0
+	for _, offered := range offeredContentTypes {
+		if quality := acceptQuality(accept, offered); quality > selectedQuality {
+			selected, selectedQuality = offered, quality
+		}
+	}
+	return selected
+}
+
+// acceptQuality returns the quality of the most specific media range in the accept header matching the content type
+func acceptQuality(accept, contentType string) float64 {
+	quality, specificity := 0.0, -1
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(mediaRange)
+		if err != nil {
+			continue
+		}
+
+		var s int
+		switch {
+		case mediaType == contentType:
+			s = 2
+		case mediaType == strings.SplitN(contentType, "/", 2)[0]+"/*":
+			s = 1
+		case mediaType == "*/*":
+			s = 0
+		default:
+			continue
+		}
+		if s <= specificity {
+			continue
+		}
+
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+		quality, specificity = q, s
+	}
+	return quality
+}
+
+// respond writes the status along with the body for JSON clients; plain text clients only receive the status
+func respond(logger *zap.SugaredLogger, w http.ResponseWriter, r *http.Request, status int, body interface{}) {
+	if responseContentType(r) != jsonContentType {
+		w.WriteHeader(status)
+		return
+	}
+	writeJSON(logger, w, status, body)
+}
+
+func writeJSON(logger *zap.SugaredLogger, w http.ResponseWriter, status int, body interface{}) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		logger.Errorw(
+			"cannot encode http response",
+			"error", err,
+		)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(contentTypeHeader, jsonContentType)
+	w.WriteHeader(status)
+	if _, err = w.Write(data); err != nil {
+		logger.Errorw(
+			"cannot write to http response",
+			"error", err,
+		)
+	}
+}
+
+const (
+	problemContentType = "application/problem+json"
+
+	// machine-readable problem codes
+	forbiddenCode            = "forbidden"
+	idempotencyKeyReusedCode = "idempotency_key_reused"
+	invalidIDCode            = "invalid_id"
+	invalidRequestCode       = "invalid_request"
+	quotaExceededCode        = "quota_exceeded"
+	requestCancelledCode     = "request_cancelled"
+	requestInProgressCode    = "request_in_progress"
+	storeTimeoutCode         = "store_timeout"
+	storeUnavailableCode     = "store_unavailable"
+	streamNotFoundCode       = "stream_not_found"
+	unauthorizedCode         = "unauthorized"
+)
+
+// problem an RFC 7807 problem details body describing why a request failed
+type problem struct {
+	Type       string   `json:"type"`
+	Title      string   `json:"title"`
+	Status     int      `json:"status"`
+	Detail     string   `json:"detail,omitempty"`
+	Code       string   `json:"code"`
+	UserID     string   `json:"userID,omitempty"`
+	StreamID   string   `json:"streamID,omitempty"`
+	Field      string   `json:"field,omitempty"`
+	Streams    []string `json:"streams,omitempty"`
+	Limit      *int     `json:"limit,omitempty"`
+	DeviceType string   `json:"deviceType,omitempty"`
+}
+
+// newProblem creates a problem with the given status and code; its type is derived from the code
+func newProblem(status int, code, title string) *problem {
+	return &problem{
+		Type:   "urn:stream-controller:problem:" + code,
+		Title:  title,
+		Status: status,
+		Code:   code,
+	}
+}
+
+func writeProblem(logger *zap.SugaredLogger, w http.ResponseWriter, p *problem) {
+	data, err := json.Marshal(p)
+	if err != nil {
+		logger.Errorw(
+			"cannot encode http problem response",
+			"error", err,
+		)
+		w.WriteHeader(p.Status)
+		return
+	}
+	w.Header().Set(contentTypeHeader, problemContentType)
+	w.WriteHeader(p.Status)
+	if _, err = w.Write(data); err != nil {
+		logger.Errorw(
+			"cannot write to http response",
+			"error", err,
+		)
+	}
+}
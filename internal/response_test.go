@@ -0,0 +1,26 @@
+package internal
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestShouldSelectContentTypeFromAcceptHeader(t *testing.T) {
+	tests := map[string]string{
+		"":                                     textContentType,
+		"*/*":                                  textContentType,
+		"text/plain":                           textContentType,
+		"text/*":                               textContentType,
+		"application/json":                     jsonContentType,
+		"application/*":                        jsonContentType,
+		"application/json, text/plain":         textContentType,
+		"application/json, text/plain;q=0.9":   jsonContentType,
+		"*/*;q=0.1, application/json":          jsonContentType,
+		"text/plain;q=0, */*":                  jsonContentType,
+		"image/png":                            "",
+		"application/json;q=0, text/plain;q=0": "",
+	}
+	for accept, expected := range tests {
+		assert.Equal(t, expected, selectContentType(accept), "accept: %q", accept)
+	}
+}
@@ -1,36 +1,141 @@
 package internal
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"github.com/go-chi/chi"
+	"github.com/pkg/errors"
+	"github.com/prgodlonton/stream-controller/internal/session"
 	"go.uber.org/zap"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
+)
+
+const (
+	// header holding the number of streams the user is watching
+	activeHeader = "X-Stream-Active"
+
+	// header holding the comma-separated streams evicted to make room for the stream being added
+	evictedHeader = "X-Stream-Evicted"
+
+	// header holding the number of streams the user may watch concurrently
+	limitHeader = "X-Stream-Limit"
+
+	// header holding the number of seconds until the user's soonest expiring stream releases its slot
+	retryAfterHeader = "Retry-After"
+
+	// maximum size in bytes of the JSON body describing the device on which a stream is watched
+	maxDeviceSize = 4096
 )
 
 // NewRouter creates a new router with HTTP handlers
-func NewRouter(logger *zap.SugaredLogger, store Store) http.Handler {
+func NewRouter(logger *zap.SugaredLogger, store Store, opts ...Option) http.Handler {
+	o := newOptions(opts)
 	router := chi.NewRouter()
-	router.Route("/v1/users/{userID}", func(r chi.Router) {
-		r.Route("/streams/{streamID}", func(r chi.Router) {
-			r.Delete("/", deleteStream(logger, store))
-			r.Put("/", createStream(logger, store))
+	if o.metrics != nil {
+		router.Use(o.metrics.Middleware)
+	}
+	if o.notifier != nil {
+		// event streams are held open for longer than the deadline of store operations
+		router.With(eventMiddlewares(logger, o)...).Get("/v1/users/{userID}/events", streamEvents(logger, o.notifier))
+	}
+	router.Group(func(router chi.Router) {
+		if o.storeTimeout != nil {
+			router.Use(withDeadline(o.storeTimeout))
+		}
+		if o.health != nil {
+			router.Get("/healthz", liveness())
+			router.Get("/readyz", readiness(logger, o.health))
+		}
+		if o.authenticator != nil {
+			router.Mount("/admin/v1", adminRouter(logger, store, o.authenticator, o.notifier, o.ids))
+		}
+		if o.authenticator != nil {
+			router.With(authenticate(logger, o.authenticator)).Post("/v1/batch", applyBatch(logger, store, o.authenticator, o.notifier, o.ids))
+		} else {
+			router.Post("/v1/batch", applyBatch(logger, store, nil, o.notifier, o.ids))
+		}
+		router.Route("/v1/users/{userID}", func(r chi.Router) {
+			r.Use(negotiateContentType)
+			r.Use(userMiddlewares(logger, o)...)
+			r.Route("/streams/{streamID}", func(r chi.Router) {
+				r.Use(validateURLParam(logger, o.ids, "streamID"))
+				if o.idempotency != nil {
+					r.Use(idempotent(logger, o.idempotency))
+				}
+				r.Delete("/", deleteStream(logger, store, o.notifier))
+				r.Put("/", createStream(logger, store, o.notifier, o.quotaExceededStatus))
+				r.Post("/heartbeat", renewStream(logger, store, o.notifier))
+			})
+			r.Get("/", listStreams(logger, store))
 		})
-		r.Get("/", listStreams(logger, store))
 	})
 	return router
 }
 
-func createStream(logger *zap.SugaredLogger, store Store) http.HandlerFunc {
+// userMiddlewares returns the middlewares authorizing callers to act on the user given by the path
+func userMiddlewares(logger *zap.SugaredLogger, o *options) []func(http.Handler) http.Handler {
+	var middlewares []func(http.Handler) http.Handler
+	if o.authenticator != nil {
+		middlewares = append(middlewares, authenticate(logger, o.authenticator), authorizeUser(logger, o.authenticator))
+	}
+	return append(middlewares, validateURLParam(logger, o.ids, "userID"))
+}
+
+// eventMiddlewares returns the middlewares authorizing callers to receive the events of the user given by the path;
+// the bearer token may also be given by the access_token query parameter for browsers' EventSource
+func eventMiddlewares(logger *zap.SugaredLogger, o *options) []func(http.Handler) http.Handler {
+	var middlewares []func(http.Handler) http.Handler
+	if o.authenticator != nil {
+		middlewares = append(middlewares, authenticateWith(logger, o.authenticator.authenticateQuery), authorizeUser(logger, o.authenticator))
+	}
+	return append(middlewares, validateURLParam(logger, o.ids, "userID"))
+}
+
+func createStream(logger *zap.SugaredLogger, store Store, notifier Notifier, quotaExceededStatus int) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		userID, streamID := getURLParams(r)
-		if err := store.AddStream(userID, streamID); err != nil {
-			if err == exceededStreamsQuota {
+		device, err := readDevice(r)
+		if err != nil {
+			logger.Debugw(
+				"cannot read device",
+				"userID", userID,
+				"streamID", streamID,
+				"error", err,
+			)
+			writeProblem(logger, w, invalidRequest("", "the body must be a JSON object describing the device"))
+			return
+		}
+		change, err := store.AddStream(r.Context(), userID, streamID, device)
+		notifyExpired(r.Context(), logger, notifier, userID, change.Expired)
+		if err != nil {
+			if qe, ok := err.(*QuotaExceededError); ok {
 				logger.Debugw(
 					"user exceeded streaming quota",
 					"userID", userID,
 					"streamID", streamID,
+					"limit", qe.Limit,
+					"deviceType", qe.DeviceType,
 				)
-				w.WriteHeader(http.StatusBadRequest)
+				p := newProblem(quotaExceededStatus, quotaExceededCode, "Streaming quota exceeded")
+				p.Detail = "stop watching one of the active streams to watch this stream"
+				if qe.DeviceType != "" {
+					p.Detail = "stop watching one of the active streams on " + qe.DeviceType + " devices to watch this stream"
+				}
+				p.UserID, p.StreamID = userID, streamID
+				p.Streams, p.Limit, p.DeviceType = qe.Streams, &qe.Limit, qe.DeviceType
+				w.Header().Set(limitHeader, strconv.Itoa(qe.Limit))
+				w.Header().Set(activeHeader, strconv.Itoa(len(qe.Streams)))
+				if qe.RetryAfter > 0 {
+					w.Header().Set(retryAfterHeader, strconv.Itoa(retryAfterSeconds(qe.RetryAfter)))
+				}
+				writeProblem(logger, w, p)
 				return
 			}
 			logger.Errorw(
@@ -39,26 +144,72 @@ func createStream(logger *zap.SugaredLogger, store Store) http.HandlerFunc {
 				"streamID", streamID,
 				"error", err,
 			)
-			w.WriteHeader(http.StatusInternalServerError)
+			writeProblem(logger, w, storeProblem(err, userID, streamID))
 			return
 		}
-		w.WriteHeader(http.StatusCreated)
+		if len(change.Evicted) > 0 {
+			logger.Infow(
+				"evicted streams to make room for stream",
+				"userID", userID,
+				"streamID", streamID,
+				"evicted", change.Evicted,
+			)
+			w.Header().Set(evictedHeader, strings.Join(change.Evicted, ","))
+			for _, evictedID := range change.Evicted {
+				notify(r.Context(), logger, notifier, Event{Type: SessionEvictedEvent, UserID: userID, StreamID: evictedID})
+			}
+		}
+		respond(logger, w, r, http.StatusCreated, streamResponse{UserID: userID, StreamID: streamID, Evicted: change.Evicted})
 	}
 }
 
 func listStreams(logger *zap.SugaredLogger, store Store) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		userID := chi.URLParam(r, "userID")
-		streamIDs, err := store.GetStreams(userID)
+		asJSON := responseContentType(r) == jsonContentType
+		var streamIDs []string
+		var sessions []session.Session
+		var err error
+		if asJSON {
+			sessions, err = store.GetSessions(r.Context(), userID)
+			streamIDs = streamIDsOf(sessions)
+		} else {
+			streamIDs, err = store.GetStreams(r.Context(), userID)
+		}
 		if err != nil {
 			logger.Debugw(
 				"cannot list streams",
 				"userID", userID,
 				"error", err,
 			)
-			w.WriteHeader(http.StatusInternalServerError)
+			writeProblem(logger, w, storeProblem(err, userID, ""))
 			return
 		}
+		limit, err := store.GetLimit(r.Context(), userID)
+		if err != nil {
+			logger.Debugw(
+				"cannot get stream limit",
+				"userID", userID,
+				"error", err,
+			)
+			writeProblem(logger, w, storeProblem(err, userID, ""))
+			return
+		}
+		if streamIDs == nil {
+			streamIDs = []string{}
+		}
+		w.Header().Set(limitHeader, strconv.Itoa(limit))
+		if asJSON {
+			writeJSON(logger, w, http.StatusOK, streamsResponse{
+				UserID:    userID,
+				Streams:   streamIDs,
+				Sessions:  toSessionResponses(sessions),
+				Limit:     limit,
+				Remaining: remaining(limit, len(streamIDs)),
+			})
+			return
+		}
+		w.Header().Set(contentTypeHeader, textContentType)
 		if _, err = w.Write([]byte(strings.Join(streamIDs, ","))); err != nil {
 			logger.Errorw(
 				"cannot write to http response",
@@ -71,23 +222,146 @@ func listStreams(logger *zap.SugaredLogger, store Store) http.HandlerFunc {
 	}
 }
 
-func deleteStream(logger *zap.SugaredLogger, store Store) http.HandlerFunc {
+func deleteStream(logger *zap.SugaredLogger, store Store, notifier Notifier) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		userID, streamID := getURLParams(r)
-		if err := store.RemoveStream(userID, streamID); err != nil {
+		change, err := store.RemoveStream(r.Context(), userID, streamID)
+		if err != nil {
 			logger.Errorw(
 				"cannot remove stream",
 				"userID", userID,
 				"streamID", streamID,
 				"error", err,
 			)
-			w.WriteHeader(http.StatusInternalServerError)
+			writeProblem(logger, w, storeProblem(err, userID, streamID))
 			return
 		}
-		w.WriteHeader(http.StatusOK)
+		notifyExpired(r.Context(), logger, notifier, userID, change.Expired)
+		respond(logger, w, r, http.StatusOK, streamResponse{UserID: userID, StreamID: streamID})
 	}
 }
 
+func renewStream(logger *zap.SugaredLogger, store Store, notifier Notifier) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, streamID := getURLParams(r)
+		change, err := store.RenewStream(r.Context(), userID, streamID)
+		notifyExpired(r.Context(), logger, notifier, userID, change.Expired)
+		if err != nil {
+			if err == streamNotFound {
+				logger.Debugw(
+					"user is not watching stream",
+					"userID", userID,
+					"streamID", streamID,
+				)
+				p := newProblem(http.StatusNotFound, streamNotFoundCode, "Stream not found")
+				p.Detail = "the user is not watching the stream or its lease has expired"
+				p.UserID, p.StreamID = userID, streamID
+				writeProblem(logger, w, p)
+				return
+			}
+			logger.Errorw(
+				"cannot renew stream",
+				"userID", userID,
+				"streamID", streamID,
+				"error", err,
+			)
+			writeProblem(logger, w, storeProblem(err, userID, streamID))
+			return
+		}
+		respond(logger, w, r, http.StatusOK, streamResponse{UserID: userID, StreamID: streamID})
+	}
+}
+
+// readDevice reads the device described by the request's optional JSON body; the IP address and user agent default to
+// those of the request
+func readDevice(r *http.Request) (session.Device, error) {
+	var device session.Device
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxDeviceSize+1))
+	if err != nil {
+		return device, errors.Wrap(err, "cannot read body")
+	}
+	if len(body) > maxDeviceSize {
+		return device, errors.New("body is too large")
+	}
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, &device); err != nil {
+			return device, errors.Wrap(err, "cannot parse body")
+		}
+	}
+	if device.IP == "" {
+		device.IP, _, _ = net.SplitHostPort(r.RemoteAddr)
+	}
+	if device.UserAgent == "" {
+		device.UserAgent = r.UserAgent()
+	}
+	return device, nil
+}
+
+func streamIDsOf(sessions []session.Session) []string {
+	streamIDs := make([]string, 0, len(sessions))
+	for _, s := range sessions {
+		streamIDs = append(streamIDs, s.StreamID)
+	}
+	return streamIDs
+}
+
 func getURLParams(r *http.Request) (string, string) {
 	return chi.URLParam(r, "userID"), chi.URLParam(r, "streamID")
 }
+
+// retryAfterSeconds rounds the duration up to whole seconds so clients retry once the slot has been released
+func retryAfterSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
+func remaining(limit, active int) int {
+	if active >= limit {
+		return 0
+	}
+	return limit - active
+}
+
+// storeProblem returns the problem reported when the store fails; timeouts and cancellations are distinguished from
+// other failures so that clients know the store may succeed if the request is retried
+func storeProblem(err error, userID, streamID string) *problem {
+	var p *problem
+	switch {
+	case isTimeout(err):
+		p = newProblem(http.StatusGatewayTimeout, storeTimeoutCode, "Store timeout")
+		p.Detail = "the store did not respond before the deadline; try again later"
+	case errors.Cause(err) == context.Canceled:
+		p = newProblem(http.StatusServiceUnavailable, requestCancelledCode, "Request cancelled")
+		p.Detail = "the request was cancelled before the store responded"
+	default:
+		p = newProblem(http.StatusInternalServerError, storeUnavailableCode, "Store unavailable")
+		p.Detail = "the streams being watched cannot be read or updated; try again later"
+	}
+	p.UserID, p.StreamID = userID, streamID
+	return p
+}
+
+// isTimeout returns true if the error was caused by the request's deadline passing or a network timeout
+func isTimeout(err error) bool {
+	cause := errors.Cause(err)
+	if cause == context.DeadlineExceeded {
+		return true
+	}
+	netErr, ok := cause.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// withDeadline middleware bounding the time the handlers may spend waiting on the store
+func withDeadline(timeout *StoreTimeout) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			duration := timeout.Duration()
+			if duration <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ctx, cancel := context.WithTimeout(r.Context(), duration)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
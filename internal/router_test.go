@@ -2,13 +2,22 @@ package internal
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/golang/mock/gomock"
+	"github.com/prgodlonton/stream-controller/internal/session"
 	"github.com/prgodlonton/stream-controller/testing/mocks"
+	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 var (
@@ -20,7 +29,7 @@ func TestShouldReturnCreatedWhenStreamIsAdded(t *testing.T) {
 	defer mockCtrl.Finish()
 
 	store := mocks.NewMockStore(mockCtrl)
-	store.EXPECT().AddStream("alan", "boxing1").MinTimes(1).Return(nil)
+	store.EXPECT().AddStream(gomock.Any(), "alan", "boxing1", gomock.Any()).MinTimes(1).Return(session.Change{}, nil)
 
 	w := mocks.NewMockResponseWriter(mockCtrl)
 	w.EXPECT().WriteHeader(http.StatusCreated)
@@ -31,20 +40,104 @@ func TestShouldReturnCreatedWhenStreamIsAdded(t *testing.T) {
 	router.ServeHTTP(w, r)
 }
 
-func TestShouldReturnBadRequestWhenUserHasReachedStreamQuotaLimit(t *testing.T) {
+func TestShouldReturnConflictWhenUserHasReachedStreamQuotaLimit(t *testing.T) {
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 
 	store := mocks.NewMockStore(mockCtrl)
-	store.EXPECT().AddStream("michelangelo", "bobsleigh32").MinTimes(1).Return(exceededStreamsQuota)
+	store.EXPECT().AddStream(gomock.Any(), "michelangelo", "bobsleigh32", gomock.Any()).MinTimes(1).Return(
+		session.Change{}, &QuotaExceededError{Limit: 2, Streams: []string{"luge4", "skeleton5"}, RetryAfter: 1500 * time.Millisecond},
+	)
 
+	header := http.Header{}
 	w := mocks.NewMockResponseWriter(mockCtrl)
-	w.EXPECT().WriteHeader(http.StatusBadRequest)
+	w.EXPECT().Header().AnyTimes().Return(header)
+	w.EXPECT().WriteHeader(http.StatusConflict)
+	w.EXPECT().Write(problemWithCodeAndFields(quotaExceededCode, map[string]interface{}{
+		"streams": []interface{}{"luge4", "skeleton5"},
+		"limit":   float64(2),
+	}))
 
 	r := createHTTPRequest("PUT", "v1/users/michelangelo/streams/bobsleigh32")
 
 	router := NewRouter(noopLogger, store)
 	router.ServeHTTP(w, r)
+
+	assert.Equal(t, "2", header.Get(limitHeader))
+	assert.Equal(t, "2", header.Get(activeHeader))
+	assert.Equal(t, "2", header.Get(retryAfterHeader))
+	assert.Equal(t, problemContentType, header.Get(contentTypeHeader))
+}
+
+func TestShouldReturnDeviceTypeWhenUserHasReachedDeviceTypeLimit(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+	store.EXPECT().AddStream(gomock.Any(), "olive", "snooker8", gomock.Any()).MinTimes(1).Return(
+		session.Change{}, &QuotaExceededError{Limit: 1, DeviceType: "tv", Streams: []string{"darts2"}},
+	)
+
+	header := http.Header{}
+	w := mocks.NewMockResponseWriter(mockCtrl)
+	w.EXPECT().Header().AnyTimes().Return(header)
+	w.EXPECT().WriteHeader(http.StatusConflict)
+	w.EXPECT().Write(problemWithCodeAndFields(quotaExceededCode, map[string]interface{}{
+		"streams":    []interface{}{"darts2"},
+		"limit":      float64(1),
+		"deviceType": "tv",
+	}))
+
+	r := createHTTPRequest("PUT", "v1/users/olive/streams/snooker8")
+
+	router := NewRouter(noopLogger, store)
+	router.ServeHTTP(w, r)
+
+	assert.Equal(t, "1", header.Get(limitHeader))
+}
+
+func TestShouldReturnConfiguredStatusWhenUserHasReachedStreamQuotaLimit(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+	store.EXPECT().AddStream(gomock.Any(), "nigel", "curling6", gomock.Any()).MinTimes(1).Return(
+		session.Change{}, &QuotaExceededError{Limit: 1, Streams: []string{"darts2"}},
+	)
+
+	header := http.Header{}
+	w := mocks.NewMockResponseWriter(mockCtrl)
+	w.EXPECT().Header().AnyTimes().Return(header)
+	w.EXPECT().WriteHeader(http.StatusBadRequest)
+	w.EXPECT().Write(problemWithCodeAndFields(quotaExceededCode, map[string]interface{}{"status": float64(400)}))
+
+	r := createHTTPRequest("PUT", "v1/users/nigel/streams/curling6")
+
+	router := NewRouter(noopLogger, store, WithQuotaExceededStatus(http.StatusBadRequest))
+	router.ServeHTTP(w, r)
+
+	assert.Equal(t, "1", header.Get(activeHeader))
+	assert.Empty(t, header.Get(retryAfterHeader))
+}
+
+func TestShouldReturnZeroLimitWhenUserMayNotWatchAnyStreams(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+	store.EXPECT().AddStream(gomock.Any(), "olive", "bowls8", gomock.Any()).MinTimes(1).Return(
+		session.Change{}, &QuotaExceededError{Limit: 0, Streams: []string{}},
+	)
+
+	w := mocks.NewMockResponseWriter(mockCtrl)
+	w.EXPECT().Header().AnyTimes().Return(http.Header{})
+	w.EXPECT().WriteHeader(http.StatusConflict)
+	w.EXPECT().Write(problemWithCodeAndFields(quotaExceededCode, map[string]interface{}{"limit": float64(0)}))
+
+	r := createHTTPRequest("PUT", "v1/users/olive/streams/bowls8")
+
+	router := NewRouter(noopLogger, store)
+	router.ServeHTTP(w, r)
 }
 
 func TestShouldReturnInternalServerErrorWhenStreamCannotBeAdded(t *testing.T) {
@@ -52,10 +145,12 @@ func TestShouldReturnInternalServerErrorWhenStreamCannotBeAdded(t *testing.T) {
 	defer mockCtrl.Finish()
 
 	store := mocks.NewMockStore(mockCtrl)
-	store.EXPECT().AddStream("bob", "tennis2").MinTimes(1).Return(errors.New("intentional error"))
+	store.EXPECT().AddStream(gomock.Any(), "bob", "tennis2", gomock.Any()).MinTimes(1).Return(session.Change{}, errors.New("intentional error"))
 
 	w := mocks.NewMockResponseWriter(mockCtrl)
+	w.EXPECT().Header().AnyTimes().Return(http.Header{})
 	w.EXPECT().WriteHeader(http.StatusInternalServerError)
+	w.EXPECT().Write(gomock.Any())
 
 	r := createHTTPRequest("PUT", "v1/users/bob/streams/tennis2")
 
@@ -68,18 +163,42 @@ func TestShouldReturnActiveStreamsForUser(t *testing.T) {
 	defer mockCtrl.Finish()
 
 	store := mocks.NewMockStore(mockCtrl)
-	store.EXPECT().GetStreams("cassandra").MaxTimes(1).Return(
+	store.EXPECT().GetStreams(gomock.Any(), "cassandra").MaxTimes(1).Return(
 		[]string{"boxing16", "tennis42", "sumo89"},
 		nil,
 	)
+	store.EXPECT().GetLimit(gomock.Any(), "cassandra").MaxTimes(1).Return(4, nil)
 
+	header := http.Header{}
 	w := mocks.NewMockResponseWriter(mockCtrl)
+	w.EXPECT().Header().AnyTimes().Return(header)
 	w.EXPECT().Write([]byte("boxing16,tennis42,sumo89"))
 
 	r := createHTTPRequest("GET", "v1/users/cassandra")
 
 	router := NewRouter(noopLogger, store)
 	router.ServeHTTP(w, r)
+
+	assert.Equal(t, "4", header.Get(limitHeader))
+}
+
+func TestShouldReturnInternalServerErrorWhenStreamLimitCannotBeRead(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+	store.EXPECT().GetStreams(gomock.Any(), "samuel").MaxTimes(1).Return([]string{"golf7"}, nil)
+	store.EXPECT().GetLimit(gomock.Any(), "samuel").MaxTimes(1).Return(0, errors.New("intentional error"))
+
+	w := mocks.NewMockResponseWriter(mockCtrl)
+	w.EXPECT().Header().AnyTimes().Return(http.Header{})
+	w.EXPECT().WriteHeader(http.StatusInternalServerError)
+	w.EXPECT().Write(gomock.Any())
+
+	r := createHTTPRequest("GET", "v1/users/samuel")
+
+	router := NewRouter(noopLogger, store)
+	router.ServeHTTP(w, r)
 }
 
 func TestShouldReturnInternalServerErrorWhenActiveStreamsCannotBeRead(t *testing.T) {
@@ -87,13 +206,15 @@ func TestShouldReturnInternalServerErrorWhenActiveStreamsCannotBeRead(t *testing
 	defer mockCtrl.Finish()
 
 	store := mocks.NewMockStore(mockCtrl)
-	store.EXPECT().GetStreams("rachel").MaxTimes(1).Return(
+	store.EXPECT().GetStreams(gomock.Any(), "rachel").MaxTimes(1).Return(
 		[]string{},
 		errors.New("intentional error"),
 	)
 
 	w := mocks.NewMockResponseWriter(mockCtrl)
+	w.EXPECT().Header().AnyTimes().Return(http.Header{})
 	w.EXPECT().WriteHeader(http.StatusInternalServerError)
+	w.EXPECT().Write(gomock.Any())
 
 	r := createHTTPRequest("GET", "v1/users/rachel")
 
@@ -106,12 +227,14 @@ func TestShouldReturnInternalServerErrorWhenWritingStreamListToResponseWriterFai
 	defer mockCtrl.Finish()
 
 	store := mocks.NewMockStore(mockCtrl)
-	store.EXPECT().GetStreams("rodney").MaxTimes(1).Return(
+	store.EXPECT().GetStreams(gomock.Any(), "rodney").MaxTimes(1).Return(
 		[]string{"boxing16", "tennis42", "sumo89"},
 		nil,
 	)
+	store.EXPECT().GetLimit(gomock.Any(), "rodney").MaxTimes(1).Return(3, nil)
 
 	w := mocks.NewMockResponseWriter(mockCtrl)
+	w.EXPECT().Header().AnyTimes().Return(http.Header{})
 	w.EXPECT().Write(gomock.Any()).Return(0, errors.New("intentional error"))
 	w.EXPECT().WriteHeader(http.StatusInternalServerError)
 
@@ -126,7 +249,7 @@ func TestShouldReturnOKWhenStreamIsRemoved(t *testing.T) {
 	defer mockCtrl.Finish()
 
 	store := mocks.NewMockStore(mockCtrl)
-	store.EXPECT().RemoveStream("charlie", "snooker3").MinTimes(1).Return(nil)
+	store.EXPECT().RemoveStream(gomock.Any(), "charlie", "snooker3").MinTimes(1).Return(session.Change{}, nil)
 
 	w := mocks.NewMockResponseWriter(mockCtrl)
 	w.EXPECT().WriteHeader(http.StatusOK)
@@ -142,10 +265,12 @@ func TestShouldReturnInternalServerErrorWhenStreamCannotBeRemoved(t *testing.T)
 	defer mockCtrl.Finish()
 
 	store := mocks.NewMockStore(mockCtrl)
-	store.EXPECT().RemoveStream("duncan", "nfl4").MinTimes(1).Return(errors.New("intentional error"))
+	store.EXPECT().RemoveStream(gomock.Any(), "duncan", "nfl4").MinTimes(1).Return(session.Change{}, errors.New("intentional error"))
 
 	w := mocks.NewMockResponseWriter(mockCtrl)
+	w.EXPECT().Header().AnyTimes().Return(http.Header{})
 	w.EXPECT().WriteHeader(http.StatusInternalServerError)
+	w.EXPECT().Write(gomock.Any())
 
 	r := createHTTPRequest("DELETE", "v1/users/duncan/streams/nfl4")
 
@@ -153,6 +278,367 @@ func TestShouldReturnInternalServerErrorWhenStreamCannotBeRemoved(t *testing.T)
 	router.ServeHTTP(w, r)
 }
 
+func TestShouldReturnOKWhenStreamIsRenewed(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+	store.EXPECT().RenewStream(gomock.Any(), "edith", "darts5").MinTimes(1).Return(session.Change{}, nil)
+
+	w := mocks.NewMockResponseWriter(mockCtrl)
+	w.EXPECT().WriteHeader(http.StatusOK)
+
+	r := createHTTPRequest("POST", "v1/users/edith/streams/darts5/heartbeat")
+
+	router := NewRouter(noopLogger, store)
+	router.ServeHTTP(w, r)
+}
+
+func TestShouldReturnNotFoundWhenRenewedStreamIsNotBeingWatched(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+	store.EXPECT().RenewStream(gomock.Any(), "frank", "polo6").MinTimes(1).Return(session.Change{}, streamNotFound)
+
+	w := mocks.NewMockResponseWriter(mockCtrl)
+	w.EXPECT().Header().AnyTimes().Return(http.Header{})
+	w.EXPECT().WriteHeader(http.StatusNotFound)
+	w.EXPECT().Write(gomock.Any())
+
+	r := createHTTPRequest("POST", "v1/users/frank/streams/polo6/heartbeat")
+
+	router := NewRouter(noopLogger, store)
+	router.ServeHTTP(w, r)
+}
+
+func TestShouldReturnInternalServerErrorWhenStreamCannotBeRenewed(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+	store.EXPECT().RenewStream(gomock.Any(), "gemma", "chess7").MinTimes(1).Return(session.Change{}, errors.New("intentional error"))
+
+	w := mocks.NewMockResponseWriter(mockCtrl)
+	w.EXPECT().Header().AnyTimes().Return(http.Header{})
+	w.EXPECT().WriteHeader(http.StatusInternalServerError)
+	w.EXPECT().Write(gomock.Any())
+
+	r := createHTTPRequest("POST", "v1/users/gemma/streams/chess7/heartbeat")
+
+	router := NewRouter(noopLogger, store)
+	router.ServeHTTP(w, r)
+}
+
+func TestShouldReturnJSONWhenStreamIsAddedByJSONClient(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+	store.EXPECT().AddStream(gomock.Any(), "harold", "hockey8", gomock.Any()).MinTimes(1).Return(session.Change{}, nil)
+
+	header := http.Header{}
+	w := mocks.NewMockResponseWriter(mockCtrl)
+	w.EXPECT().Header().AnyTimes().Return(header)
+	w.EXPECT().WriteHeader(http.StatusCreated)
+	w.EXPECT().Write([]byte(`{"userID":"harold","streamID":"hockey8"}`))
+
+	r := createHTTPRequest("PUT", "v1/users/harold/streams/hockey8")
+	r.Header.Set("Accept", "application/json")
+
+	router := NewRouter(noopLogger, store)
+	router.ServeHTTP(w, r)
+
+	assert.Equal(t, jsonContentType, header.Get(contentTypeHeader))
+}
+
+func TestShouldReturnStreamsEvictedToMakeRoomForStream(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+	store.EXPECT().AddStream(gomock.Any(), "harold", "hockey9", gomock.Any()).MinTimes(1).Return(session.Change{Evicted: []string{"hockey8"}}, nil)
+
+	header := http.Header{}
+	w := mocks.NewMockResponseWriter(mockCtrl)
+	w.EXPECT().Header().AnyTimes().Return(header)
+	w.EXPECT().WriteHeader(http.StatusCreated)
+	w.EXPECT().Write([]byte(`{"userID":"harold","streamID":"hockey9","evicted":["hockey8"]}`))
+
+	r := createHTTPRequest("PUT", "v1/users/harold/streams/hockey9")
+	r.Header.Set("Accept", "application/json")
+
+	router := NewRouter(noopLogger, store)
+	router.ServeHTTP(w, r)
+
+	assert.Equal(t, "hockey8", header.Get(evictedHeader))
+}
+
+func TestShouldReturnActiveStreamsAsJSONForJSONClient(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+	store.EXPECT().GetSessions(gomock.Any(), "irene").MaxTimes(1).Return([]session.Session{
+		{StreamID: "boxing16", ExpiresAt: time.Date(2019, 11, 5, 20, 0, 30, 0, time.UTC)},
+		{StreamID: "sumo89", Device: session.Device{DeviceID: "tv-1"}, ExpiresAt: time.Date(2019, 11, 5, 20, 0, 45, 0, time.UTC)},
+	}, nil)
+	store.EXPECT().GetLimit(gomock.Any(), "irene").MaxTimes(1).Return(3, nil)
+
+	header := http.Header{}
+	w := mocks.NewMockResponseWriter(mockCtrl)
+	w.EXPECT().Header().AnyTimes().Return(header)
+	w.EXPECT().WriteHeader(http.StatusOK)
+	w.EXPECT().Write([]byte(`{"userID":"irene","streams":["boxing16","sumo89"],"sessions":[` +
+		`{"streamID":"boxing16","device":{},"expiresAt":"2019-11-05T20:00:30Z"},` +
+		`{"streamID":"sumo89","device":{"deviceID":"tv-1"},"expiresAt":"2019-11-05T20:00:45Z"}` +
+		`],"limit":3,"remaining":1}`))
+
+	r := createHTTPRequest("GET", "v1/users/irene")
+	r.Header.Set("Accept", "text/plain;q=0.5, application/json")
+
+	router := NewRouter(noopLogger, store)
+	router.ServeHTTP(w, r)
+
+	assert.Equal(t, jsonContentType, header.Get(contentTypeHeader))
+}
+
+func TestShouldReturnEmptyStreamListAsJSONWhenUserIsNotWatching(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+	store.EXPECT().GetSessions(gomock.Any(), "james").MaxTimes(1).Return(nil, nil)
+	store.EXPECT().GetLimit(gomock.Any(), "james").MaxTimes(1).Return(3, nil)
+
+	w := mocks.NewMockResponseWriter(mockCtrl)
+	w.EXPECT().Header().AnyTimes().Return(http.Header{})
+	w.EXPECT().WriteHeader(http.StatusOK)
+	w.EXPECT().Write([]byte(`{"userID":"james","streams":[],"sessions":[],"limit":3,"remaining":3}`))
+
+	r := createHTTPRequest("GET", "v1/users/james")
+	r.Header.Set("Accept", "application/json")
+
+	router := NewRouter(noopLogger, store)
+	router.ServeHTTP(w, r)
+}
+
+func TestShouldRecordDeviceDescribedByRequestBody(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+	store.EXPECT().AddStream(gomock.Any(), "karen", "darts3", session.Device{
+		DeviceID:   "a1b2",
+		DeviceType: "mobile",
+		AppVersion: "4.2.0",
+		IP:         "192.0.2.7",
+		UserAgent:  "player/4.2.0",
+	}).Return(session.Change{}, nil)
+
+	w := mocks.NewMockResponseWriter(mockCtrl)
+	w.EXPECT().WriteHeader(http.StatusCreated)
+
+	r := createHTTPRequest("PUT", "v1/users/karen/streams/darts3")
+	r.Body = ioutil.NopCloser(strings.NewReader(`{"deviceID":"a1b2","deviceType":"mobile","appVersion":"4.2.0"}`))
+	r.RemoteAddr = "192.0.2.7:52114"
+	r.Header.Set("User-Agent", "player/4.2.0")
+
+	router := NewRouter(noopLogger, store)
+	router.ServeHTTP(w, r)
+}
+
+func TestShouldReturnBadRequestWhenDeviceCannotBeParsed(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+
+	w := mocks.NewMockResponseWriter(mockCtrl)
+	w.EXPECT().Header().AnyTimes().Return(http.Header{})
+	w.EXPECT().WriteHeader(http.StatusBadRequest)
+	w.EXPECT().Write(problemWithCodeAndFields(invalidRequestCode, nil))
+
+	r := createHTTPRequest("PUT", "v1/users/karen/streams/darts3")
+	r.Body = ioutil.NopCloser(strings.NewReader(`{"deviceID":`))
+
+	router := NewRouter(noopLogger, store)
+	router.ServeHTTP(w, r)
+}
+
+func TestShouldReturnNotAcceptableWhenNoOfferedContentTypeIsAccepted(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+
+	w := mocks.NewMockResponseWriter(mockCtrl)
+	w.EXPECT().WriteHeader(http.StatusNotAcceptable)
+
+	r := createHTTPRequest("GET", "v1/users/kevin")
+	r.Header.Set("Accept", "image/png")
+
+	router := NewRouter(noopLogger, store)
+	router.ServeHTTP(w, r)
+}
+
+func TestShouldReturnBadRequestWhenUserIDIsEmpty(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+
+	w := mocks.NewMockResponseWriter(mockCtrl)
+	w.EXPECT().Header().AnyTimes().Return(http.Header{})
+	w.EXPECT().WriteHeader(http.StatusBadRequest)
+	w.EXPECT().Write(problemWithCodeAndFields(invalidIDCode, map[string]interface{}{"field": "userID"}))
+
+	r := createHTTPRequest("PUT", "v1/users//streams/archery9")
+
+	router := NewRouter(noopLogger, store)
+	router.ServeHTTP(w, r)
+}
+
+func TestShouldReturnBadRequestWhenStreamIDIsEmpty(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+
+	w := mocks.NewMockResponseWriter(mockCtrl)
+	w.EXPECT().Header().AnyTimes().Return(http.Header{})
+	w.EXPECT().WriteHeader(http.StatusBadRequest)
+	w.EXPECT().Write(problemWithCodeAndFields(invalidIDCode, map[string]interface{}{"field": "streamID"}))
+
+	r := createHTTPRequest("DELETE", "v1/users/laura/streams//")
+
+	router := NewRouter(noopLogger, store)
+	router.ServeHTTP(w, r)
+}
+
+func TestShouldReturnStoreUnavailableProblemWhenStoreFails(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+	store.EXPECT().AddStream(gomock.Any(), "martin", "bowls3", gomock.Any()).MinTimes(1).Return(session.Change{}, errors.New("intentional error"))
+
+	header := http.Header{}
+	w := mocks.NewMockResponseWriter(mockCtrl)
+	w.EXPECT().Header().AnyTimes().Return(header)
+	w.EXPECT().WriteHeader(http.StatusInternalServerError)
+	w.EXPECT().Write(problemWithCodeAndFields(storeUnavailableCode, map[string]interface{}{
+		"userID":   "martin",
+		"streamID": "bowls3",
+	}))
+
+	r := createHTTPRequest("PUT", "v1/users/martin/streams/bowls3")
+
+	router := NewRouter(noopLogger, store)
+	router.ServeHTTP(w, r)
+
+	assert.Equal(t, problemContentType, header.Get(contentTypeHeader))
+}
+
+func TestShouldReturnGatewayTimeoutWhenStoreExceedsDeadline(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := mocks.NewMockStore(mockCtrl)
+	store.EXPECT().RenewStream(gomock.Any(), "olive", "judo2").DoAndReturn(
+		func(ctx context.Context, userID, streamID string) (session.Change, error) {
+			<-ctx.Done()
+			return session.Change{}, ctx.Err()
+		},
+	)
+
+	w := mocks.NewMockResponseWriter(mockCtrl)
+	w.EXPECT().Header().AnyTimes().Return(http.Header{})
+	w.EXPECT().WriteHeader(http.StatusGatewayTimeout)
+	w.EXPECT().Write(problemWithCodeAndFields(storeTimeoutCode, map[string]interface{}{"userID": "olive"}))
+
+	r := createHTTPRequest("POST", "v1/users/olive/streams/judo2/heartbeat")
+
+	router := NewRouter(noopLogger, store, WithStoreTimeout(NewStoreTimeout(10*time.Millisecond)))
+	router.ServeHTTP(w, r)
+}
+
+func TestShouldApplyStoreTimeoutChangedWhilstRunning(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	var deadlines []bool
+	store := mocks.NewMockStore(mockCtrl)
+	store.EXPECT().RenewStream(gomock.Any(), "olive", "judo2").Times(2).DoAndReturn(
+		func(ctx context.Context, userID, streamID string) (session.Change, error) {
+			_, ok := ctx.Deadline()
+			deadlines = append(deadlines, ok)
+			return session.Change{}, nil
+		},
+	)
+
+	timeout := NewStoreTimeout(time.Second)
+	router := NewRouter(noopLogger, store, WithStoreTimeout(timeout))
+	router.ServeHTTP(httptest.NewRecorder(), createHTTPRequest("POST", "v1/users/olive/streams/judo2/heartbeat"))
+	timeout.Set(0)
+	router.ServeHTTP(httptest.NewRecorder(), createHTTPRequest("POST", "v1/users/olive/streams/judo2/heartbeat"))
+
+	assert.Equal(t, []bool{true, false}, deadlines)
+}
+
+func TestShouldReturnServiceUnavailableWhenRequestIsCancelled(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	store := NewMemoryStore(NewMemoryQuotas(1), time.Minute)
+
+	w := mocks.NewMockResponseWriter(mockCtrl)
+	w.EXPECT().Header().AnyTimes().Return(http.Header{})
+	w.EXPECT().WriteHeader(http.StatusServiceUnavailable)
+	w.EXPECT().Write(problemWithCodeAndFields(requestCancelledCode, map[string]interface{}{"userID": "pauline"}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := createHTTPRequest("PUT", "v1/users/pauline/streams/rowing1").WithContext(ctx)
+
+	router := NewRouter(noopLogger, store)
+	router.ServeHTTP(w, r)
+}
+
+// problemWithCodeAndFields matches problem bodies with the code and field values
+func problemWithCodeAndFields(code string, fields map[string]interface{}) gomock.Matcher {
+	return problemMatcher{code: code, fields: fields}
+}
+
+type problemMatcher struct {
+	code   string
+	fields map[string]interface{}
+}
+
+func (pm problemMatcher) Matches(x interface{}) bool {
+	data, ok := x.([]byte)
+	if !ok {
+		return false
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return false
+	}
+	if body["code"] != pm.code {
+		return false
+	}
+	for name, value := range pm.fields {
+		if !reflect.DeepEqual(body[name], value) {
+			return false
+		}
+	}
+	return true
+}
+
+func (pm problemMatcher) String() string {
+	return fmt.Sprintf("is problem with code %v and fields %v", pm.code, pm.fields)
+}
+
 func createHTTPRequest(method, url string) *http.Request {
 	req, err := http.NewRequest(
 		method,
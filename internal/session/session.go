@@ -0,0 +1,55 @@
+package session
+
+import (
+	"time"
+)
+
+// Device describes the device on which a user is watching a stream
+type Device struct {
+	DeviceID   string `json:"deviceID,omitempty"`
+	DeviceType string `json:"deviceType,omitempty"`
+	AppVersion string `json:"appVersion,omitempty"`
+	IP         string `json:"ip,omitempty"`
+	UserAgent  string `json:"userAgent,omitempty"`
+}
+
+// Session a stream being watched by a user, the device it is watched on, when it was started and when its lease
+// expires; the start time is zero if it is unknown
+type Session struct {
+	StreamID  string
+	Device    Device
+	StartedAt time.Time
+	ExpiresAt time.Time
+}
+
+const (
+	// StartOperation records a user as watching a stream on a device
+	StartOperation = "start"
+
+	// StopOperation removes the record of a user watching a stream
+	StopOperation = "stop"
+)
+
+// Operation starts or stops a stream being watched by a user as one of a batch; the device is only used when starting
+// a stream
+type Operation struct {
+	Op       string
+	UserID   string
+	StreamID string
+	Device   Device
+}
+
+// Change the changes made to a user's streams by an operation: whether it started a stream that was not already held,
+// renewed a held stream or stopped a held stream, the streams evicted to make room for a started stream and those
+// whose leases were found to have expired
+type Change struct {
+	Changed bool
+	Evicted []string
+	Expired []string
+}
+
+// Result the outcome of an operation: the changes it made to the user's streams, or the error if the operation failed
+type Result struct {
+	Change
+	Err error
+}
@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+	"net/http"
+	"os"
+	"sync"
+)
+
+const (
+	// approximate number of domain events kept in the Redis stream, beyond which the oldest are trimmed
+	domainEventsMaxLen = 100000
+)
+
+// RedisStreamSink appends domain events to a Redis stream, each entry holding the event's type, user and JSON data
+type RedisStreamSink struct {
+	client redis.UniversalClient
+	stream string
+}
+
+// NewRedisStreamSink creates a new sink appending to the key space's domain events stream
+func NewRedisStreamSink(client redis.UniversalClient, keys KeySpace) EventSink {
+	return &RedisStreamSink{
+		client: client,
+		stream: keys.DomainEvents(),
+	}
+}
+
+// Send appends the event to the stream
+func (rs *RedisStreamSink) Send(ctx context.Context, event DomainEvent) error {
+	client, err := withContext(ctx, rs.client)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrap(err, "cannot encode domain event")
+	}
+	cmd := client.XAdd(&redis.XAddArgs{
+		Stream:       rs.stream,
+		MaxLenApprox: domainEventsMaxLen,
+		Values: map[string]interface{}{
+			"type":   event.Type,
+			"userID": event.UserID,
+			"data":   data,
+		},
+	})
+	if err := cmd.Err(); err != nil {
+		return errors.Wrap(err, "failed to add domain event to stream")
+	}
+	return nil
+}
+
+// WebhookSink posts each domain event as JSON to a webhook
+type WebhookSink struct {
+	client *http.Client
+	url    string
+}
+
+// NewWebhookSink creates a new sink posting to the url
+func NewWebhookSink(url string) EventSink {
+	return &WebhookSink{
+		client: &http.Client{},
+		url:    url,
+	}
+}
+
+// Send posts the event, failing unless the webhook returns a successful status
+func (ws *WebhookSink) Send(ctx context.Context, event DomainEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrap(err, "cannot encode domain event")
+	}
+	req, err := http.NewRequest(http.MethodPost, ws.url, bytes.NewReader(data))
+	if err != nil {
+		return errors.Wrap(err, "cannot create webhook request")
+	}
+	req.Header.Set(contentTypeHeader, jsonContentType)
+	resp, err := ws.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(err, "failed to post domain event to webhook")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// FileSink appends domain events to a local file as newline-delimited JSON
+type FileSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFileSink creates a new sink appending to the file at the path, which is created if it does not exist
+func NewFileSink(path string) (*FileSink, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot open domain events file")
+	}
+	return &FileSink{file: file}, nil
+}
+
+// Send appends the event to the file as a single line
+func (fs *FileSink) Send(ctx context.Context, event DomainEvent) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrap(err, "cannot encode domain event")
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if _, err := fs.file.Write(append(data, '\n')); err != nil {
+		return errors.Wrap(err, "failed to write domain event to file")
+	}
+	return nil
+}
+
+// Close closes the file
+func (fs *FileSink) Close() error {
+	return fs.file.Close()
+}
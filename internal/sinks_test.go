@@ -0,0 +1,62 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWebhookSinkShouldPostEventsAsJSON(t *testing.T) {
+	var received DomainEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, jsonContentType, r.Header.Get(contentTypeHeader))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+		if received.UserID == "mallory" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	sink := NewWebhookSink(server.URL)
+	event := DomainEvent{Type: SessionStoppedEvent, UserID: "alan", StreamID: "boxing1", Time: time.Unix(1000, 0).UTC()}
+
+	assert.NoError(t, sink.Send(context.Background(), event))
+	assert.Equal(t, event, received)
+	assert.EqualError(t, sink.Send(context.Background(), DomainEvent{UserID: "mallory"}), "webhook returned status 503")
+}
+
+func TestFileSinkShouldAppendEventsAsNewlineDelimitedJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events.ndjson")
+
+	for _, userID := range []string{"alan", "becky"} {
+		sink, err := NewFileSink(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		event := DomainEvent{Type: SessionStartedEvent, UserID: userID, Time: time.Unix(1000, 0).UTC()}
+		assert.NoError(t, sink.Send(context.Background(), event))
+		assert.NoError(t, sink.Close())
+	}
+
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(
+		t,
+		`{"type":"session_started","userID":"alan","time":"1970-01-01T00:16:40Z"}`+"\n"+
+			`{"type":"session_started","userID":"becky","time":"1970-01-01T00:16:40Z"}`+"\n",
+		string(data),
+	)
+}
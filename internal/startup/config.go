@@ -1,45 +1,394 @@
 package startup
 
 import (
+	"context"
 	"encoding/json"
 	"github.com/hashicorp/consul/api"
+	"github.com/pkg/errors"
+	"github.com/prgodlonton/stream-controller/internal"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
 )
 
 const (
-	// ConsulAddr environment variable holding the consul address
+	// ConsulAddr environment variable holding the consul address; consul is only read when it is set
 	ConsulAddr = "CONSUL_ADDRESS"
 
 	// ConsulKey environment variable holding the key where the config is stored
 	ConsulKey = "CONSUL_KEY"
+
+	// EnvPrefix prefix of the environment variables overriding individual settings, e.g. STREAMCTL_REDIS_ADDRESS
+	EnvPrefix = "STREAMCTL_"
+)
+
+const (
+	// MemoryStoreType keeps streams in memory; only suitable for a single server
+	MemoryStoreType = "memory"
+
+	// RedisStoreType keeps streams in a Redis server
+	RedisStoreType = "redis"
+)
+
+const (
+	// RedisSingleMode connects to a single Redis server
+	RedisSingleMode = "single"
+
+	// RedisSentinelMode connects to the master of a Redis server monitored by sentinels
+	RedisSentinelMode = "sentinel"
+
+	// RedisClusterMode connects to a Redis cluster
+	RedisClusterMode = "cluster"
+)
+
+const (
+	// NoPublishSink does not publish domain events
+	NoPublishSink = "none"
+
+	// RedisPublishSink publishes domain events to a Redis stream
+	RedisPublishSink = "redis"
+
+	// WebhookPublishSink posts domain events to a webhook
+	WebhookPublishSink = "webhook"
+
+	// FilePublishSink appends domain events to a newline-delimited JSON file
+	FilePublishSink = "file"
 )
 
 // Config holds all configuration
 type Config struct {
-	Redis  Redis  `json:"redis"`
-	Server Server `json:"server"`
+	Auth        Auth        `json:"auth" yaml:"auth"`
+	Idempotency Idempotency `json:"idempotency" yaml:"idempotency"`
+	IDs         IDs         `json:"ids" yaml:"ids"`
+	Log         Log         `json:"log" yaml:"log"`
+	Publish     Publish     `json:"publish" yaml:"publish"`
+	Quota       Quota       `json:"quota" yaml:"quota"`
+	Redis       Redis       `json:"redis" yaml:"redis"`
+	Server      Server      `json:"server" yaml:"server"`
+	Store       Store       `json:"store" yaml:"store"`
+	Stream      Stream      `json:"stream" yaml:"stream"`
+}
+
+// Auth holds caller authentication configuration; the max token lifetime is the number of seconds within which tokens
+// must expire and is not checked if it is 0
+type Auth struct {
+	Enabled          bool   `json:"enabled" yaml:"enabled"`
+	Secret           string `json:"secret" yaml:"secret"`
+	JWKSFile         string `json:"jwks-file" yaml:"jwks-file"`
+	ServiceRole      string `json:"service-role" yaml:"service-role"`
+	AdminRole        string `json:"admin-role" yaml:"admin-role"`
+	MaxTokenLifetime int    `json:"max-token-lifetime" yaml:"max-token-lifetime"`
+}
+
+// Idempotency holds the configuration of requests retried with idempotency keys; the ttl is the number of seconds
+// for which responses are replayed and responses are not recorded if it is 0
+type Idempotency struct {
+	TTL int `json:"ttl" yaml:"ttl"`
+}
+
+// IDs holds the rules checked of user and stream IDs before they reach the store; the max length is in bytes and the
+// pattern is a regular expression, which is not checked if empty
+type IDs struct {
+	MaxLength     int    `json:"max-length" yaml:"max-length"`
+	Pattern       string `json:"pattern" yaml:"pattern"`
+	UUIDUserIDs   bool   `json:"uuid-user-ids" yaml:"uuid-user-ids"`
+	UUIDStreamIDs bool   `json:"uuid-stream-ids" yaml:"uuid-stream-ids"`
+}
+
+// Log holds logging configuration
+type Log struct {
+	Level string `json:"level" yaml:"level"`
+}
+
+// Publish holds domain event publishing configuration; the url is that of the webhook sink and the path that of the
+// file sink
+type Publish struct {
+	Sink      string `json:"sink" yaml:"sink"`
+	URL       string `json:"url" yaml:"url"`
+	Path      string `json:"path" yaml:"path"`
+	QueueSize int    `json:"queue-size" yaml:"queue-size"`
+	Retries   int    `json:"retries" yaml:"retries"`
+}
+
+// Quota holds stream quota configuration; the device limits are comma-separated limits of each device type, e.g.
+// "mobile=1,tv=2", and the eviction policy is one of reject, evict-oldest or evict-idle
+type Quota struct {
+	DefaultLimit    int    `json:"default-limit" yaml:"default-limit"`
+	RejectionStatus int    `json:"rejection-status" yaml:"rejection-status"`
+	LegacyRejection bool   `json:"legacy-rejection" yaml:"legacy-rejection"`
+	DeviceLimits    string `json:"device-limits" yaml:"device-limits"`
+	EvictionPolicy  string `json:"eviction-policy" yaml:"eviction-policy"`
 }
 
-// Redis holds redis server configuration
+// Redis holds redis server configuration; the address of sentinels and clusters is a comma-separated list of seed
+// addresses
 type Redis struct {
-	Address  string `json:"address"`
-	Password string `json:"password"`
-	DB       int    `json:"db"`
+	Mode       string `json:"mode" yaml:"mode"`
+	Address    string `json:"address" yaml:"address"`
+	MasterName string `json:"master-name" yaml:"master-name"`
+	Password   string `json:"password" yaml:"password"`
+	DB         int    `json:"db" yaml:"db"`
+	KeyPrefix  string `json:"key-prefix" yaml:"key-prefix"`
 }
 
-// Server holds server-specific configuration
+// Server holds server-specific configuration; the gRPC server is not started if its address is empty
 type Server struct {
-	Address         string `json:"address"`
-	ShutdownTimeout int    `json:"shutdown-timeout"`
+	Address          string `json:"address" yaml:"address"`
+	GRPCAddress      string `json:"grpc-address" yaml:"grpc-address"`
+	DrainDelay       int    `json:"drain-delay" yaml:"drain-delay"`
+	ReadinessTimeout int    `json:"readiness-timeout" yaml:"readiness-timeout"`
+	ShutdownTimeout  int    `json:"shutdown-timeout" yaml:"shutdown-timeout"`
+}
+
+// Store holds stream store configuration; expired leases are only removed by requests for their users if the sweep
+// interval is zero
+type Store struct {
+	Type            string `json:"type" yaml:"type"`
+	TimeoutMS       int    `json:"timeout-ms" yaml:"timeout-ms"`
+	SweepIntervalMS int    `json:"sweep-interval-ms" yaml:"sweep-interval-ms"`
+}
+
+// Stream holds stream session configuration
+type Stream struct {
+	LeaseDuration int `json:"lease-duration" yaml:"lease-duration"`
+}
+
+// DefaultConfig returns the configuration used for settings that are not provided
+func DefaultConfig() *Config {
+	return &Config{
+		Auth: Auth{
+			ServiceRole: "service",
+			AdminRole:   "admin",
+		},
+		Idempotency: Idempotency{
+			TTL: 86400,
+		},
+		IDs: IDs{
+			MaxLength: internal.DefaultMaxIDLength,
+			Pattern:   internal.DefaultIDPattern,
+		},
+		Log: Log{
+			Level: "debug",
+		},
+		Publish: Publish{
+			Sink:      NoPublishSink,
+			QueueSize: 1000,
+			Retries:   3,
+		},
+		Quota: Quota{
+			DefaultLimit:    3,
+			RejectionStatus: http.StatusConflict,
+			EvictionPolicy:  string(internal.RejectPolicy),
+		},
+		Redis: Redis{
+			Mode:      RedisSingleMode,
+			Address:   "localhost:6379",
+			KeyPrefix: "sc",
+		},
+		Server: Server{
+			Address:          "0.0.0.0:8080",
+			GRPCAddress:      "0.0.0.0:9090",
+			ReadinessTimeout: 1,
+			ShutdownTimeout:  5,
+		},
+		Store: Store{
+			Type:            RedisStoreType,
+			TimeoutMS:       1000,
+			SweepIntervalMS: 30000,
+		},
+		Stream: Stream{
+			LeaseDuration: 60,
+		},
+	}
+}
+
+// ReadConfiguration returns the default configuration overlaid in turn by the JSON or YAML file at the path, if
+// given, then the Consul KV store, if its address is set, and finally the STREAMCTL_* environment variables
+func ReadConfiguration(path string) (*Config, error) {
+	var consulValue []byte
+	if consulAddress := os.Getenv(ConsulAddr); consulAddress != "" {
+		kv, err := getConsulKV(consulAddress)
+		if err != nil {
+			return nil, err
+		}
+		consulKey := getConsulKey()
+		pair, _, err := kv.Get(consulKey, &api.QueryOptions{})
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot read consul key %v", consulKey)
+		}
+		if pair == nil {
+			return nil, errors.Errorf("consul key %v not found", consulKey)
+		}
+		consulValue = pair.Value
+	}
+	return buildConfiguration(path, consulValue)
+}
+
+// buildConfiguration overlays the defaults with the file at the path, the consul value and the environment
+// variables, in that order, and validates the result; the path and consul value are optional
+func buildConfiguration(path string, consulValue []byte) (*Config, error) {
+	config := DefaultConfig()
+	if path != "" {
+		if err := readFileConfig(config, path); err != nil {
+			return nil, err
+		}
+	}
+	if consulValue != nil {
+		if err := json.Unmarshal(consulValue, config); err != nil {
+			return nil, errors.Wrapf(err, "cannot parse consul key %v", getConsulKey())
+		}
+	}
+	if err := readEnvConfig(config, EnvPrefix, os.LookupEnv); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Validate returns an error describing every invalid setting
+func (c *Config) Validate() error {
+	var problems []string
+	if c.Auth.Enabled && c.Auth.Secret == "" && c.Auth.JWKSFile == "" {
+		problems = append(problems, "auth.secret or auth.jwks-file is required when auth is enabled")
+	}
+	if c.Auth.MaxTokenLifetime < 0 {
+		problems = append(problems, "auth.max-token-lifetime must not be negative")
+	}
+	if c.Idempotency.TTL < 0 {
+		problems = append(problems, "idempotency.ttl must not be negative")
+	}
+	if c.IDs.MaxLength < 1 {
+		problems = append(problems, "ids.max-length must be at least 1")
+	}
+	if _, err := regexp.Compile(c.IDs.Pattern); err != nil {
+		problems = append(problems, "ids.pattern must be a valid regular expression")
+	}
+	var level zapcore.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		problems = append(problems, "log.level must be one of debug, info, warn, error, dpanic, panic or fatal")
+	}
+	switch c.Publish.Sink {
+	case NoPublishSink:
+	case RedisPublishSink:
+		if c.Store.Type != RedisStoreType {
+			problems = append(problems, "publish.sink may only be redis for the redis store")
+		}
+	case WebhookPublishSink:
+		if u, err := url.Parse(c.Publish.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			problems = append(problems, "publish.url must be an http or https url for the webhook sink")
+		}
+	case FilePublishSink:
+		if c.Publish.Path == "" {
+			problems = append(problems, "publish.path is required for the file sink")
+		}
+	default:
+		problems = append(problems, "publish.sink must be one of none, redis, webhook or file")
+	}
+	if c.Publish.QueueSize < 1 {
+		problems = append(problems, "publish.queue-size must be at least 1")
+	}
+	if c.Publish.Retries < 0 {
+		problems = append(problems, "publish.retries must not be negative")
+	}
+	if c.Quota.DefaultLimit < 1 {
+		problems = append(problems, "quota.default-limit must be at least 1")
+	}
+	if _, err := parseDeviceLimits(c.Quota.DeviceLimits); err != nil {
+		problems = append(problems, "quota.device-limits "+err.Error())
+	}
+	switch internal.EvictionPolicy(c.Quota.EvictionPolicy) {
+	case internal.RejectPolicy, internal.EvictOldestPolicy, internal.EvictIdlePolicy:
+	default:
+		problems = append(problems, "quota.eviction-policy must be one of reject, evict-oldest or evict-idle")
+	}
+	if c.Quota.RejectionStatus < 400 || c.Quota.RejectionStatus > 499 {
+		problems = append(problems, "quota.rejection-status must be a 4xx status code")
+	}
+	switch c.Store.Type {
+	case MemoryStoreType:
+	case RedisStoreType:
+		if c.Redis.Address == "" {
+			problems = append(problems, "redis.address is required for the redis store")
+		}
+		// an empty prefix would name the quotas hash after the legacy hash replaced by the key migration
+		if c.Redis.KeyPrefix == "" {
+			problems = append(problems, "redis.key-prefix is required for the redis store")
+		}
+		switch c.Redis.Mode {
+		case RedisSingleMode, RedisClusterMode:
+		case RedisSentinelMode:
+			if c.Redis.MasterName == "" {
+				problems = append(problems, "redis.master-name is required in sentinel mode")
+			}
+		default:
+			problems = append(problems, "redis.mode must be one of single, sentinel or cluster")
+		}
+	default:
+		problems = append(problems, "store.type must be one of memory or redis")
+	}
+	if c.Store.TimeoutMS < 1 {
+		problems = append(problems, "store.timeout-ms must be at least 1")
+	}
+	// the keys of users are kept for ten minutes after their last lease expires so that sweeps find them
+	if c.Store.SweepIntervalMS < 0 || c.Store.SweepIntervalMS >= 600000 {
+		problems = append(problems, "store.sweep-interval-ms must be at least 0 and less than 600000")
+	}
+	if c.Server.Address == "" {
+		problems = append(problems, "server.address is required")
+	}
+	if c.Server.GRPCAddress != "" && c.Server.GRPCAddress == c.Server.Address {
+		problems = append(problems, "server.grpc-address must differ from server.address")
+	}
+	if c.Server.DrainDelay < 0 {
+		problems = append(problems, "server.drain-delay must not be negative")
+	}
+	if c.Server.ReadinessTimeout < 1 {
+		problems = append(problems, "server.readiness-timeout must be at least 1")
+	}
+	if c.Server.ShutdownTimeout < 0 {
+		problems = append(problems, "server.shutdown-timeout must not be negative")
+	}
+	if c.Stream.LeaseDuration < 1 {
+		problems = append(problems, "stream.lease-duration must be at least 1")
+	}
+	if len(problems) > 0 {
+		return errors.Errorf("invalid configuration: %v", strings.Join(problems, "; "))
+	}
+	return nil
 }
 
-// Returns the configuration held in Consul KV store
-func ReadConfiguration() *Config {
-	consulAddress := getEnvValue(ConsulAddr, "http://localhost:8500")
-	consulKey := getEnvValue(ConsulKey, "services/stream-control")
+// parseDeviceLimits parses comma-separated device type limits, e.g. "mobile=1,tv=2"
+func parseDeviceLimits(value string) (map[string]int, error) {
+	limits := make(map[string]int)
+	if strings.TrimSpace(value) == "" {
+		return limits, nil
+	}
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, errors.New("must be comma-separated device type limits, e.g. mobile=1,tv=2")
+		}
+		limit, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || limit < 0 {
+			return nil, errors.Errorf("must give a non-negative limit for %v", strings.TrimSpace(parts[0]))
+		}
+		limits[strings.TrimSpace(parts[0])] = limit
+	}
+	return limits, nil
+}
 
-	kv := getConsulKV(consulAddress)
-	return getConsulConfig(kv, consulKey)
+func getConsulKey() string {
+	return getEnvValue(ConsulKey, "services/stream-control")
 }
 
 func getEnvValue(key, fallback string) string {
@@ -49,26 +398,112 @@ func getEnvValue(key, fallback string) string {
 	return fallback
 }
 
-func getConsulKV(address string) *api.KV {
+func readFileConfig(config *Config, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Wrap(err, "cannot read configuration file")
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(data, config)
+	default:
+		err = json.Unmarshal(data, config)
+	}
+	return errors.Wrapf(err, "cannot parse configuration file %v", path)
+}
+
+func getConsulKV(address string) (*api.KV, error) {
 	client, err := api.NewClient(
 		&api.Config{
 			Address: address,
 		},
 	)
 	if err != nil {
-		panic(err)
+		return nil, errors.Wrap(err, "cannot create consul client")
 	}
-	return client.KV()
+	return client.KV(), nil
 }
 
-func getConsulConfig(store *api.KV, consulKey string) *Config {
-	pair, _, err := store.Get(consulKey, &api.QueryOptions{})
-	if err != nil {
-		panic(err)
+// consulHealthCheck returns the check that the key holding the configuration can be read from Consul
+func consulHealthCheck(kv *api.KV) internal.HealthCheck {
+	return func(ctx context.Context) error {
+		consulKey := getConsulKey()
+		if _, _, err := kv.Get(consulKey, (&api.QueryOptions{}).WithContext(ctx)); err != nil {
+			return errors.Wrapf(err, "cannot read consul key %v", consulKey)
+		}
+		return nil
 	}
-	var config Config
-	if err := json.Unmarshal(pair.Value, &config); err != nil {
-		panic(err)
+}
+
+// readEnvConfig overrides each setting having an environment variable named after the prefix and its section and
+// json key, e.g. STREAMCTL_QUOTA_DEFAULT_LIMIT for quota.default-limit
+func readEnvConfig(config *Config, prefix string, lookup func(string) (string, bool)) error {
+	return forEachSetting(config, func(name string, field reflect.Value) error {
+		envName := prefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(name))
+		value, ok := lookup(envName)
+		if !ok {
+			return nil
+		}
+		return errors.Wrapf(setField(field, value), "invalid value for environment variable %v", envName)
+	})
+}
+
+// changedSettings returns the names of the settings whose values differ between the configurations
+func changedSettings(current, updated *Config) []string {
+	values := make(map[string]interface{})
+	forEachSetting(current, func(name string, field reflect.Value) error {
+		values[name] = field.Interface()
+		return nil
+	})
+
+	var changed []string
+	forEachSetting(updated, func(name string, field reflect.Value) error {
+		if values[name] != field.Interface() {
+			changed = append(changed, name)
+		}
+		return nil
+	})
+	return changed
+}
+
+// forEachSetting calls the function with the name, e.g. quota.default-limit, and value of every setting
+func forEachSetting(config *Config, fn func(name string, field reflect.Value) error) error {
+	sections := reflect.ValueOf(config).Elem()
+	for i := 0; i < sections.NumField(); i++ {
+		section := sections.Field(i)
+		sectionName := settingName(sections.Type().Field(i))
+		for j := 0; j < section.NumField(); j++ {
+			name := sectionName + "." + settingName(section.Type().Field(j))
+			if err := fn(name, section.Field(j)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func settingName(field reflect.StructField) string {
+	return strings.Split(field.Tag.Get("json"), ",")[0]
+}
+
+func setField(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int:
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(i))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	default:
+		return errors.Errorf("unsupported setting type %v", field.Kind())
 	}
-	return &config
+	return nil
 }
@@ -0,0 +1,204 @@
+package startup
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestShouldOverlayFileConfigurationOnDefaults(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.yaml")
+	data := []byte("quota:\n  default-limit: 4\nstore:\n  type: memory\n")
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := DefaultConfig()
+	expected.Quota.DefaultLimit = 4
+	expected.Store.Type = MemoryStoreType
+
+	config, err := ReadConfiguration(path)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, config)
+}
+
+func TestShouldReturnErrorWhenConfigurationFileIsMissing(t *testing.T) {
+	_, err := ReadConfiguration(filepath.Join(os.TempDir(), "missing-stream-controller-config.json"))
+	assert.Error(t, err)
+}
+
+func TestShouldOverrideSettingsWithEnvironmentVariables(t *testing.T) {
+	env := map[string]string{
+		"STREAMCTL_REDIS_ADDRESS":          "redis:6380",
+		"STREAMCTL_QUOTA_DEFAULT_LIMIT":    "2",
+		"STREAMCTL_QUOTA_LEGACY_REJECTION": "true",
+	}
+	lookup := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+
+	config := DefaultConfig()
+	assert.NoError(t, readEnvConfig(config, EnvPrefix, lookup))
+	assert.Equal(t, "redis:6380", config.Redis.Address)
+	assert.Equal(t, 2, config.Quota.DefaultLimit)
+	assert.True(t, config.Quota.LegacyRejection)
+}
+
+func TestShouldReturnErrorWhenEnvironmentVariableIsInvalid(t *testing.T) {
+	lookup := func(name string) (string, bool) {
+		return "three", name == "STREAMCTL_QUOTA_DEFAULT_LIMIT"
+	}
+
+	err := readEnvConfig(DefaultConfig(), EnvPrefix, lookup)
+	assert.EqualError(t, err, `invalid value for environment variable STREAMCTL_QUOTA_DEFAULT_LIMIT: strconv.Atoi: parsing "three": invalid syntax`)
+}
+
+func TestShouldReportEveryInvalidSetting(t *testing.T) {
+	config := DefaultConfig()
+	config.Quota.DefaultLimit = 0
+	config.Store.Type = "postgres"
+
+	err := config.Validate()
+	assert.EqualError(t, err, "invalid configuration: quota.default-limit must be at least 1; store.type must be one of memory or redis")
+}
+
+func TestShouldRequireMasterNameInSentinelMode(t *testing.T) {
+	config := DefaultConfig()
+	config.Redis.Mode = RedisSentinelMode
+	config.Redis.Address = "sentinel-1:26379,sentinel-2:26379"
+
+	err := config.Validate()
+	assert.EqualError(t, err, "invalid configuration: redis.master-name is required in sentinel mode")
+
+	config.Redis.MasterName = "stream-controller"
+	assert.NoError(t, config.Validate())
+}
+
+func TestShouldRequireKeyPrefixForRedisStore(t *testing.T) {
+	config := DefaultConfig()
+	config.Redis.KeyPrefix = ""
+
+	err := config.Validate()
+	assert.EqualError(t, err, "invalid configuration: redis.key-prefix is required for the redis store")
+
+	config.Store.Type = MemoryStoreType
+	assert.NoError(t, config.Validate())
+}
+
+func TestShouldParseDeviceLimits(t *testing.T) {
+	limits, err := parseDeviceLimits("mobile=1, tv = 2")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"mobile": 1, "tv": 2}, limits)
+
+	config := DefaultConfig()
+	config.Quota.DeviceLimits = "mobile=1,tv=-2"
+	assert.EqualError(t, config.Validate(), "invalid configuration: quota.device-limits must give a non-negative limit for tv")
+
+	config.Quota.DeviceLimits = "mobile"
+	assert.EqualError(t, config.Validate(), "invalid configuration: quota.device-limits must be comma-separated device type limits, e.g. mobile=1,tv=2")
+}
+
+func TestShouldRejectUnknownEvictionPolicy(t *testing.T) {
+	config := DefaultConfig()
+	config.Quota.EvictionPolicy = "evict-newest"
+
+	err := config.Validate()
+	assert.EqualError(t, err, "invalid configuration: quota.eviction-policy must be one of reject, evict-oldest or evict-idle")
+
+	config.Quota.EvictionPolicy = "evict-idle"
+	assert.NoError(t, config.Validate())
+}
+
+func TestShouldRequireDestinationOfPublishSink(t *testing.T) {
+	config := DefaultConfig()
+	config.Publish.Sink = WebhookPublishSink
+	config.Publish.URL = "analytics:8080/events"
+
+	err := config.Validate()
+	assert.EqualError(t, err, "invalid configuration: publish.url must be an http or https url for the webhook sink")
+
+	config.Publish.URL = "http://analytics:8080/events"
+	assert.NoError(t, config.Validate())
+
+	config.Publish.Sink = RedisPublishSink
+	config.Store.Type = MemoryStoreType
+	err = config.Validate()
+	assert.EqualError(t, err, "invalid configuration: publish.sink may only be redis for the redis store")
+}
+
+func TestShouldRequireDistinctGRPCAddress(t *testing.T) {
+	config := DefaultConfig()
+	config.Server.GRPCAddress = config.Server.Address
+
+	err := config.Validate()
+	assert.EqualError(t, err, "invalid configuration: server.grpc-address must differ from server.address")
+
+	config.Server.GRPCAddress = ""
+	assert.NoError(t, config.Validate())
+}
+
+func TestShouldRejectNegativeIdempotencyTTL(t *testing.T) {
+	config := DefaultConfig()
+	config.Idempotency.TTL = -1
+
+	err := config.Validate()
+	assert.EqualError(t, err, "invalid configuration: idempotency.ttl must not be negative")
+
+	config.Idempotency.TTL = 0
+	assert.NoError(t, config.Validate())
+}
+
+func TestShouldRejectSweepIntervalOutsideKeyRetention(t *testing.T) {
+	config := DefaultConfig()
+	config.Store.SweepIntervalMS = 600000
+
+	err := config.Validate()
+	assert.EqualError(t, err, "invalid configuration: store.sweep-interval-ms must be at least 0 and less than 600000")
+
+	config.Store.SweepIntervalMS = 0
+	assert.NoError(t, config.Validate())
+}
+
+func TestShouldRejectInvalidIDRules(t *testing.T) {
+	config := DefaultConfig()
+	config.IDs.MaxLength = 0
+	config.IDs.Pattern = "^[a-z"
+
+	err := config.Validate()
+	assert.EqualError(t, err, "invalid configuration: ids.max-length must be at least 1; ids.pattern must be a valid regular expression")
+
+	config.IDs.MaxLength = 36
+	config.IDs.Pattern = ""
+	config.IDs.UUIDUserIDs = true
+	assert.NoError(t, config.Validate())
+}
+
+func TestShouldCheckThatConsulKeyCanBeRead(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/kv/services/stream-control", r.URL.Path)
+		w.WriteHeader(status)
+		w.Write([]byte(`[{"Key":"services/stream-control","Value":"e30="}]`))
+	}))
+	defer server.Close()
+
+	kv, err := getConsulKV(server.URL)
+	assert.NoError(t, err)
+	check := consulHealthCheck(kv)
+	assert.NoError(t, check(context.Background()))
+
+	status = http.StatusInternalServerError
+	assert.Error(t, check(context.Background()))
+}
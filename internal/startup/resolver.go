@@ -4,82 +4,442 @@ import (
 	"github.com/go-redis/redis"
 	"github.com/pkg/errors"
 	"github.com/prgodlonton/stream-controller/internal"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"google.golang.org/grpc"
 	"net/http"
+	"os"
+	"strings"
+	"sync"
 	"time"
 )
 
+// settings applied whilst the service is running; changes to any other setting require a restart
+var liveSettings = map[string]bool{
+	"log.level":                true,
+	"quota.default-limit":      true,
+	"quota.device-limits":      true,
+	"quota.eviction-policy":    true,
+	"server.drain-delay":       true,
+	"server.readiness-timeout": true,
+	"server.shutdown-timeout":  true,
+	"store.timeout-ms":         true,
+}
+
 // Resolver resolves all dependencies and handles dependency injection
 type Resolver struct {
+	mu     sync.RWMutex
 	config *Config
+	level  zap.AtomicLevel
 
 	// singletons
-	client *redis.Client
-	logger *zap.SugaredLogger
-	server *http.Server
+	authenticator *internal.Authenticator
+	client        redis.UniversalClient
+	grpcServer    *grpc.Server
+	health        *internal.Health
+	idempotency   internal.IdempotencyStore
+	ids           *internal.IDValidator
+	logger        *zap.SugaredLogger
+	metrics       *internal.Metrics
+	notifier      internal.Notifier
+	publisher     *internal.AsyncPublisher
+	quotas        internal.AdjustableQuotas
+	registry      *prometheus.Registry
+	server        *http.Server
+	store         internal.Store
+	storeTimeout  *internal.StoreTimeout
+	sweeper       *internal.Sweeper
 }
 
 // NewResolver returns a new resolver
 func NewResolver(config *Config) *Resolver {
 	resolver := &Resolver{
 		config: config,
+		level:  zap.NewAtomicLevelAt(parseLevel(config.Log.Level)),
 	}
 	resolver.resolveEager()
 	return resolver
 }
 
+// Config returns the current configuration
+func (r *Resolver) Config() *Config {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.config
+}
+
+// Reconfigure applies the changed settings that can be applied whilst the service is running and returns the names
+// of the changed settings that only take effect after a restart; the Resolve methods read the configuration without
+// the lock, so it must only be called once every dependency is resolved
+func (r *Resolver) Reconfigure(config *Config) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var restart []string
+	for _, name := range changedSettings(r.config, config) {
+		if !liveSettings[name] {
+			restart = append(restart, name)
+		}
+	}
+
+	r.level.SetLevel(parseLevel(config.Log.Level))
+	r.ResolveQuotas().SetDefaultLimit(config.Quota.DefaultLimit)
+	r.ResolveQuotas().SetDeviceLimits(deviceLimits(config))
+	r.ResolveQuotas().SetEvictionPolicy(internal.EvictionPolicy(config.Quota.EvictionPolicy))
+	r.ResolveHealth().SetTimeout(time.Duration(config.Server.ReadinessTimeout) * time.Second)
+	r.ResolveStoreTimeout().Set(time.Duration(config.Store.TimeoutMS) * time.Millisecond)
+	r.config = config
+	return restart
+}
+
 func (r *Resolver) resolveEager() {
 	r.ResolveLogger()
-	r.ResolveRedisClient()
+	r.ResolveStore()
 	r.ResolveServer()
+	r.ResolveGRPCServer()
+}
+
+func (r *Resolver) ResolveAuthenticator() *internal.Authenticator {
+	if r.authenticator == nil && r.config.Auth.Enabled {
+		var keys map[string]interface{}
+		if r.config.Auth.JWKSFile != "" {
+			var err error
+			if keys, err = internal.LoadJWKS(r.config.Auth.JWKSFile); err != nil {
+				panic(errors.Wrap(err, "resolver: failed to load jwks file"))
+			}
+		}
+		r.authenticator = internal.NewAuthenticator(
+			[]byte(r.config.Auth.Secret),
+			keys,
+			r.config.Auth.ServiceRole,
+			r.config.Auth.AdminRole,
+			time.Duration(r.config.Auth.MaxTokenLifetime)*time.Second,
+		)
+	}
+	return r.authenticator
+}
+
+// ResolveGRPCServer returns the gRPC server, or nil if no gRPC address is configured
+func (r *Resolver) ResolveGRPCServer() *grpc.Server {
+	if r.grpcServer == nil && r.config.Server.GRPCAddress != "" {
+		r.grpcServer = internal.NewGRPCServer(
+			r.ResolveLogger(),
+			r.ResolveStore(),
+			internal.WithAuthenticator(r.ResolveAuthenticator()),
+			internal.WithIDValidator(r.ResolveIDValidator()),
+			internal.WithNotifier(r.ResolveNotifier()),
+			internal.WithStoreTimeout(r.ResolveStoreTimeout()),
+		)
+	}
+	return r.grpcServer
+}
+
+func (r *Resolver) ResolveHealth() *internal.Health {
+	if r.health == nil {
+		checks := map[string]internal.HealthCheck{}
+		if r.config.Store.Type == RedisStoreType {
+			checks["redis"] = internal.RedisHealthCheck(r.ResolveRedisClient())
+		}
+		if consulAddress := os.Getenv(ConsulAddr); consulAddress != "" {
+			kv, err := getConsulKV(consulAddress)
+			if err != nil {
+				panic(errors.Wrap(err, "resolver: failed to create consul client"))
+			}
+			checks["consul"] = consulHealthCheck(kv)
+		}
+		r.health = internal.NewHealth(
+			time.Duration(r.config.Server.ReadinessTimeout)*time.Second,
+			checks,
+		)
+	}
+	return r.health
+}
+
+// ResolveIdempotencyStore returns the store of responses replayed for idempotency keys, or nil if they are not
+// recorded
+func (r *Resolver) ResolveIdempotencyStore() internal.IdempotencyStore {
+	if r.idempotency == nil && r.config.Idempotency.TTL > 0 {
+		ttl := time.Duration(r.config.Idempotency.TTL) * time.Second
+		if r.config.Store.Type == MemoryStoreType {
+			r.idempotency = internal.NewMemoryIdempotencyStore(ttl)
+		} else {
+			r.idempotency = internal.NewRedisIdempotencyStore(r.ResolveRedisClient(), r.ResolveKeySpace(), ttl)
+		}
+	}
+	return r.idempotency
+}
+
+func (r *Resolver) ResolveIDValidator() *internal.IDValidator {
+	if r.ids == nil {
+		ids, err := internal.NewIDValidator(
+			r.config.IDs.MaxLength,
+			r.config.IDs.Pattern,
+			r.config.IDs.UUIDUserIDs,
+			r.config.IDs.UUIDStreamIDs,
+		)
+		if err != nil {
+			panic(errors.Wrap(err, "resolver: invalid id rules"))
+		}
+		r.ids = ids
+	}
+	return r.ids
+}
+
+func (r *Resolver) ResolveKeySpace() internal.KeySpace {
+	return internal.NewKeySpace(r.config.Redis.KeyPrefix)
 }
 
 func (r *Resolver) ResolveLogger() *zap.SugaredLogger {
 	if r.logger == nil {
-		logger, _ := zap.NewDevelopment()
-		r.logger = logger.Sugar()
+		r.logger = newLogger(r.level)
 	}
 	return r.logger
 }
 
-func (r *Resolver) ResolveRedisClient() *redis.Client {
-	if r.client == nil {
-		r.client = redis.NewClient(
-			&redis.Options{
-				Addr:     r.config.Redis.Address,
-				Password: r.config.Redis.Password,
-				DB:       r.config.Redis.DB,
-			},
+func (r *Resolver) ResolveMetrics() *internal.Metrics {
+	if r.metrics == nil {
+		r.metrics = internal.NewMetrics(r.ResolveRegistry())
+	}
+	return r.metrics
+}
+
+func (r *Resolver) ResolveNotifier() internal.Notifier {
+	if r.notifier == nil {
+		if r.config.Store.Type == MemoryStoreType {
+			r.notifier = internal.NewMemoryNotifier()
+		} else {
+			notifier, err := internal.NewRedisNotifier(r.ResolveLogger(), r.ResolveRedisClient(), r.ResolveKeySpace())
+			if err != nil {
+				panic(errors.Wrap(err, "resolver: failed to subscribe to redis events channel"))
+			}
+			r.notifier = notifier
+		}
+	}
+	return r.notifier
+}
+
+// ResolvePublisher returns the publisher of domain events, or nil if they are not published
+func (r *Resolver) ResolvePublisher() *internal.AsyncPublisher {
+	if r.publisher == nil && r.config.Publish.Sink != NoPublishSink {
+		var sink internal.EventSink
+		switch r.config.Publish.Sink {
+		case RedisPublishSink:
+			sink = internal.NewRedisStreamSink(r.ResolveRedisClient(), r.ResolveKeySpace())
+		case WebhookPublishSink:
+			sink = internal.NewWebhookSink(r.config.Publish.URL)
+		case FilePublishSink:
+			fileSink, err := internal.NewFileSink(r.config.Publish.Path)
+			if err != nil {
+				panic(errors.Wrap(err, "resolver: failed to open domain events file"))
+			}
+			sink = fileSink
+		default:
+			panic(errors.Errorf("resolver: unknown publish sink %q", r.config.Publish.Sink))
+		}
+		r.publisher = internal.NewAsyncPublisher(
+			r.ResolveLogger(),
+			sink,
+			r.config.Publish.QueueSize,
+			r.config.Publish.Retries,
+		)
+	}
+	return r.publisher
+}
+
+// ResolveRegistry returns the registry of the metrics served on /metrics, which is owned by the resolver so that
+// several resolvers may be created in one process
+func (r *Resolver) ResolveRegistry() *prometheus.Registry {
+	if r.registry == nil {
+		r.registry = prometheus.NewRegistry()
+		r.registry.MustRegister(
+			prometheus.NewGoCollector(),
+			prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
 		)
-		if _, err := r.client.Ping().Result(); err != nil {
-			panic(errors.Wrap(err, "resolver: failed to ping redis server"))
+	}
+	return r.registry
+}
+
+func (r *Resolver) ResolveQuotas() internal.AdjustableQuotas {
+	if r.quotas == nil {
+		if r.config.Store.Type == MemoryStoreType {
+			r.quotas = internal.NewMemoryQuotas(r.config.Quota.DefaultLimit)
+		} else {
+			r.quotas = internal.NewRedisQuotas(
+				r.ResolveRedisClient(),
+				r.ResolveKeySpace(),
+				r.config.Quota.DefaultLimit,
+			)
 		}
+		r.quotas.SetDeviceLimits(deviceLimits(r.config))
+		r.quotas.SetEvictionPolicy(internal.EvictionPolicy(r.config.Quota.EvictionPolicy))
+	}
+	return r.quotas
+}
+
+func (r *Resolver) ResolveRedisClient() redis.UniversalClient {
+	if r.client == nil {
+		client, err := NewRedisClient(r.config)
+		if err != nil {
+			panic(errors.Wrap(err, "resolver"))
+		}
+		r.client = client
 	}
 	return r.client
 }
 
 func (r *Resolver) ResolveRouter() http.Handler {
+	rejectionStatus := r.config.Quota.RejectionStatus
+	if r.config.Quota.LegacyRejection {
+		rejectionStatus = http.StatusBadRequest
+	}
 	return internal.NewRouter(
 		r.ResolveLogger(),
 		r.ResolveStore(),
+		internal.WithAuthenticator(r.ResolveAuthenticator()),
+		internal.WithHealth(r.ResolveHealth()),
+		internal.WithIDValidator(r.ResolveIDValidator()),
+		internal.WithIdempotency(r.ResolveIdempotencyStore()),
+		internal.WithMetrics(r.ResolveMetrics()),
+		internal.WithNotifier(r.ResolveNotifier()),
+		internal.WithQuotaExceededStatus(rejectionStatus),
+		internal.WithStoreTimeout(r.ResolveStoreTimeout()),
 	)
 }
 
 func (r *Resolver) ResolveServer() *http.Server {
 	if r.server == nil {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.HandlerFor(r.ResolveRegistry(), promhttp.HandlerOpts{}))
+		mux.Handle("/", r.ResolveRouter())
+
+		// event streams clear the write timeout of their own responses as they are held open
 		r.server = &http.Server{
 			Addr:         r.config.Server.Address,
-			Handler:      r.ResolveRouter(),
+			Handler:      mux,
 			IdleTimeout:  time.Second * 60,
 			ReadTimeout:  time.Second * 15,
 			WriteTimeout: time.Second * 15,
 		}
+		r.server.RegisterOnShutdown(func() {
+			// end the event streams so that the server's connections become idle and it can shut down
+			r.ResolveNotifier().Close()
+		})
 	}
 	return r.server
 }
 
 func (r *Resolver) ResolveStore() internal.Store {
-	return internal.NewRedisStore(
-		r.ResolveRedisClient(),
-	)
+	if r.store == nil {
+		leaseDuration := time.Duration(r.config.Stream.LeaseDuration) * time.Second
+		var store internal.Store
+		switch r.config.Store.Type {
+		case MemoryStoreType:
+			store = internal.NewMemoryStore(
+				r.ResolveQuotas(),
+				leaseDuration,
+			)
+		case RedisStoreType:
+			store = internal.NewRedisStore(
+				r.ResolveRedisClient(),
+				r.ResolveKeySpace(),
+				r.ResolveQuotas(),
+				leaseDuration,
+			)
+		default:
+			panic(errors.Errorf("resolver: unknown store type %q", r.config.Store.Type))
+		}
+		if publisher := r.ResolvePublisher(); publisher != nil {
+			store = internal.NewPublishingStore(store, publisher)
+		}
+		r.store = internal.NewInstrumentedStore(internal.NewContextStore(store), r.ResolveMetrics())
+	}
+	return r.store
+}
+
+// ResolveStoreTimeout returns the deadline of each request's store operations
+func (r *Resolver) ResolveStoreTimeout() *internal.StoreTimeout {
+	if r.storeTimeout == nil {
+		r.storeTimeout = internal.NewStoreTimeout(time.Duration(r.config.Store.TimeoutMS) * time.Millisecond)
+	}
+	return r.storeTimeout
+}
+
+// ResolveSweeper returns the sweeper of expired leases, or nil if they are only removed by requests for their users
+func (r *Resolver) ResolveSweeper() *internal.Sweeper {
+	if r.sweeper == nil && r.config.Store.SweepIntervalMS > 0 {
+		r.sweeper = internal.NewSweeper(
+			r.ResolveLogger(),
+			r.ResolveStore(),
+			r.ResolveNotifier(),
+			time.Duration(r.config.Store.SweepIntervalMS)*time.Millisecond,
+		)
+	}
+	return r.sweeper
+}
+
+// NewLogger creates a new logger at the configured level for commands that do not resolve the whole service
+func NewLogger(config *Config) *zap.SugaredLogger {
+	return newLogger(zap.NewAtomicLevelAt(parseLevel(config.Log.Level)))
+}
+
+func newLogger(level zap.AtomicLevel) *zap.SugaredLogger {
+	config := zap.NewDevelopmentConfig()
+	config.Level = level
+	logger, _ := config.Build()
+	return logger.Sugar()
+}
+
+// NewRedisClient creates a new client of the configured redis servers and checks that they can be reached; the client
+// keeps go-redis' default read and write timeouts, as store.timeout-ms only sets each request's deadline so that it
+// can be changed whilst the service is running
+func NewRedisClient(config *Config) (redis.UniversalClient, error) {
+	var client redis.UniversalClient
+	addresses := strings.Split(config.Redis.Address, ",")
+	switch config.Redis.Mode {
+	case RedisSentinelMode:
+		client = redis.NewFailoverClient(
+			&redis.FailoverOptions{
+				SentinelAddrs: addresses,
+				MasterName:    config.Redis.MasterName,
+				Password:      config.Redis.Password,
+				DB:            config.Redis.DB,
+			},
+		)
+	case RedisClusterMode:
+		client = redis.NewClusterClient(
+			&redis.ClusterOptions{
+				Addrs:    addresses,
+				Password: config.Redis.Password,
+			},
+		)
+	default:
+		client = redis.NewClient(
+			&redis.Options{
+				Addr:     config.Redis.Address,
+				Password: config.Redis.Password,
+				DB:       config.Redis.DB,
+			},
+		)
+	}
+	if _, err := client.Ping().Result(); err != nil {
+		client.Close()
+		return nil, errors.Wrap(err, "failed to ping redis server")
+	}
+	return client, nil
+}
+
+// deviceLimits returns the validated limits of each device type
+func deviceLimits(config *Config) map[string]int {
+	limits, _ := parseDeviceLimits(config.Quota.DeviceLimits)
+	return limits
+}
+
+func parseLevel(text string) zapcore.Level {
+	var level zapcore.Level
+	if err := level.UnmarshalText([]byte(text)); err != nil {
+		return zapcore.DebugLevel
+	}
+	return level
 }
@@ -0,0 +1,44 @@
+package startup
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap/zapcore"
+	"testing"
+	"time"
+)
+
+func TestShouldApplyLiveSettingsAndReportThoseRequiringRestart(t *testing.T) {
+	config := DefaultConfig()
+	config.Store.Type = MemoryStoreType
+	resolver := NewResolver(config)
+
+	updated := *config
+	updated.Log.Level = "warn"
+	updated.Quota.DefaultLimit = 5
+	updated.Server.Address = "0.0.0.0:9090"
+	updated.Store.TimeoutMS = 250
+
+	restart := resolver.Reconfigure(&updated)
+
+	assert.Equal(t, []string{"server.address"}, restart)
+	assert.Equal(t, &updated, resolver.Config())
+	assert.Equal(t, 250*time.Millisecond, resolver.ResolveStoreTimeout().Duration())
+	assert.False(t, resolver.ResolveLogger().Desugar().Core().Enabled(zapcore.InfoLevel))
+
+	limit, err := resolver.ResolveQuotas().Limit(context.Background(), "alan")
+	assert.NoError(t, err)
+	assert.Equal(t, 5, limit)
+}
+
+func TestShouldRegisterMetricsOfEachResolverSeparately(t *testing.T) {
+	config := DefaultConfig()
+	config.Store.Type = MemoryStoreType
+
+	first, second := NewResolver(config), NewResolver(config)
+
+	assert.True(t, first.ResolveRegistry() != second.ResolveRegistry())
+	families, err := second.ResolveRegistry().Gather()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, families)
+}
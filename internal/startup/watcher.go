@@ -0,0 +1,94 @@
+package startup
+
+import (
+	"context"
+	"github.com/hashicorp/consul/api"
+	"os"
+	"time"
+)
+
+const (
+	// time a blocking query waits for the configuration to change before returning
+	watchWaitTime = 5 * time.Minute
+
+	// time waited before retrying a failed blocking query
+	watchRetryDelay = 5 * time.Second
+)
+
+// WatchConfiguration watches the Consul key holding the configuration with blocking queries and applies each valid
+// change to the resolver until the context is done; it returns immediately when Consul is not being used
+func WatchConfiguration(ctx context.Context, path string, resolver *Resolver) {
+	consulAddress := os.Getenv(ConsulAddr)
+	if consulAddress == "" {
+		return
+	}
+
+	logger := resolver.ResolveLogger()
+	kv, err := getConsulKV(consulAddress)
+	if err != nil {
+		logger.Errorw("cannot watch configuration", "error", err)
+		return
+	}
+
+	consulKey := getConsulKey()
+	var index uint64
+	for {
+		opts := &api.QueryOptions{
+			WaitIndex: index,
+			WaitTime:  watchWaitTime,
+		}
+		pair, meta, err := kv.Get(consulKey, opts.WithContext(ctx))
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logger.Warnw("cannot read configuration from consul", "key", consulKey, "error", err)
+			if !sleep(ctx, watchRetryDelay) {
+				return
+			}
+			continue
+		}
+
+		// the index is reset if it goes backwards, e.g. when the consul servers' state is restored
+		if meta.LastIndex < index {
+			index = 0
+			continue
+		}
+		if meta.LastIndex == index {
+			continue
+		}
+		index = meta.LastIndex
+
+		if pair == nil {
+			logger.Warnw("configuration key not found in consul; keeping current configuration", "key", consulKey)
+			continue
+		}
+		config, err := buildConfiguration(path, pair.Value)
+		if err != nil {
+			logger.Errorw("invalid configuration in consul; keeping current configuration", "key", consulKey, "error", err)
+			continue
+		}
+
+		changed := changedSettings(resolver.Config(), config)
+		if len(changed) == 0 {
+			continue
+		}
+		restart := resolver.Reconfigure(config)
+		logger.Infow("configuration reloaded", "changed", changed)
+		if len(restart) > 0 {
+			logger.Warnw("changed settings only take effect after a restart", "settings", restart)
+		}
+	}
+}
+
+// sleep waits for the duration and returns false if the context is done first
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -1,69 +1,690 @@
 package internal
 
 import (
+	"context"
+	"encoding/json"
 	"github.com/go-redis/redis"
 	"github.com/pkg/errors"
+	"github.com/prgodlonton/stream-controller/internal/session"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
 )
 
-var exceededStreamsQuota = errors.New("user has exceeded streaming quota")
+var streamNotFound = errors.New("user is not watching stream")
 
 const (
-	// *atomic* lua script to add strings to the given set if it has less than 3 elements
-	condSetAdd = `if redis.call("SCARD",KEYS[1]) < 3 then return redis.call("SADD",KEYS[1],ARGV[1]) else return -1 end`
+	// lua prelude converting the set of streams KEYS[1] written by versions before streams were leased into a sorted
+	// set of leases expiring at the local variable expiry, so that the streams are kept until they can be renewed;
+	// the type's status reply is a table in Redis but a string in some emulators
+	convertLegacySet = `
+local keyType = redis.call("TYPE",KEYS[1])
+if (keyType.ok or keyType) == "set" then
+	local streams = redis.call("SMEMBERS",KEYS[1])
+	redis.call("DEL",KEYS[1])
+	for _, stream in ipairs(streams) do
+		redis.call("ZADD",KEYS[1],expiry,stream)
+	end
+	redis.call("PEXPIREAT",KEYS[1],string.format("%.0f",tonumber(expiry)+600000))
+end
+`
+
+	// lua prelude pruning the expired leases, those scored no later than the local variable now, from the sorted set
+	// KEYS[1] along with their devices in the hash KEYS[2] and start times in the sorted set KEYS[3]; the pruned
+	// streams are held by the local variable expired
+	pruneLeases = `
+local expired = redis.call("ZRANGEBYSCORE",KEYS[1],"-inf",now)
+if #expired > 0 then
+	redis.call("ZREMRANGEBYSCORE",KEYS[1],"-inf",now)
+	redis.call("HDEL",KEYS[2],unpack(expired))
+	redis.call("ZREM",KEYS[3],unpack(expired))
+end
+`
+
+	// lua postlude expiring the sorted set KEYS[1], hash KEYS[2] and sorted set KEYS[3] ten minutes after the last
+	// lease in the sorted set KEYS[1], so that the sweeper can find the leases that expired before the keys do
+	expireWithLastLease = `
+local last = string.format("%.0f",tonumber(redis.call("ZRANGE",KEYS[1],-1,-1,"WITHSCORES")[2]) + 600000)
+redis.call("PEXPIREAT",KEYS[1],last)
+redis.call("PEXPIREAT",KEYS[2],last)
+redis.call("PEXPIREAT",KEYS[3],last)
+`
+
+	// *atomic* lua script to prune expired leases and then add or renew the stream's lease, recording its device and
+	// start time, if it is already held or the set has less elements than the given limit, and the user's other
+	// streams on the device's type are fewer than the device type's limit, if it is not negative; under the evict
+	// policies the streams started first, or whose leases were least recently renewed, are removed until the stream
+	// fits within both limits and are returned with 1, otherwise when the stream cannot be added 0 is returned along
+	// with the device type if its limit was reached and the elements counted against the limit with their scores;
+	// the pruned streams are returned next, followed by 1 if an added stream was not already held
+	condLeaseAdd = `local now, expiry = ARGV[3], ARGV[4]` + convertLegacySet + pruneLeases + `
+local limit, deviceLimit, policy = tonumber(ARGV[2]), tonumber(ARGV[7]), ARGV[8]
+local held = redis.call("ZSCORE",KEYS[1],ARGV[1])
+local evicted = {}
+local function withScores(streams)
+	local leases = {}
+	for _, stream in ipairs(streams) do
+		leases[#leases+1] = stream
+		leases[#leases+1] = redis.call("ZSCORE",KEYS[1],stream)
+	end
+	return leases
+end
+local function evict(streams)
+	local key = KEYS[3]
+	if policy == "evict-idle" then
+		key = KEYS[1]
+	end
+	local victim, lowest
+	for i, stream in ipairs(streams) do
+		local score = tonumber(redis.call("ZSCORE",key,stream) or 0)
+		if not victim or score < lowest then
+			victim, lowest = i, score
+		end
+	end
+	local stream = table.remove(streams,victim)
+	redis.call("ZREM",KEYS[1],stream)
+	redis.call("HDEL",KEYS[2],stream)
+	redis.call("ZREM",KEYS[3],stream)
+	evicted[#evicted+1] = stream
+end
+local typed = {}
+if deviceLimit >= 0 then
+	local devices = redis.call("HGETALL",KEYS[2])
+	for i = 1, #devices, 2 do
+		if devices[i] ~= ARGV[1] and cjson.decode(devices[i+1]).deviceType == ARGV[6] then
+			typed[#typed+1] = devices[i]
+		end
+	end
+end
+if not held and redis.call("ZCARD",KEYS[1]) >= limit and (policy == "reject" or limit < 1) then
+	return {0,"",redis.call("ZRANGE",KEYS[1],0,-1,"WITHSCORES"),expired}
+end
+if deviceLimit >= 0 and #typed >= deviceLimit and (policy == "reject" or deviceLimit < 1) then
+	return {0,ARGV[6],withScores(typed),expired}
+end
+while deviceLimit >= 0 and #typed >= deviceLimit do
+	evict(typed)
+end
+if not held then
+	local others = redis.call("ZRANGE",KEYS[1],0,-1)
+	while #others >= limit do
+		evict(others)
+	end
+end
+redis.call("ZADD",KEYS[1],expiry,ARGV[1])
+redis.call("ZADD",KEYS[3],"NX",now,ARGV[1])
+redis.call("HSET",KEYS[2],ARGV[1],ARGV[5])` + expireWithLastLease + `
+local created = 1
+if held then
+	created = 0
+end
+return {1,evicted,expired,created}`
+
+	// *atomic* lua script to return the elements whose leases have not expired; expired leases are left for the
+	// scripts changing the streams to prune so that they are reported
+	leaseList = `local now, expiry = ARGV[1], ARGV[2]` + convertLegacySet + `
+return redis.call("ZRANGEBYSCORE",KEYS[1],"("..now,"+inf")`
+
+	// *atomic* lua script to prune expired leases and then renew the stream's lease if it is still held, returning 1
+	// if it was renewed, otherwise 0, along with the pruned streams
+	condLeaseRenew = `local now, expiry = ARGV[2], ARGV[3]` + convertLegacySet + pruneLeases + `
+if not redis.call("ZSCORE",KEYS[1],ARGV[1]) then
+	return {0,expired}
+end
+redis.call("ZADD",KEYS[1],expiry,ARGV[1])` + expireWithLastLease + `
+return {1,expired}`
+
+	// *atomic* lua script to return the elements whose leases have not expired with their scores, the devices
+	// indexed by element and the elements with their start times
+	leaseDetail = `local now, expiry = ARGV[1], ARGV[2]` + convertLegacySet + `
+return {
+	redis.call("ZRANGEBYSCORE",KEYS[1],"("..now,"+inf","WITHSCORES"),
+	redis.call("HGETALL",KEYS[2]),
+	redis.call("ZRANGE",KEYS[3],0,-1,"WITHSCORES")
+}`
+
+	// *atomic* lua script to prune expired leases and then remove the stream's lease, device and start time,
+	// returning 1 if the stream was held, otherwise 0, along with the pruned streams
+	leaseRemove = `local now, expiry = ARGV[2], ARGV[3]` + convertLegacySet + pruneLeases + `
+local removed = redis.call("ZREM",KEYS[1],ARGV[1])
+redis.call("HDEL",KEYS[2],ARGV[1])
+redis.call("ZREM",KEYS[3],ARGV[1])
+return {removed,expired}`
+
+	// *atomic* lua script to prune expired leases and then remove all of the user's streams, returning 1 if any
+	// streams were held, otherwise 0, along with the pruned streams
+	leaseRemoveAll = `local now, expiry = ARGV[1], ARGV[2]` + convertLegacySet + pruneLeases + `
+local removed = 0
+if redis.call("ZCARD",KEYS[1]) > 0 then
+	removed = 1
+end
+redis.call("DEL",KEYS[1],KEYS[2],KEYS[3])
+return {removed,expired}`
+
+	// *atomic* lua script to prune expired leases and return the pruned streams
+	leaseExpire = `local now, expiry = ARGV[1], ARGV[2]` + convertLegacySet + pruneLeases + `
+return expired`
 )
 
 // Store records the streams being watched by users
 type Store interface {
-	AddStream(userID, streamID string) error
-	GetStreams(userID string) ([]string, error)
-	RemoveStream(userID, streamID string) error
+	// AddStream records the user as watching the stream on the device and returns the streams evicted to make room
+	// for it by the eviction policy
+	AddStream(ctx context.Context, userID, streamID string, device session.Device) (session.Change, error)
+
+	// Apply applies the batch of operations, returning the result of each in the same order; it fails without results
+	// if the batch as a whole could not be applied
+	Apply(ctx context.Context, operations []session.Operation) ([]session.Result, error)
+
+	// ExpireStreams removes the user's streams whose leases have expired and returns them; the operations changing
+	// a user's streams also return the expired streams they remove, which are otherwise still held but not listed
+	ExpireStreams(ctx context.Context, userID string) (session.Change, error)
+	GetLimit(ctx context.Context, userID string) (int, error)
+	GetSessions(ctx context.Context, userID string) ([]session.Session, error)
+	GetStreams(ctx context.Context, userID string) ([]string, error)
+	ListUsers(ctx context.Context, cursor uint64, count int64) ([]string, uint64, error)
+	RemoveAllStreams(ctx context.Context, userID string) (session.Change, error)
+	RemoveStream(ctx context.Context, userID, streamID string) (session.Change, error)
+	RenewStream(ctx context.Context, userID, streamID string) (session.Change, error)
+	SetLimit(ctx context.Context, userID string, limit int, duration time.Duration) error
 }
 
 // RedisStore a Redis-backed store
 type RedisStore struct {
-	client *redis.Client
+	client        redis.UniversalClient
+	keys          KeySpace
+	quotas        Quotas
+	leaseDuration time.Duration
+	now           func() time.Time
 }
 
-// NewRedisStore creates a new Redis-backed store
-func NewRedisStore(client *redis.Client) Store {
+// NewRedisStore creates a new Redis-backed store, holding its data in the key space, whose streams expire unless
+// renewed within the lease duration
+func NewRedisStore(client redis.UniversalClient, keys KeySpace, quotas Quotas, leaseDuration time.Duration) Store {
 	return &RedisStore{
-		client: client,
+		client:        client,
+		keys:          keys,
+		quotas:        quotas,
+		leaseDuration: leaseDuration,
+		now:           time.Now,
+	}
+}
+
+// Adds records a user as watching a stream on the device, evicting streams to make room for it if the eviction
+// policy allows, and returns the evicted streams
+func (rs *RedisStore) AddStream(ctx context.Context, userID, streamID string, device session.Device) (session.Change, error) {
+	limit, err := rs.quotas.Limit(ctx, userID)
+	if err != nil {
+		return session.Change{}, err
+	}
+	client, err := withContext(ctx, rs.client)
+	if err != nil {
+		return session.Change{}, err
+	}
+	add, err := rs.newLeaseAdd(userID, streamID, device, limit, rs.now())
+	if err != nil {
+		return session.Change{}, err
+	}
+	return add.result(client.Eval(condLeaseAdd, add.keys, add.args...))
+}
+
+// Apply applies the batch of operations in a single pipeline, returning the result of each in the same order; it
+// fails without results if every operation failed, e.g. because Redis is unreachable
+func (rs *RedisStore) Apply(ctx context.Context, operations []session.Operation) ([]session.Result, error) {
+	var userIDs []string
+	for _, op := range operations {
+		if op.Op == session.StartOperation {
+			userIDs = append(userIDs, op.UserID)
+		}
+	}
+	limits, err := rs.quotas.Limits(ctx, userIDs)
+	if err != nil {
+		return nil, err
+	}
+	client, err := withContext(ctx, rs.client)
+	if err != nil {
+		return nil, err
+	}
+
+	now := rs.now()
+	results := make([]session.Result, len(operations))
+	adds := make([]*leaseAdd, len(operations))
+	cmds := make([]*redis.Cmd, len(operations))
+	pipe := client.Pipeline()
+	defer pipe.Close()
+	for i, op := range operations {
+		switch op.Op {
+		case session.StartOperation:
+			add, err := rs.newLeaseAdd(op.UserID, op.StreamID, op.Device, limits[op.UserID], now)
+			if err != nil {
+				results[i].Err = err
+				continue
+			}
+			adds[i] = add
+			cmds[i] = pipe.Eval(condLeaseAdd, add.keys, add.args...)
+		case session.StopOperation:
+			cmds[i] = pipe.Eval(leaseRemove, rs.userKeys(op.UserID), op.StreamID, toMillis(now), toMillis(now.Add(rs.leaseDuration)))
+		default:
+			results[i].Err = errors.Errorf("unknown operation %q", op.Op)
+		}
+	}
+	// the commands that failed are read individually
+	pipe.Exec()
+
+	var failed, sent int
+	var firstErr error
+	for i, cmd := range cmds {
+		if cmd == nil {
+			continue
+		}
+		sent++
+		if adds[i] != nil {
+			results[i].Change, results[i].Err = adds[i].result(cmd)
+		} else {
+			results[i].Change, results[i].Err = changedLeases(cmd, "failed to remove element from list")
+		}
+		if _, ok := results[i].Err.(*QuotaExceededError); results[i].Err != nil && !ok {
+			failed++
+			if firstErr == nil {
+				firstErr = results[i].Err
+			}
+		}
+	}
+	if sent > 0 && failed == sent {
+		return nil, firstErr
+	}
+	return results, nil
+}
+
+// ExpireStreams removes the user's streams whose leases have expired and returns them
+func (rs *RedisStore) ExpireStreams(ctx context.Context, userID string) (session.Change, error) {
+	client, err := withContext(ctx, rs.client)
+	if err != nil {
+		return session.Change{}, err
 	}
+	now := rs.now()
+	return expiredLeases(
+		client.Eval(leaseExpire, rs.userKeys(userID), toMillis(now), toMillis(now.Add(rs.leaseDuration))),
+		"failed to expire elements of list",
+	)
 }
 
-// Adds records a user as watching a stream
-func (rs *RedisStore) AddStream(userID, streamID string) error {
-	cmd := rs.client.Eval(condSetAdd, []string{userID}, streamID)
+// GetLimit returns the number of streams the user may watch concurrently
+func (rs *RedisStore) GetLimit(ctx context.Context, userID string) (int, error) {
+	return rs.quotas.Limit(ctx, userID)
+}
+
+// GetSessions returns the streams being watched by a single user, ordered by lease expiry, with their devices and
+// start times
+func (rs *RedisStore) GetSessions(ctx context.Context, userID string) ([]session.Session, error) {
+	client, err := withContext(ctx, rs.client)
+	if err != nil {
+		return nil, err
+	}
+	now := rs.now()
+	cmd := client.Eval(leaseDetail, rs.userKeys(userID), toMillis(now), toMillis(now.Add(rs.leaseDuration)))
 	val, err := cmd.Result()
 	if err != nil {
-		return errors.Wrap(err, "failed to add element to list")
+		return nil, errors.Wrap(err, "failed to get list elements")
+	}
+	results, ok := val.([]interface{})
+	if !ok || len(results) != 3 {
+		return nil, errors.New("cannot convert redis eval return value to triple of slices")
+	}
+	elements, err := toStrings(results[0])
+	if err != nil {
+		return nil, err
+	}
+	devices, err := toStrings(results[1])
+	if err != nil {
+		return nil, err
+	}
+	starts, err := toStrings(results[2])
+	if err != nil {
+		return nil, err
 	}
 
-	added, ok := val.(int64)
-	if !ok {
-		return errors.New("cannot convert redis eval return value to int64")
+	deviceData := make(map[string]string, len(devices)/2)
+	for i := 0; i+1 < len(devices); i += 2 {
+		deviceData[devices[i]] = devices[i+1]
+	}
+	startTimes := make(map[string]string, len(starts)/2)
+	for i := 0; i+1 < len(starts); i += 2 {
+		startTimes[starts[i]] = starts[i+1]
 	}
-	if added == -1 {
-		return exceededStreamsQuota
+	sessions := make([]session.Session, 0, len(elements)/2)
+	for i := 0; i+1 < len(elements); i += 2 {
+		expiry, err := strconv.ParseFloat(elements[i+1], 64)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot convert redis eval return score to float64")
+		}
+		s := session.Session{StreamID: elements[i], ExpiresAt: fromMillis(int64(expiry))}
+		if start, ok := startTimes[s.StreamID]; ok {
+			started, err := strconv.ParseFloat(start, 64)
+			if err != nil {
+				return nil, errors.Wrap(err, "cannot convert redis eval return start time to float64")
+			}
+			s.StartedAt = fromMillis(int64(started))
+		}
+		if data, ok := deviceData[s.StreamID]; ok {
+			if err := json.Unmarshal([]byte(data), &s.Device); err != nil {
+				return nil, errors.Wrap(err, "cannot decode device")
+			}
+		}
+		sessions = append(sessions, s)
 	}
-	return nil
+	return sessions, nil
 }
 
 // Get returns all stream being watched by a single user
-func (rs *RedisStore) GetStreams(userID string) ([]string, error) {
-	cmd := rs.client.SMembers(userID)
-	elements, err := cmd.Result()
+func (rs *RedisStore) GetStreams(ctx context.Context, userID string) ([]string, error) {
+	client, err := withContext(ctx, rs.client)
+	if err != nil {
+		return []string{}, err
+	}
+	now := rs.now()
+	cmd := client.Eval(leaseList, rs.userKeys(userID), toMillis(now), toMillis(now.Add(rs.leaseDuration)))
+	val, err := cmd.Result()
 	if err != nil {
 		return []string{}, errors.Wrap(err, "failed to get list elements")
 	}
-	return elements, nil
+	return toStrings(val)
+}
+
+// ListUsers returns a page of the users watching streams, or whose leases expired in the last ten minutes, and the
+// cursor of the next page, which is zero once all users have been returned; pages may be empty or repeat users as the
+// keyspace is scanned incrementally, and all users are returned in a single page by a cluster as each of its masters
+// must be scanned in full
+func (rs *RedisStore) ListUsers(ctx context.Context, cursor uint64, count int64) ([]string, uint64, error) {
+	client, err := withContext(ctx, rs.client)
+	if err != nil {
+		return []string{}, 0, err
+	}
+	var keys []string
+	var next uint64
+	if cluster, ok := client.(*redis.ClusterClient); ok {
+		keys, err = scanMasters(cluster, rs.keys.StreamsPattern(), count)
+	} else {
+		keys, next, err = client.Scan(cursor, rs.keys.StreamsPattern(), count).Result()
+	}
+	if err != nil {
+		return []string{}, 0, errors.Wrap(err, "failed to scan keys")
+	}
+	userIDs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if userID, ok := rs.keys.UserID(key); ok {
+			userIDs = append(userIDs, userID)
+		}
+	}
+	return userIDs, next, nil
+}
+
+// RemoveAllStreams removes the records of all streams being watched by a user
+func (rs *RedisStore) RemoveAllStreams(ctx context.Context, userID string) (session.Change, error) {
+	client, err := withContext(ctx, rs.client)
+	if err != nil {
+		return session.Change{}, err
+	}
+	now := rs.now()
+	return changedLeases(
+		client.Eval(leaseRemoveAll, rs.userKeys(userID), toMillis(now), toMillis(now.Add(rs.leaseDuration))),
+		"failed to remove list",
+	)
 }
 
 // Remove removes the record of a user watching a stream
-func (rs *RedisStore) RemoveStream(userID, streamID string) error {
-	cmd := rs.client.SRem(userID, streamID)
-	if _, err := cmd.Result(); err != nil {
-		return errors.Wrap(err, "failed to remove element from list")
+func (rs *RedisStore) RemoveStream(ctx context.Context, userID, streamID string) (session.Change, error) {
+	client, err := withContext(ctx, rs.client)
+	if err != nil {
+		return session.Change{}, err
+	}
+	now := rs.now()
+	return changedLeases(
+		client.Eval(leaseRemove, rs.userKeys(userID), streamID, toMillis(now), toMillis(now.Add(rs.leaseDuration))),
+		"failed to remove element from list",
+	)
+}
+
+// RenewStream extends the lease of a stream the user is watching
+func (rs *RedisStore) RenewStream(ctx context.Context, userID, streamID string) (session.Change, error) {
+	client, err := withContext(ctx, rs.client)
+	if err != nil {
+		return session.Change{}, err
+	}
+
+	now := rs.now()
+	cmd := client.Eval(
+		condLeaseRenew,
+		rs.userKeys(userID),
+		streamID,
+		toMillis(now),
+		toMillis(now.Add(rs.leaseDuration)),
+	)
+	change, err := changedLeases(cmd, "failed to renew element in list")
+	if err == nil && !change.Changed {
+		return change, streamNotFound
+	}
+	return change, err
+}
+
+// SetLimit overrides the number of streams the user may watch concurrently for the duration, or indefinitely if the
+// duration is zero
+func (rs *RedisStore) SetLimit(ctx context.Context, userID string, limit int, duration time.Duration) error {
+	return rs.quotas.Override(ctx, userID, limit, duration)
+}
+
+// leaseAdd the keys and arguments of the add script for a stream along with the limits they give, from which the
+// script's result is read
+type leaseAdd struct {
+	keys        []string
+	args        []interface{}
+	limit       int
+	deviceLimit int
+	now         time.Time
+}
+
+// newLeaseAdd returns the add script's keys and arguments recording the user as watching the stream on the device
+func (rs *RedisStore) newLeaseAdd(userID, streamID string, device session.Device, limit int, now time.Time) (*leaseAdd, error) {
+	data, err := json.Marshal(device)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot encode device")
 	}
-	return nil
+
+	deviceLimit, ok := rs.quotas.DeviceLimit(device.DeviceType)
+	if !ok || device.DeviceType == "" {
+		deviceLimit = -1
+	}
+
+	return &leaseAdd{
+		keys: rs.userKeys(userID),
+		args: []interface{}{
+			streamID,
+			limit,
+			toMillis(now),
+			toMillis(now.Add(rs.leaseDuration)),
+			data,
+			device.DeviceType,
+			deviceLimit,
+			string(rs.quotas.EvictionPolicy()),
+		},
+		limit:       limit,
+		deviceLimit: deviceLimit,
+		now:         now,
+	}, nil
+}
+
+// result returns the streams evicted and expired by the add script, or the expired streams along with the quota
+// exceeded error if the stream was rejected
+func (la *leaseAdd) result(cmd *redis.Cmd) (session.Change, error) {
+	val, err := cmd.Result()
+	if err != nil {
+		return session.Change{}, errors.Wrap(err, "failed to add element to list")
+	}
+
+	results, ok := val.([]interface{})
+	if !ok || len(results) != 4 {
+		return session.Change{}, errors.New("cannot convert redis eval return value to quadruple")
+	}
+	if added, ok := results[0].(int64); ok && added == 1 {
+		evicted, err := toStrings(results[1])
+		if err != nil {
+			return session.Change{}, err
+		}
+		expired, err := toStrings(results[2])
+		if err != nil {
+			return session.Change{}, err
+		}
+		created, ok := results[3].(int64)
+		if !ok {
+			return session.Change{}, errors.New("cannot convert redis eval return value to int64")
+		}
+		return session.Change{Changed: created == 1, Evicted: evicted, Expired: expired}, nil
+	}
+	deviceType, ok := results[1].(string)
+	if !ok {
+		return session.Change{}, errors.New("cannot convert redis eval return device type to string")
+	}
+	elements, err := toStrings(results[2])
+	if err != nil {
+		return session.Change{}, err
+	}
+	expired, err := toStrings(results[3])
+	if err != nil {
+		return session.Change{}, err
+	}
+	change := session.Change{Expired: expired}
+	if deviceType != "" {
+		return change, toQuotaExceededError(la.deviceLimit, deviceType, elements, la.now)
+	}
+	return change, toQuotaExceededError(la.limit, "", elements, la.now)
+}
+
+// expiredLeases returns the streams pruned by a script returning them, wrapping the command's error with the message
+func expiredLeases(cmd *redis.Cmd, message string) (session.Change, error) {
+	val, err := cmd.Result()
+	if err != nil {
+		return session.Change{}, errors.Wrap(err, message)
+	}
+	expired, err := toStrings(val)
+	if err != nil {
+		return session.Change{}, err
+	}
+	return session.Change{Expired: expired}, nil
+}
+
+// changedLeases returns whether a script returning 1 or 0 along with the pruned streams changed the stream, wrapping
+// the command's error with the message
+func changedLeases(cmd *redis.Cmd, message string) (session.Change, error) {
+	val, err := cmd.Result()
+	if err != nil {
+		return session.Change{}, errors.Wrap(err, message)
+	}
+	results, ok := val.([]interface{})
+	if !ok || len(results) != 2 {
+		return session.Change{}, errors.New("cannot convert redis eval return value to pair")
+	}
+	changed, ok := results[0].(int64)
+	if !ok {
+		return session.Change{}, errors.New("cannot convert redis eval return value to int64")
+	}
+	expired, err := toStrings(results[1])
+	if err != nil {
+		return session.Change{}, err
+	}
+	return session.Change{Changed: changed == 1, Expired: expired}, nil
+}
+
+// userKeys returns the keys of the sorted set holding the user's leases, the hash holding their devices and the
+// sorted set holding their start times
+func (rs *RedisStore) userKeys(userID string) []string {
+	return []string{rs.keys.Streams(userID), rs.keys.Devices(userID), rs.keys.Started(userID)}
+}
+
+// withContext returns the client bound to the context, or the context's error if it is already done; go-redis does
+// not interrupt commands in flight, so they are bounded by the client's read and write timeouts instead
+func withContext(ctx context.Context, client redis.UniversalClient) (redis.UniversalClient, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	switch c := client.(type) {
+	case *redis.Client:
+		return c.WithContext(ctx), nil
+	case *redis.ClusterClient:
+		return c.WithContext(ctx), nil
+	}
+	return client, nil
+}
+
+// scanMasters returns the keys matching the pattern held by every master of the cluster
+func scanMasters(cluster *redis.ClusterClient, pattern string, count int64) ([]string, error) {
+	var mu sync.Mutex
+	var keys []string
+	err := cluster.ForEachMaster(func(client *redis.Client) error {
+		iter := client.Scan(0, pattern, count).Iterator()
+		for iter.Next() {
+			mu.Lock()
+			keys = append(keys, iter.Val())
+			mu.Unlock()
+		}
+		return iter.Err()
+	})
+	return keys, err
+}
+
+// toQuotaExceededError converts the elements and scores returned by the add script to a quota exceeded error whose
+// streams are ordered by score so the first is the soonest expiring lease
+func toQuotaExceededError(limit int, deviceType string, elements []string, now time.Time) error {
+	type lease struct {
+		streamID string
+		expiry   float64
+	}
+	leases := make([]lease, 0, len(elements)/2)
+	for i := 0; i+1 < len(elements); i += 2 {
+		expiry, err := strconv.ParseFloat(elements[i+1], 64)
+		if err != nil {
+			return errors.Wrap(err, "cannot convert redis eval return score to float64")
+		}
+		leases = append(leases, lease{streamID: elements[i], expiry: expiry})
+	}
+	sort.SliceStable(leases, func(i, j int) bool {
+		return leases[i].expiry < leases[j].expiry
+	})
+
+	qe := &QuotaExceededError{
+		Limit:      limit,
+		DeviceType: deviceType,
+		Streams:    make([]string, 0, len(leases)),
+	}
+	for _, l := range leases {
+		qe.Streams = append(qe.Streams, l.streamID)
+	}
+	if len(leases) > 0 {
+		qe.RetryAfter = time.Duration(int64(leases[0].expiry)-toMillis(now)) * time.Millisecond
+	}
+	return qe
+}
+
+func toStrings(val interface{}) ([]string, error) {
+	elements, ok := val.([]interface{})
+	if !ok {
+		return []string{}, errors.New("cannot convert redis eval return value to slice")
+	}
+	strs := make([]string, 0, len(elements))
+	for _, element := range elements {
+		str, ok := element.(string)
+		if !ok {
+			return []string{}, errors.New("cannot convert redis eval return element to string")
+		}
+		strs = append(strs, str)
+	}
+	return strs, nil
+}
+
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func fromMillis(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond))
 }
@@ -0,0 +1,327 @@
+package internal
+
+import (
+	"context"
+	"github.com/alicebob/miniredis"
+	"github.com/go-redis/redis"
+	"github.com/prgodlonton/stream-controller/internal/session"
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRedisStoreShouldRejectStreamsBeyondTheUsersLimit(t *testing.T) {
+	store, _, clock := newRedisStore(t, 2)
+
+	assert.NoError(t, addStream(store, "alan", "boxing1", session.Device{}))
+	clock.Advance(10 * time.Second)
+	assert.NoError(t, addStream(store, "alan", "tennis2", session.Device{}))
+	assert.NoError(t, addStream(store, "alan", "tennis2", session.Device{}))
+	assert.Equal(
+		t,
+		&QuotaExceededError{Limit: 2, Streams: []string{"boxing1", "tennis2"}, RetryAfter: 50 * time.Second},
+		addStream(store, "alan", "sumo3", session.Device{}),
+	)
+
+	streamIDs, err := store.GetStreams(context.Background(), "alan")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"boxing1", "tennis2"}, streamIDs)
+}
+
+func TestRedisStoreShouldApplyOverriddenLimit(t *testing.T) {
+	store, _, _ := newRedisStore(t, 1)
+
+	assert.NoError(t, store.SetLimit(context.Background(), "becky", 2, time.Hour))
+	assert.NoError(t, addStream(store, "becky", "rugby7", session.Device{}))
+	assert.NoError(t, addStream(store, "becky", "golf4", session.Device{}))
+	assert.IsType(t, &QuotaExceededError{}, addStream(store, "becky", "darts2", session.Device{}))
+
+	assert.NoError(t, store.SetLimit(context.Background(), "becky", 0, 0))
+	limit, err := store.GetLimit(context.Background(), "becky")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, limit)
+	assert.NoError(t, removeStream(store, "becky", "rugby7"))
+	assert.IsType(t, &QuotaExceededError{}, addStream(store, "becky", "rugby7", session.Device{}))
+}
+
+func TestRedisStoreShouldDeleteExpiredOverriddenLimitsWhenRead(t *testing.T) {
+	store, server, _ := newRedisStore(t, 1)
+	expired := "4:" + strconv.FormatInt(toMillis(time.Now().Add(-time.Minute)), 10)
+	server.HSet("sc:quotas", "becky", expired)
+	server.HSet("sc:quotas", "charles", expired)
+	assert.NoError(t, store.SetLimit(context.Background(), "dorothy", 3, time.Hour))
+
+	limit, err := store.GetLimit(context.Background(), "becky")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, limit)
+	limits, err := store.quotas.Limits(context.Background(), []string{"charles", "dorothy"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"charles": 1, "dorothy": 3}, limits)
+
+	users, err := server.HKeys("sc:quotas")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"dorothy"}, users)
+}
+
+func TestRedisStoreShouldFreeSlotWhenStreamIsRemoved(t *testing.T) {
+	store, _, _ := newRedisStore(t, 1)
+
+	assert.NoError(t, addStream(store, "charles", "boxing1", session.Device{}))
+	assert.NoError(t, removeStream(store, "charles", "boxing1"))
+	assert.NoError(t, addStream(store, "charles", "golf4", session.Device{}))
+
+	streamIDs, err := store.GetStreams(context.Background(), "charles")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"golf4"}, streamIDs)
+}
+
+func TestRedisStoreShouldExpireStreamsWhoseLeasesAreNotRenewed(t *testing.T) {
+	store, _, clock := newRedisStore(t, 2)
+
+	assert.NoError(t, addStream(store, "diane", "cycling2", session.Device{}))
+	assert.NoError(t, addStream(store, "diane", "karate3", session.Device{}))
+
+	clock.Advance(30 * time.Second)
+	assert.NoError(t, renewLease(store, "diane", "karate3"))
+
+	clock.Advance(45 * time.Second)
+	assert.Equal(t, streamNotFound, renewLease(store, "diane", "cycling2"))
+	assert.NoError(t, addStream(store, "diane", "golf4", session.Device{}))
+
+	streamIDs, err := store.GetStreams(context.Background(), "diane")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"karate3", "golf4"}, streamIDs)
+
+	clock.Advance(time.Minute)
+	streamIDs, err = store.GetStreams(context.Background(), "diane")
+	assert.NoError(t, err)
+	assert.Empty(t, streamIDs)
+}
+
+func TestRedisStoreShouldLeaseStreamsHeldInSetByEarlierVersions(t *testing.T) {
+	store, server, clock := newRedisStore(t, 2)
+	server.SetAdd("sc:user:{edward}:streams", "boxing1", "tennis2")
+
+	streamIDs, err := store.GetStreams(context.Background(), "edward")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"boxing1", "tennis2"}, streamIDs)
+	assert.IsType(t, &QuotaExceededError{}, addStream(store, "edward", "sumo3", session.Device{}))
+
+	clock.Advance(30 * time.Second)
+	assert.NoError(t, renewLease(store, "edward", "tennis2"))
+	clock.Advance(45 * time.Second)
+	assert.NoError(t, addStream(store, "edward", "sumo3", session.Device{}))
+
+	streamIDs, err = store.GetStreams(context.Background(), "edward")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"tennis2", "sumo3"}, streamIDs)
+}
+
+func TestRedisStoreShouldRemoveStreamHeldInSetByEarlierVersions(t *testing.T) {
+	store, server, _ := newRedisStore(t, 2)
+	server.SetAdd("sc:user:{frank}:streams", "darts2")
+
+	assert.NoError(t, removeStream(store, "frank", "darts2"))
+	streamIDs, err := store.GetStreams(context.Background(), "frank")
+	assert.NoError(t, err)
+	assert.Empty(t, streamIDs)
+}
+
+// newRedisStore creates a store with the default limit backed by an in-process Redis server, whose clock starts at
+// the current time so that the keys' expiry times are in the future
+func newRedisStore(t *testing.T, defaultLimit int) (*RedisStore, *miniredis.Miniredis, *fakeClock) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	keys := NewKeySpace("sc")
+	clock := &fakeClock{now: time.Now().Truncate(time.Millisecond)}
+	store := NewRedisStore(client, keys, NewRedisQuotas(client, keys, defaultLimit), time.Minute).(*RedisStore)
+	store.now = clock.Now
+	return store, server, clock
+}
+
+func TestRedisStoreShouldRecordDevicesOfSessions(t *testing.T) {
+	store, server, clock := newRedisStore(t, 3)
+	started := clock.Now()
+	tv := session.Device{DeviceID: "tv-2", DeviceType: "tv", AppVersion: "2.1.0"}
+
+	assert.NoError(t, addStream(store, "gemma", "boxing1", session.Device{DeviceID: "tv-1", DeviceType: "tv"}))
+	clock.Advance(10 * time.Second)
+	assert.NoError(t, addStream(store, "gemma", "boxing1", tv))
+	assert.NoError(t, addStream(store, "gemma", "tennis2", session.Device{DeviceType: "mobile"}))
+
+	sessions, err := store.GetSessions(context.Background(), "gemma")
+	assert.NoError(t, err)
+	assert.Equal(t, []session.Session{
+		{StreamID: "boxing1", Device: tv, StartedAt: started, ExpiresAt: clock.Now().Add(time.Minute)},
+		{StreamID: "tennis2", Device: session.Device{DeviceType: "mobile"}, StartedAt: clock.Now(), ExpiresAt: clock.Now().Add(time.Minute)},
+	}, sessions)
+
+	assert.NoError(t, removeStream(store, "gemma", "boxing1"))
+	assert.Empty(t, server.HGet("sc:user:{gemma}:devices", "boxing1"))
+	assert.Empty(t, server.HGet("sc:user:{gemma}:started", "boxing1"))
+
+	clock.Advance(2 * time.Minute)
+	sessions, err = store.GetSessions(context.Background(), "gemma")
+	assert.NoError(t, err)
+	assert.Empty(t, sessions)
+	change, err := store.ExpireStreams(context.Background(), "gemma")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"tennis2"}, change.Expired)
+	assert.Empty(t, server.HGet("sc:user:{gemma}:devices", "tennis2"))
+}
+
+func TestRedisStoreShouldRejectStreamsBeyondTheDeviceTypesLimit(t *testing.T) {
+	store, _, _ := newRedisStore(t, 4)
+	store.quotas.(AdjustableQuotas).SetDeviceLimits(map[string]int{"tv": 1, "console": 0})
+	tv := session.Device{DeviceType: "tv"}
+
+	assert.NoError(t, addStream(store, "henry", "boxing1", tv))
+	assert.NoError(t, addStream(store, "henry", "boxing1", tv))
+	assert.NoError(t, addStream(store, "henry", "tennis2", session.Device{DeviceType: "mobile"}))
+	assert.NoError(t, addStream(store, "henry", "golf4", session.Device{}))
+
+	err := addStream(store, "henry", "sumo3", tv)
+	if assert.IsType(t, &QuotaExceededError{}, err) {
+		qe := err.(*QuotaExceededError)
+		assert.Equal(t, 1, qe.Limit)
+		assert.Equal(t, "tv", qe.DeviceType)
+		assert.Equal(t, []string{"boxing1"}, qe.Streams)
+	}
+	err = addStream(store, "henry", "darts2", session.Device{DeviceType: "console"})
+	if assert.IsType(t, &QuotaExceededError{}, err) {
+		assert.Equal(t, 0, err.(*QuotaExceededError).Limit)
+	}
+}
+
+func TestRedisStoreShouldEvictStreamsUnderEvictionPolicy(t *testing.T) {
+	store, _, clock := newRedisStore(t, 2)
+	quotas := store.quotas.(AdjustableQuotas)
+	quotas.SetDeviceLimits(map[string]int{"tv": 1})
+
+	assert.NoError(t, addStream(store, "irene", "boxing1", session.Device{}))
+	clock.Advance(10 * time.Second)
+	assert.NoError(t, addStream(store, "irene", "tennis2", session.Device{}))
+	clock.Advance(10 * time.Second)
+	assert.NoError(t, renewLease(store, "irene", "boxing1"))
+
+	quotas.SetEvictionPolicy(EvictIdlePolicy)
+	change, err := store.AddStream(context.Background(), "irene", "sumo3", session.Device{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"tennis2"}, change.Evicted)
+
+	quotas.SetEvictionPolicy(EvictOldestPolicy)
+	change, err = store.AddStream(context.Background(), "irene", "golf4", session.Device{DeviceType: "tv"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"boxing1"}, change.Evicted)
+
+	clock.Advance(10 * time.Second)
+	change, err = store.AddStream(context.Background(), "irene", "darts5", session.Device{DeviceType: "tv"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"golf4"}, change.Evicted)
+
+	streamIDs, err := store.GetStreams(context.Background(), "irene")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"darts5", "sumo3"}, streamIDs)
+	sessions, err := store.GetSessions(context.Background(), "irene")
+	assert.NoError(t, err)
+	assert.Len(t, sessions, 2)
+}
+
+func TestRedisStoreShouldReportStreamsWhoseLeasesExpired(t *testing.T) {
+	store, _, clock := newRedisStore(t, 2)
+
+	assert.NoError(t, addStream(store, "jack", "boxing1", session.Device{}))
+	assert.NoError(t, addStream(store, "jack", "tennis2", session.Device{}))
+	clock.Advance(2 * time.Minute)
+
+	streamIDs, err := store.GetStreams(context.Background(), "jack")
+	assert.NoError(t, err)
+	assert.Empty(t, streamIDs)
+	userIDs, _, err := store.ListUsers(context.Background(), 0, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"jack"}, userIDs)
+	change, err := store.RenewStream(context.Background(), "jack", "boxing1")
+	assert.Equal(t, streamNotFound, err)
+	assert.ElementsMatch(t, []string{"boxing1", "tennis2"}, change.Expired)
+
+	assert.NoError(t, addStream(store, "jack", "sumo3", session.Device{}))
+	clock.Advance(2 * time.Minute)
+	change, err = store.ExpireStreams(context.Background(), "jack")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"sumo3"}, change.Expired)
+	change, err = store.ExpireStreams(context.Background(), "jack")
+	assert.NoError(t, err)
+	assert.Empty(t, change.Expired)
+}
+
+func TestRedisStoreShouldReportWhetherStreamsWereStartedAndStopped(t *testing.T) {
+	store, _, _ := newRedisStore(t, 2)
+	ctx := context.Background()
+
+	change, err := store.AddStream(ctx, "kate", "boxing1", session.Device{})
+	assert.NoError(t, err)
+	assert.True(t, change.Changed)
+	change, err = store.AddStream(ctx, "kate", "boxing1", session.Device{DeviceType: "tv"})
+	assert.NoError(t, err)
+	assert.False(t, change.Changed)
+
+	change, err = store.RemoveStream(ctx, "kate", "tennis2")
+	assert.NoError(t, err)
+	assert.False(t, change.Changed)
+	change, err = store.RemoveStream(ctx, "kate", "boxing1")
+	assert.NoError(t, err)
+	assert.True(t, change.Changed)
+
+	change, err = store.RemoveAllStreams(ctx, "kate")
+	assert.NoError(t, err)
+	assert.False(t, change.Changed)
+	assert.NoError(t, addStream(store, "kate", "sumo3", session.Device{}))
+	change, err = store.RemoveAllStreams(ctx, "kate")
+	assert.NoError(t, err)
+	assert.True(t, change.Changed)
+}
+
+func TestRedisStoreShouldApplyBatchOfOperationsInOrder(t *testing.T) {
+	store, _, _ := newRedisStore(t, 1)
+	assert.NoError(t, store.SetLimit(context.Background(), "becky", 2, time.Hour))
+	assert.NoError(t, addStream(store, "alan", "boxing1", session.Device{}))
+
+	results, err := store.Apply(context.Background(), []session.Operation{
+		{Op: session.StartOperation, UserID: "alan", StreamID: "darts2"},
+		{Op: session.StopOperation, UserID: "alan", StreamID: "boxing1"},
+		{Op: session.StartOperation, UserID: "alan", StreamID: "darts2", Device: session.Device{DeviceType: "tv"}},
+		{Op: session.StartOperation, UserID: "becky", StreamID: "rugby7"},
+		{Op: session.StartOperation, UserID: "becky", StreamID: "golf4"},
+		{Op: session.StopOperation, UserID: "becky", StreamID: "tennis2"},
+	})
+
+	assert.NoError(t, err)
+	if assert.Len(t, results, 6) {
+		if assert.IsType(t, &QuotaExceededError{}, results[0].Err) {
+			assert.Equal(t, []string{"boxing1"}, results[0].Err.(*QuotaExceededError).Streams)
+		}
+		for i, changed := range []bool{true, true, true, true, false} {
+			result := results[i+1]
+			assert.NoError(t, result.Err, i+1)
+			assert.Equal(t, changed, result.Changed, i+1)
+			assert.Empty(t, result.Evicted, i+1)
+			assert.Empty(t, result.Expired, i+1)
+		}
+	}
+	sessions, err := store.GetSessions(context.Background(), "alan")
+	assert.NoError(t, err)
+	if assert.Len(t, sessions, 1) {
+		assert.Equal(t, "darts2", sessions[0].StreamID)
+		assert.Equal(t, "tv", sessions[0].Device.DeviceType)
+	}
+	streamIDs, err := store.GetStreams(context.Background(), "becky")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"rugby7", "golf4"}, streamIDs)
+}
@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"time"
+)
+
+// number of users whose leases are expired per page of users
+const sweepPageSize = 100
+
+// Sweeper periodically removes the streams whose leases have expired and notifies the players of their users, so
+// that they learn a stream ended even when no further request is made for the user; leases expired by several
+// instances are only reported by the instance removing them
+type Sweeper struct {
+	logger   *zap.SugaredLogger
+	store    Store
+	notifier Notifier
+	interval time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewSweeper creates a new sweeper expiring the leases held in the store at each interval
+func NewSweeper(logger *zap.SugaredLogger, store Store, notifier Notifier, interval time.Duration) *Sweeper {
+	return &Sweeper{
+		logger:   logger,
+		store:    store,
+		notifier: notifier,
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start sweeps the store in the background until the sweeper is stopped
+func (s *Sweeper) Start() {
+	go s.run()
+}
+
+// Stop stops sweeping the store and waits for a sweep in progress to complete
+func (s *Sweeper) Stop() {
+	close(s.stop)
+	<-s.done
+}
+
+func (s *Sweeper) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), s.interval)
+			if err := s.Sweep(ctx); err != nil {
+				s.logger.Errorw(
+					"cannot sweep expired streams",
+					"error", err,
+				)
+			}
+			cancel()
+		}
+	}
+}
+
+// Sweep removes the expired streams of every user and notifies their players, returning the first error listing the
+// users; users whose streams cannot be expired are skipped until the next sweep
+func (s *Sweeper) Sweep(ctx context.Context) error {
+	var cursor uint64
+	for {
+		userIDs, next, err := s.store.ListUsers(ctx, cursor, sweepPageSize)
+		if err != nil {
+			return errors.Wrap(err, "cannot list users")
+		}
+		for _, userID := range userIDs {
+			change, err := s.store.ExpireStreams(ctx, userID)
+			if err != nil {
+				s.logger.Errorw(
+					"cannot expire streams",
+					"userID", userID,
+					"error", err,
+				)
+				continue
+			}
+			notifyExpired(ctx, s.logger, s.notifier, userID, change.Expired)
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
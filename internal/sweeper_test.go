@@ -0,0 +1,40 @@
+package internal
+
+import (
+	"context"
+	"github.com/prgodlonton/stream-controller/internal/session"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestSweeperShouldNotifyPlayersOfStreamsWhoseLeasesExpired(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	store := NewMemoryStore(NewMemoryQuotas(2), time.Minute).(*MemoryStore)
+	store.now = clock.Now
+	notifier := NewMemoryNotifier()
+	events, unsubscribe := notifier.Subscribe("alan")
+	defer unsubscribe()
+
+	assert.NoError(t, addStream(store, "alan", "boxing1", session.Device{}))
+	assert.NoError(t, addStream(store, "becky", "rugby7", session.Device{}))
+	clock.Advance(30 * time.Second)
+	assert.NoError(t, addStream(store, "alan", "tennis2", session.Device{}))
+	clock.Advance(45 * time.Second)
+
+	sweeper := NewSweeper(noopLogger, store, notifier, time.Minute)
+	assert.NoError(t, sweeper.Sweep(context.Background()))
+	event := receiveEvent(t, events)
+	assert.Equal(t, SessionExpiredEvent, event.Type)
+	assert.Equal(t, "boxing1", event.StreamID)
+
+	assert.NoError(t, sweeper.Sweep(context.Background()))
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected event %+v", event)
+	default:
+	}
+	streamIDs, err := store.GetStreams(context.Background(), "alan")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"tennis2"}, streamIDs)
+}
@@ -0,0 +1,126 @@
+package internal
+
+import (
+	"github.com/go-chi/chi"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"net/http"
+	"regexp"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// DefaultMaxIDLength maximum length in bytes of user and stream IDs by default
+	DefaultMaxIDLength = 128
+
+	// DefaultIDPattern pattern matched by user and stream IDs by default; it excludes the colons and braces found in
+	// redis keys, whitespace and control characters
+	DefaultIDPattern = `^[A-Za-z0-9._@-]+$`
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// IDValidator checks user and stream IDs before they are used as redis keys and members; IDs must never be empty,
+// hold invalid UTF-8 or control characters
+type IDValidator struct {
+	maxLength     int
+	pattern       *regexp.Regexp
+	uuidUserIDs   bool
+	uuidStreamIDs bool
+}
+
+// NewIDValidator creates a new validator of IDs of at most the maximum length in bytes matching the pattern, which
+// is not checked if it is empty; user or stream IDs may additionally be required to be UUIDs
+func NewIDValidator(maxLength int, pattern string, uuidUserIDs, uuidStreamIDs bool) (*IDValidator, error) {
+	if maxLength < 1 {
+		return nil, errors.New("maximum id length must be at least 1")
+	}
+	v := &IDValidator{
+		maxLength:     maxLength,
+		uuidUserIDs:   uuidUserIDs,
+		uuidStreamIDs: uuidStreamIDs,
+	}
+	if pattern != "" {
+		var err error
+		if v.pattern, err = regexp.Compile(pattern); err != nil {
+			return nil, errors.Wrap(err, "cannot compile id pattern")
+		}
+	}
+	return v, nil
+}
+
+// defaultIDValidator returns the validator of IDs used unless another is configured
+func defaultIDValidator() *IDValidator {
+	return &IDValidator{
+		maxLength: DefaultMaxIDLength,
+		pattern:   regexp.MustCompile(DefaultIDPattern),
+	}
+}
+
+// ValidateUserID returns an error describing why the user ID is invalid, naming it as the given field, or nil if it
+// is valid
+func (v *IDValidator) ValidateUserID(field, userID string) error {
+	return v.validate(field, userID, v.uuidUserIDs)
+}
+
+// ValidateStreamID returns an error describing why the stream ID is invalid, naming it as the given field, or nil if
+// it is valid
+func (v *IDValidator) ValidateStreamID(field, streamID string) error {
+	return v.validate(field, streamID, v.uuidStreamIDs)
+}
+
+func (v *IDValidator) validate(field, id string, uuid bool) error {
+	switch {
+	case id == "":
+		return errors.Errorf("%s must not be empty", field)
+	case len(id) > v.maxLength:
+		return errors.Errorf("%s must be at most %d characters", field, v.maxLength)
+	case !utf8.ValidString(id) || containsControl(id):
+		return errors.Errorf("%s must not contain control characters or invalid UTF-8", field)
+	case uuid && !uuidPattern.MatchString(id):
+		return errors.Errorf("%s must be a UUID", field)
+	case v.pattern != nil && !v.pattern.MatchString(id):
+		return errors.Errorf("%s must match %s", field, v.pattern)
+	}
+	return nil
+}
+
+func containsControl(s string) bool {
+	for _, r := range s {
+		if unicode.IsControl(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// invalidID returns the problem reported when the ID given by the field is invalid
+func invalidID(field string, err error) *problem {
+	p := newProblem(http.StatusBadRequest, invalidIDCode, "Invalid identifier")
+	p.Detail = err.Error()
+	p.Field = field
+	return p
+}
+
+// validateURLParam middleware rejecting requests whose user or stream ID URL parameter is invalid
+func validateURLParam(logger *zap.SugaredLogger, v *IDValidator, name string) func(http.Handler) http.Handler {
+	validate := v.ValidateUserID
+	if name == "streamID" {
+		validate = v.ValidateStreamID
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := validate(name, chi.URLParam(r, name)); err != nil {
+				logger.Debugw(
+					"invalid url parameter",
+					"param", name,
+					"error", err,
+				)
+				writeProblem(logger, w, invalidID(name, err))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/golang/mock/gomock"
+	"github.com/prgodlonton/stream-controller/internal/session"
+	"github.com/prgodlonton/stream-controller/testing/mocks"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestShouldRejectInvalidIDsUnderDefaultRules(t *testing.T) {
+	ids := defaultIDValidator()
+
+	for _, id := range []string{"alan", "boxing1", "becky.jones@example.com", "7c9e6679-7425-40de-944b-e07fc1f90ae7"} {
+		assert.NoError(t, ids.ValidateUserID("userID", id), id)
+	}
+	invalid := map[string]string{
+		"":                       "userID must not be empty",
+		strings.Repeat("a", 129): "userID must be at most 128 characters",
+		"alan\n":                 "userID must not contain control characters or invalid UTF-8",
+		"alan\xff":               "userID must not contain control characters or invalid UTF-8",
+		"user:{alan}":            "userID must match ^[A-Za-z0-9._@-]+$",
+		"alan smith":             "userID must match ^[A-Za-z0-9._@-]+$",
+	}
+	for id, message := range invalid {
+		assert.EqualError(t, ids.ValidateUserID("userID", id), message, id)
+	}
+}
+
+func TestShouldRequireUUIDsWhenConfigured(t *testing.T) {
+	ids, err := NewIDValidator(36, "", false, true)
+	assert.NoError(t, err)
+
+	assert.NoError(t, ids.ValidateUserID("userID", "alan smith"))
+	assert.NoError(t, ids.ValidateStreamID("streamID", "7c9e6679-7425-40de-944b-e07fc1f90ae7"))
+	assert.EqualError(t, ids.ValidateStreamID("streamID", "boxing1"), "streamID must be a UUID")
+
+	_, err = NewIDValidator(36, "[", false, false)
+	assert.Error(t, err)
+}
+
+func TestShouldReturnBadRequestGivingFieldWhenIDIsInvalid(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	router := NewRouter(noopLogger, mocks.NewMockStore(mockCtrl))
+	paths := map[string]string{
+		"/v1/users/alan:1/streams/boxing1":                           "userID",
+		"/v1/users/" + strings.Repeat("a", 200) + "/streams/boxing1": "userID",
+		"/v1/users/alan/streams/" + strings.Repeat("b", 200):         "streamID",
+		"/v1/users/alan/streams/boxing%0A1/heartbeat":                "streamID",
+	}
+	for path, field := range paths {
+		method := "PUT"
+		if strings.HasSuffix(path, "/heartbeat") {
+			method = "POST"
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+
+		assert.Equal(t, http.StatusBadRequest, w.Code, path)
+		var p problem
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &p))
+		assert.Equal(t, invalidIDCode, p.Code, path)
+		assert.Equal(t, field, p.Field, path)
+	}
+}
+
+func FuzzRouterShouldNotPassInvalidIDsToStore(f *testing.F) {
+	f.Add("alan", "boxing1")
+	f.Add("", "rugby7")
+	f.Add("user:{becky}", "tennis2")
+	f.Add("charles", "golf4\x00")
+	f.Add(strings.Repeat("d", 129), "squash5")
+	f.Add("edward", "7c9e6679-7425-40de-944b-e07fc1f90ae7")
+	f.Add("frank%2F", "darts2\xff")
+	ids := defaultIDValidator()
+	f.Fuzz(func(t *testing.T, userID, streamID string) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		// the store fails the test unless it is only given valid IDs
+		check := func(userID, streamID string) {
+			if err := ids.ValidateUserID("userID", userID); err != nil {
+				t.Fatalf("store reached with invalid user id %q: %v", userID, err)
+			}
+			if err := ids.ValidateStreamID("streamID", streamID); err != nil {
+				t.Fatalf("store reached with invalid stream id %q: %v", streamID, err)
+			}
+		}
+		store := mocks.NewMockStore(mockCtrl)
+		store.EXPECT().AddStream(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().DoAndReturn(
+			func(_ context.Context, userID, streamID string, _ session.Device) (session.Change, error) {
+				check(userID, streamID)
+				return session.Change{}, nil
+			},
+		)
+		store.EXPECT().RemoveStream(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().DoAndReturn(
+			func(_ context.Context, userID, streamID string) (session.Change, error) {
+				check(userID, streamID)
+				return session.Change{}, nil
+			},
+		)
+		store.EXPECT().RenewStream(gomock.Any(), gomock.Any(), gomock.Any()).AnyTimes().DoAndReturn(
+			func(_ context.Context, userID, streamID string) (session.Change, error) {
+				check(userID, streamID)
+				return session.Change{}, nil
+			},
+		)
+		store.EXPECT().GetStreams(gomock.Any(), gomock.Any()).AnyTimes().DoAndReturn(
+			func(_ context.Context, userID string) ([]string, error) {
+				check(userID, "boxing1")
+				return nil, nil
+			},
+		)
+		store.EXPECT().GetLimit(gomock.Any(), gomock.Any()).AnyTimes().Return(3, nil)
+		store.EXPECT().Apply(gomock.Any(), gomock.Any()).AnyTimes().DoAndReturn(
+			func(_ context.Context, operations []session.Operation) ([]session.Result, error) {
+				for _, op := range operations {
+					check(op.UserID, op.StreamID)
+				}
+				return make([]session.Result, len(operations)), nil
+			},
+		)
+
+		router := NewRouter(noopLogger, store)
+		streamPath := "/v1/users/" + userID + "/streams/" + streamID
+		requests := []*http.Request{
+			fuzzRequest("PUT", streamPath, ""),
+			fuzzRequest("DELETE", streamPath, ""),
+			fuzzRequest("POST", streamPath+"/heartbeat", ""),
+			fuzzRequest("GET", "/v1/users/"+userID, ""),
+		}
+		if body, err := json.Marshal(batchRequest{Operations: []batchOperation{
+			{Op: session.StartOperation, UserID: userID, StreamID: streamID},
+		}}); err == nil {
+			requests = append(requests, fuzzRequest("POST", "/v1/batch", string(body)))
+		}
+		for _, r := range requests {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+		}
+	})
+}
+
+// fuzzRequest creates a request for the unescaped path, which may hold any characters, as received by the router
+func fuzzRequest(method, path, body string) *http.Request {
+	r := httptest.NewRequest(method, "/", strings.NewReader(body))
+	r.URL.Path, r.URL.RawPath = path, ""
+	return r
+}
@@ -1,23 +1,50 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"github.com/prgodlonton/stream-controller/internal"
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"os"
 	"sort"
 	"strings"
 	"testing"
+	"time"
 )
 
 const (
-	host = "http://localhost:8080/v1/users"
+	// ServerAddr environment variable holding the address of a running server to test against
+	ServerAddr = "STREAM_CONTROLLER_ADDRESS"
 )
 
 var (
 	client = &http.Client{}
+	host   string
 )
 
+// TestMain runs the tests against the server at ServerAddr or, when it is not set, a self-contained in-memory server
+func TestMain(m *testing.M) {
+	if address := os.Getenv(ServerAddr); address != "" {
+		host = address + "/v1/users"
+		os.Exit(m.Run())
+	}
+
+	server := httptest.NewServer(
+		internal.NewRouter(
+			zap.NewNop().Sugar(),
+			internal.NewMemoryStore(internal.NewMemoryQuotas(3), time.Minute),
+		),
+	)
+	host = server.URL + "/v1/users"
+	code := m.Run()
+	server.Close()
+	os.Exit(code)
+}
+
 // TestEndToEndScenarioForTwoUsers tests a simple scenario for two persons' hypothetical viewing habits
 func TestEndToEndScenarioForTwoUsers(t *testing.T) {
 	as := assert.New(t)
@@ -36,7 +63,7 @@ func TestEndToEndScenarioForTwoUsers(t *testing.T) {
 
 	// charles tries to watch karate and golf but exceeds his quota for the golf
 	as.Equal(http.StatusCreated, watchStream("charles", "karate3"))
-	as.Equal(http.StatusBadRequest, watchStream("charles", "golf4"))
+	as.Equal(http.StatusConflict, watchStream("charles", "golf4"))
 	as.Equal([]string{"boxing1", "cycling2", "karate3"}, streamsWatched("charles"))
 
 	// charles turns off boxing to watch golf
@@ -57,6 +84,19 @@ func TestEndToEndScenarioForTwoUsers(t *testing.T) {
 	as.Equal([]string{""}, streamsWatched("becky"))
 }
 
+// TestEndToEndScenarioForJSONClient tests that a JSON client receives the streams being watched as a JSON list
+func TestEndToEndScenarioForJSONClient(t *testing.T) {
+	as := assert.New(t)
+
+	// dorothy starts watching
+	as.Equal(http.StatusCreated, watchStream("dorothy", "squash5"))
+	as.Equal([]string{"squash5"}, streamsWatchedAsJSON("dorothy"))
+
+	// dorothy stops watching
+	as.Equal(http.StatusOK, finishStream("dorothy", "squash5"))
+	as.Equal([]string{}, streamsWatchedAsJSON("dorothy"))
+}
+
 func watchStream(userID, streamID string) int {
 	req, err := http.NewRequest(
 		"PUT",
@@ -98,6 +138,28 @@ func streamsWatched(userID string) []string {
 	return streamIDs
 }
 
+func streamsWatchedAsJSON(userID string) []string {
+	req, err := http.NewRequest(
+		"GET",
+		fmt.Sprintf("%v/%v", host, userID),
+		nil,
+	)
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("Accept", "application/json")
+	_, body := call(req)
+
+	var streams struct {
+		StreamIDs []string `json:"streams"`
+	}
+	if err := json.Unmarshal([]byte(body), &streams); err != nil {
+		panic(err)
+	}
+	sort.Strings(streams.StreamIDs)
+	return streams.StreamIDs
+}
+
 func call(req *http.Request) (int, string) {
 	resp, err := client.Do(req)
 	if err != nil {
@@ -5,8 +5,11 @@
 package mocks
 
 import (
+	context "context"
 	gomock "github.com/golang/mock/gomock"
+	session "github.com/prgodlonton/stream-controller/internal/session"
 	reflect "reflect"
+	time "time"
 )
 
 // MockStore is a mock of Store interface
@@ -33,44 +36,166 @@ func (m *MockStore) EXPECT() *MockStoreMockRecorder {
 }
 
 // AddStream mocks base method
-func (m *MockStore) AddStream(arg0, arg1 string) error {
+func (m *MockStore) AddStream(arg0 context.Context, arg1, arg2 string, arg3 session.Device) (session.Change, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "AddStream", arg0, arg1)
-	ret0, _ := ret[0].(error)
-	return ret0
+	ret := m.ctrl.Call(m, "AddStream", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(session.Change)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
 }
 
 // AddStream indicates an expected call of AddStream
-func (mr *MockStoreMockRecorder) AddStream(arg0, arg1 interface{}) *gomock.Call {
+func (mr *MockStoreMockRecorder) AddStream(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddStream", reflect.TypeOf((*MockStore)(nil).AddStream), arg0, arg1, arg2, arg3)
+}
+
+// Apply mocks base method
+func (m *MockStore) Apply(arg0 context.Context, arg1 []session.Operation) ([]session.Result, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Apply", arg0, arg1)
+	ret0, _ := ret[0].([]session.Result)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Apply indicates an expected call of Apply
+func (mr *MockStoreMockRecorder) Apply(arg0, arg1 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddStream", reflect.TypeOf((*MockStore)(nil).AddStream), arg0, arg1)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Apply", reflect.TypeOf((*MockStore)(nil).Apply), arg0, arg1)
+}
+
+// ExpireStreams mocks base method
+func (m *MockStore) ExpireStreams(arg0 context.Context, arg1 string) (session.Change, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ExpireStreams", arg0, arg1)
+	ret0, _ := ret[0].(session.Change)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ExpireStreams indicates an expected call of ExpireStreams
+func (mr *MockStoreMockRecorder) ExpireStreams(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ExpireStreams", reflect.TypeOf((*MockStore)(nil).ExpireStreams), arg0, arg1)
+}
+
+// GetLimit mocks base method
+func (m *MockStore) GetLimit(arg0 context.Context, arg1 string) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetLimit", arg0, arg1)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetLimit indicates an expected call of GetLimit
+func (mr *MockStoreMockRecorder) GetLimit(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetLimit", reflect.TypeOf((*MockStore)(nil).GetLimit), arg0, arg1)
+}
+
+// GetSessions mocks base method
+func (m *MockStore) GetSessions(arg0 context.Context, arg1 string) ([]session.Session, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetSessions", arg0, arg1)
+	ret0, _ := ret[0].([]session.Session)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetSessions indicates an expected call of GetSessions
+func (mr *MockStoreMockRecorder) GetSessions(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetSessions", reflect.TypeOf((*MockStore)(nil).GetSessions), arg0, arg1)
 }
 
 // GetStreams mocks base method
-func (m *MockStore) GetStreams(arg0 string) ([]string, error) {
+func (m *MockStore) GetStreams(arg0 context.Context, arg1 string) ([]string, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetStreams", arg0)
+	ret := m.ctrl.Call(m, "GetStreams", arg0, arg1)
 	ret0, _ := ret[0].([]string)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // GetStreams indicates an expected call of GetStreams
-func (mr *MockStoreMockRecorder) GetStreams(arg0 interface{}) *gomock.Call {
+func (mr *MockStoreMockRecorder) GetStreams(arg0, arg1 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetStreams", reflect.TypeOf((*MockStore)(nil).GetStreams), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetStreams", reflect.TypeOf((*MockStore)(nil).GetStreams), arg0, arg1)
+}
+
+// ListUsers mocks base method
+func (m *MockStore) ListUsers(arg0 context.Context, arg1 uint64, arg2 int64) ([]string, uint64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListUsers", arg0, arg1, arg2)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(uint64)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// ListUsers indicates an expected call of ListUsers
+func (mr *MockStoreMockRecorder) ListUsers(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListUsers", reflect.TypeOf((*MockStore)(nil).ListUsers), arg0, arg1, arg2)
+}
+
+// RemoveAllStreams mocks base method
+func (m *MockStore) RemoveAllStreams(arg0 context.Context, arg1 string) (session.Change, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RemoveAllStreams", arg0, arg1)
+	ret0, _ := ret[0].(session.Change)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RemoveAllStreams indicates an expected call of RemoveAllStreams
+func (mr *MockStoreMockRecorder) RemoveAllStreams(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RemoveAllStreams", reflect.TypeOf((*MockStore)(nil).RemoveAllStreams), arg0, arg1)
 }
 
 // RemoveStream mocks base method
-func (m *MockStore) RemoveStream(arg0, arg1 string) error {
+func (m *MockStore) RemoveStream(arg0 context.Context, arg1, arg2 string) (session.Change, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RemoveStream", arg0, arg1, arg2)
+	ret0, _ := ret[0].(session.Change)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RemoveStream indicates an expected call of RemoveStream
+func (mr *MockStoreMockRecorder) RemoveStream(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RemoveStream", reflect.TypeOf((*MockStore)(nil).RemoveStream), arg0, arg1, arg2)
+}
+
+// RenewStream mocks base method
+func (m *MockStore) RenewStream(arg0 context.Context, arg1, arg2 string) (session.Change, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "RemoveStream", arg0, arg1)
+	ret := m.ctrl.Call(m, "RenewStream", arg0, arg1, arg2)
+	ret0, _ := ret[0].(session.Change)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RenewStream indicates an expected call of RenewStream
+func (mr *MockStoreMockRecorder) RenewStream(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RenewStream", reflect.TypeOf((*MockStore)(nil).RenewStream), arg0, arg1, arg2)
+}
+
+// SetLimit mocks base method
+func (m *MockStore) SetLimit(arg0 context.Context, arg1 string, arg2 int, arg3 time.Duration) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetLimit", arg0, arg1, arg2, arg3)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
-// RemoveStream indicates an expected call of RemoveStream
-func (mr *MockStoreMockRecorder) RemoveStream(arg0, arg1 interface{}) *gomock.Call {
+// SetLimit indicates an expected call of SetLimit
+func (mr *MockStoreMockRecorder) SetLimit(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RemoveStream", reflect.TypeOf((*MockStore)(nil).RemoveStream), arg0, arg1)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetLimit", reflect.TypeOf((*MockStore)(nil).SetLimit), arg0, arg1, arg2, arg3)
 }